@@ -23,9 +23,6 @@ type WriteBatch struct {
 }
 
 func (db *DB) NewWriteBatch(opt WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPtree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seq no file not exists")
-	}
 	return &WriteBatch{
 		options:       opt,
 		lo:            new(sync.Mutex),
@@ -35,8 +32,13 @@ func (db *DB) NewWriteBatch(opt WriteBatchOptions) *WriteBatch {
 }
 
 func (wb *WriteBatch) Put(key, value []byte) error {
-	if len(key) == 0 {
-		return utils.ErrKeyIsEmpty
+	err := wb.db.checkKeySize(key)
+	if err != nil {
+		return err
+	}
+	err = wb.db.checkValueSize(key, int64(len(value)), false)
+	if err != nil {
+		return err
 	}
 	wb.lo.Lock()
 	defer wb.lo.Unlock()
@@ -50,8 +52,8 @@ func (wb *WriteBatch) Put(key, value []byte) error {
 }
 
 func (wb *WriteBatch) Delete(key []byte) error {
-	if len(key) == 0 {
-		return utils.ErrKeyIsEmpty
+	if err := checkUserKey(key); err != nil {
+		return err
 	}
 	wb.lo.Lock()
 	defer wb.lo.Unlock()
@@ -84,23 +86,56 @@ func (wb *WriteBatch) Commit() error {
 	wb.db.lo.Lock()
 	defer wb.db.lo.Unlock()
 
+	records := make([]*data.LogRecord, 0, len(wb.pendingWrites))
+	for _, record := range wb.pendingWrites {
+		records = append(records, record)
+	}
+	if err := wb.db.commitRecords(records, wb.options.SyncWrite); err != nil {
+		return err
+	}
+
+	// 清空暂存的数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+}
+
+// 在一个事务中写入 records 并更新索引，records 中的 key 不能重复，调用时需要持有数据库的锁
+// 有二级索引时，索引数据的变化也会加入到同一个事务中
+func (db *DB) commitRecords(records []*data.LogRecord, sync bool) error {
+	indexRecords, entryNum, err := db.secondaryIndexRecords(records)
+	if err != nil {
+		return err
+	}
+	records = append(records, indexRecords...)
+
+	// 提前检查磁盘空间，避免写入一部分之后才失败
+	var size int64
+	for _, record := range records {
+		size += int64(len(record.Key) + len(record.Value))
+	}
+	if db.readOnly {
+		return utils.ErrReadOnly
+	}
+	if err := db.checkDiskUsage(size); err != nil {
+		return err
+	}
+
 	// 获取当前事物的序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 将写单条数据先暂存起来，直到全部运行完之后再进行更新
-	position := make(map[string]*data.LogRecordPos)
-	for _, recode := range wb.pendingWrites {
-		seq := logRecordKeyWithSeq(recode.Key, seqNo)
-		record, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   seq,
-			Type:  recode.Type,
-			Value: recode.Value,
+	positions := make([]*data.LogRecordPos, len(records))
+	for i, record := range records {
+		pos, err := db.appendLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(record.Key, seqNo),
+			Type:  record.Type,
+			Value: record.Value,
 		})
 		if err != nil {
 			return err
 		}
-
-		position[string(recode.Key)] = record
+		positions[i] = pos
 	}
 	// 事物完成最后再加一条
 	d := &data.LogRecord{
@@ -109,32 +144,34 @@ func (wb *WriteBatch) Commit() error {
 	}
 
 	// 把事务完成的标识加入db中
-	_, err := wb.db.appendLogRecord(d)
+	_, err = db.appendLogRecord(d)
 	if err != nil {
 		return err
 	}
 
 	// 如果事务内的record全部完成，就根据配置进行持久化
-	if wb.options.SyncWrite && wb.db.activeFiles != nil {
-		err := wb.db.activeFiles.Sync()
+	if sync && db.activeFile() != nil {
+		err := db.syncActiveFile()
 		if err != nil {
 			return err
 		}
 	}
 
-	// 更新索引
-	for _, record := range wb.pendingWrites {
-		pos := position[string(record.Key)]
-		if record.Type == data.LogRecordNormal {
-			wb.db.index.Put(record.Key, pos)
-		} else if record.Type == data.LogRecordDelete {
-			wb.db.index.Delete(record.Key)
+	// 批量更新索引，B+ 树索引只需要一个事务，磁盘哈希索引每个桶只需要写一次
+	var putKeys, deleteKeys [][]byte
+	var putPositions []*data.LogRecordPos
+	for i, record := range records {
+		if record.Type == data.LogRecordDelete {
+			deleteKeys = append(deleteKeys, record.Key)
+		} else {
+			putKeys = append(putKeys, record.Key)
+			putPositions = append(putPositions, positions[i])
 		}
 	}
-
-	// 清空暂存的数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
+	if !db.applyIndex(putKeys, putPositions, deleteKeys) {
+		return utils.ErrIndexUpdateFailed
+	}
+	db.secondaryEntryNum = entryNum
 	return nil
 }
 
@@ -84,3 +84,81 @@ func TestDB_NewWriteBatch1(t *testing.T) {
 	t.Log(get)
 	t.Log(err)
 }
+
+func TestDB_WriteBatchBPtree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPtree
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	options := DefaultWriteBatchOptions
+	options.MaxBatchNum = 20000
+	wb := db.NewWriteBatch(options)
+	for i := 0; i < 10000; i++ {
+		err = wb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, db.index.Size())
+
+	wb = db.NewWriteBatch(options)
+	for i := 0; i < 5000; i++ {
+		err = wb.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = wb.Put([]byte("new"), []byte("new"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 5001, db.index.Size())
+
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	value, err := db.Get(utils.GetTestKey(9999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(9999), value)
+}
+
+func TestDB_WriteBatchReplay(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-replay")
+	opts.DirPath = dir
+	opts.IndexSnapshot = false
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	// 同一个 key 多次更新，重启后以最后一次为准
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, db.Delete([]byte("a")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, db.Put([]byte("b"), []byte("1")))
+	assert.Nil(t, db.Delete([]byte("b")))
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("b"), []byte("2")))
+	assert.Nil(t, wb.Put([]byte("c"), []byte("1")))
+	assert.Nil(t, wb.Commit())
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Delete([]byte("c")))
+	assert.Nil(t, wb.Commit())
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+
+	value, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+	value, err = db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+	_, err = db.Get([]byte("c"))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+}
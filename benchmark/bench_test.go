@@ -5,6 +5,7 @@ import (
 	"github.com/lustresix/lxdb/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"runtime"
 	"testing"
 )
 
@@ -49,3 +50,42 @@ func Benchmark_Get(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+func benchmarkOpen(b *testing.B, workers int) {
+	option := LustreDB.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bench-open")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	option.DirPath = dir
+	option.DataFileSize = 4 * 1024 * 1024
+	option.IndexSnapshot = false
+	option.IndexLoadWorkers = workers
+
+	openDB, err := LustreDB.Open(option)
+	assert.Nil(b, err)
+	for i := 0; i < 100000; i++ {
+		err := openDB.Put(utils.GetTestKey(i), utils.RandomValue(256))
+		assert.Nil(b, err)
+	}
+	err = openDB.Close()
+	assert.Nil(b, err)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		openDB, err := LustreDB.Open(option)
+		assert.Nil(b, err)
+		b.StopTimer()
+		_ = openDB.Close()
+		b.StartTimer()
+	}
+}
+
+func Benchmark_Open(b *testing.B) {
+	benchmarkOpen(b, 1)
+}
+
+func Benchmark_OpenParallel(b *testing.B) {
+	benchmarkOpen(b, runtime.NumCPU())
+}
@@ -0,0 +1,264 @@
+package benchmark
+
+import (
+	"bytes"
+	"github.com/google/btree"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
+	"github.com/lustresix/lxdb/utils"
+	goart "github.com/plar/go-adaptive-radix-tree"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+const indexBenchKeys = 100000
+
+// 并发读写索引，每 writeEvery 次操作中有一次写入
+func benchmarkIndexReadWrite(b *testing.B, indexer index.Indexer, writeEvery int) {
+	keys := make([][]byte, indexBenchKeys)
+	for i := range keys {
+		keys[i] = utils.GetTestKey(i)
+		indexer.Put(keys[i], &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	pos := &data.LogRecordPos{Fid: 2, Offset: 100}
+
+	var seed int64
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt64(&seed, 1)) * 7919
+		for pb.Next() {
+			key := keys[i%indexBenchKeys]
+			if i%writeEvery == 0 {
+				indexer.Put(key, pos)
+			} else {
+				indexer.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func Benchmark_IndexReadWrite_BTree(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewBtree(), 4)
+}
+
+func Benchmark_IndexReadWrite_ShardedBTree(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewShardedIndex(index.Btree, index.DefaultShardNum), 4)
+}
+
+func Benchmark_IndexReadWrite_ART(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewArt(), 4)
+}
+
+func Benchmark_IndexReadWrite_ShardedART(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewShardedIndex(index.ART, index.DefaultShardNum), 4)
+}
+
+func Benchmark_IndexReadWrite_SkipList(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewSkipList(), 4)
+}
+
+func Benchmark_IndexReadMostly_BTree(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewBtree(), 20)
+}
+
+func Benchmark_IndexReadMostly_ART(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewArt(), 20)
+}
+
+func Benchmark_IndexReadMostly_ShardedART(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewShardedIndex(index.ART, index.DefaultShardNum), 20)
+}
+
+func Benchmark_IndexReadMostly_SkipList(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewSkipList(), 20)
+}
+
+// 创建迭代器并 Seek 读取一个 key，不应该和索引中的数据量相关
+func benchmarkIndexSeek(b *testing.B, indexer index.Indexer) {
+	for i := 0; i < indexBenchKeys; i++ {
+		indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		iterator := indexer.Iterator(false)
+		iterator.Seek(utils.GetTestKey(i % indexBenchKeys))
+		if !iterator.Valid() {
+			b.Fatal("seek failed")
+		}
+		iterator.Close()
+	}
+}
+
+func Benchmark_IndexSeek_BTree(b *testing.B) {
+	benchmarkIndexSeek(b, index.NewBtree())
+}
+
+func Benchmark_IndexSeek_ART(b *testing.B) {
+	benchmarkIndexSeek(b, index.NewArt())
+}
+
+func Benchmark_IndexSeek_SkipList(b *testing.B) {
+	benchmarkIndexSeek(b, index.NewSkipList())
+}
+
+// 顺序遍历所有的 key
+func benchmarkIndexScan(b *testing.B, indexer index.Indexer) {
+	for i := 0; i < indexBenchKeys; i++ {
+		indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		iterator := indexer.Iterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		}
+		iterator.Close()
+	}
+}
+
+func Benchmark_IndexScan_BTree(b *testing.B) {
+	benchmarkIndexScan(b, index.NewBtree())
+}
+
+func Benchmark_IndexScan_ART(b *testing.B) {
+	benchmarkIndexScan(b, index.NewArt())
+}
+
+func Benchmark_IndexScan_SkipList(b *testing.B) {
+	benchmarkIndexScan(b, index.NewSkipList())
+}
+
+func Benchmark_IndexReadWrite_Hash(b *testing.B) {
+	benchmarkIndexReadWrite(b, index.NewHashIndex(index.DefaultShardNum), 4)
+}
+
+// 写入 indexBenchKeys 个 key 之后索引占用的堆内存，key 和位置信息本身也计算在内
+// 通过 B/key 指标比较不同索引每个 key 的内存占用
+// 只需要写入的索引，用来和改用紧凑存储之前的布局比较
+type memoryIndexer interface {
+	Put(key []byte, pos *data.LogRecordPos) bool
+}
+
+func benchmarkIndexMemory(b *testing.B, newIndexer func() memoryIndexer) {
+	var bytesPerKey float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		indexer := newIndexer()
+		for j := 0; j < indexBenchKeys; j++ {
+			indexer.Put(utils.GetTestKey(j), &data.LogRecordPos{Fid: 1, Offset: int64(j)})
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		bytesPerKey = float64(after.HeapAlloc-before.HeapAlloc) / indexBenchKeys
+		runtime.KeepAlive(indexer)
+	}
+	b.ReportMetric(bytesPerKey, "B/key")
+}
+
+func Benchmark_IndexMemory_BTree(b *testing.B) {
+	benchmarkIndexMemory(b, func() memoryIndexer { return index.NewBtree() })
+}
+
+// 之前的 BTree 布局：每个条目单独分配，保存 key 的切片和指向位置信息的指针
+func Benchmark_IndexMemory_BTreeBaseline(b *testing.B) {
+	benchmarkIndexMemory(b, func() memoryIndexer { return &baselineBTree{tree: btree.New(32)} })
+}
+
+func Benchmark_IndexMemory_ART(b *testing.B) {
+	benchmarkIndexMemory(b, func() memoryIndexer { return index.NewArt() })
+}
+
+// 之前的 ART：go-adaptive-radix-tree，叶子节点保存 key 的拷贝和指向位置信息的指针
+func Benchmark_IndexMemory_ARTBaseline(b *testing.B) {
+	benchmarkIndexMemory(b, func() memoryIndexer { return &baselineArt{tree: goart.New()} })
+}
+
+func Benchmark_IndexMemory_SkipList(b *testing.B) {
+	benchmarkIndexMemory(b, func() memoryIndexer { return index.NewSkipList() })
+}
+
+func Benchmark_IndexMemory_Hash(b *testing.B) {
+	benchmarkIndexMemory(b, func() memoryIndexer { return index.NewHashIndex(index.DefaultShardNum) })
+}
+
+type baselineItem struct {
+	key []byte
+	pos *data.LogRecordPos
+}
+
+func (bi *baselineItem) Less(than btree.Item) bool {
+	return bytes.Compare(bi.key, than.(*baselineItem).key) < 0
+}
+
+type baselineBTree struct {
+	tree *btree.BTree
+}
+
+func (bt *baselineBTree) Put(key []byte, pos *data.LogRecordPos) bool {
+	bt.tree.ReplaceOrInsert(&baselineItem{key: key, pos: pos})
+	return true
+}
+
+type baselineArt struct {
+	tree goart.Tree
+}
+
+func (art *baselineArt) Put(key []byte, pos *data.LogRecordPos) bool {
+	art.tree.Insert(key, pos)
+	return true
+}
+
+// 随机写入保存在磁盘上的索引，比较单次写入的开销
+func benchmarkDiskIndexPut(b *testing.B, newIndexer func(dir string) index.Indexer) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-bench")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	indexer := newIndexer(dir)
+	defer func() {
+		_ = indexer.Close()
+	}()
+
+	keys := make([][]byte, indexBenchKeys)
+	positions := make([]*data.LogRecordPos, indexBenchKeys)
+	for i := range keys {
+		keys[i] = utils.GetTestKey(i)
+		positions[i] = &data.LogRecordPos{Fid: 1, Offset: int64(i)}
+	}
+	for i := 0; i < indexBenchKeys; i += 1000 {
+		indexer.PutBatch(keys[i:i+1000], positions[i:i+1000])
+	}
+	pos := &data.LogRecordPos{Fid: 2, Offset: 100}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		indexer.Put(keys[rand.Intn(indexBenchKeys)], pos)
+	}
+}
+
+func Benchmark_IndexPut_BPtree(b *testing.B) {
+	benchmarkDiskIndexPut(b, func(dir string) index.Indexer { return index.NewBPTree(dir, false) })
+}
+
+func Benchmark_IndexPut_DiskHash(b *testing.B) {
+	benchmarkDiskIndexPut(b, func(dir string) index.Indexer {
+		dh, err := index.NewDiskHashIndex(dir, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return dh
+	})
+}
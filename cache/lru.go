@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/lustresix/lxdb/data"
+	"sync"
+)
+
+// entryOverhead 每个缓存项除 value 之外的大致内存开销，计入容量
+const entryOverhead = 64
+
+// 缓存的 key，数据在磁盘上的位置是不可变的，所以可以直接作为 key
+type cacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type entry struct {
+	key   cacheKey
+	value []byte
+}
+
+// Cache 以数据位置为 key 的 value 缓存，按照字节数限制容量，超出后淘汰最久未使用的数据
+// 数据写入后位置不会再变化，所以不需要在更新数据时失效，只有数据文件被删除时需要清理
+type Cache struct {
+	// 容量，单位字节
+	capacity int64
+
+	// 当前已使用的字节数
+	size int64
+
+	lo    *sync.Mutex
+	ll    *list.List
+	items map[cacheKey]*list.Element
+}
+
+// NewCache 初始化缓存，capacity 为缓存的字节数上限
+func NewCache(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		lo:       new(sync.Mutex),
+		ll:       list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// Get 根据位置取出缓存的 value，返回的是一份拷贝
+func (c *Cache) Get(pos *data.LogRecordPos) ([]byte, bool) {
+	c.lo.Lock()
+	defer c.lo.Unlock()
+
+	elem, ok := c.items[cacheKey{fid: pos.Fid, offset: pos.Offset}]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	value := elem.Value.(*entry).value
+	return append([]byte(nil), value...), true
+}
+
+// Put 缓存位置对应的 value，会拷贝一份数据保存
+func (c *Cache) Put(pos *data.LogRecordPos, value []byte) {
+	cost := int64(len(value)) + entryOverhead
+	// 单个数据超过了容量就不缓存
+	if cost > c.capacity {
+		return
+	}
+
+	c.lo.Lock()
+	defer c.lo.Unlock()
+
+	key := cacheKey{fid: pos.Fid, offset: pos.Offset}
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	elem := c.ll.PushFront(&entry{key: key, value: append([]byte(nil), value...)})
+	c.items[key] = elem
+	c.size += cost
+
+	// 超过容量从尾部开始淘汰
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// RemoveFile 清理某个数据文件的所有缓存，数据文件被删除后文件 id 可能会被复用，所以必须清理
+func (c *Cache) RemoveFile(fid uint32) {
+	c.lo.Lock()
+	defer c.lo.Unlock()
+
+	for key, elem := range c.items {
+		if key.fid == fid {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// Size 当前已使用的字节数
+func (c *Cache) Size() int64 {
+	c.lo.Lock()
+	defer c.lo.Unlock()
+	return c.size
+}
+
+// Len 缓存的数据条数
+func (c *Cache) Len() int {
+	c.lo.Lock()
+	defer c.lo.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) removeElement(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.size -= int64(len(e.value)) + entryOverhead
+}
@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCache_PutGet(t *testing.T) {
+	c := NewCache(1024)
+	pos := &data.LogRecordPos{Fid: 1, Offset: 12}
+
+	_, ok := c.Get(pos)
+	assert.False(t, ok)
+
+	c.Put(pos, []byte("value"))
+	value, ok := c.Get(pos)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+
+	// 返回的是拷贝，修改不影响缓存
+	value[0] = 'x'
+	value, _ = c.Get(pos)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestCache_Evict(t *testing.T) {
+	c := NewCache(3 * (100 + entryOverhead))
+	for i := 0; i < 3; i++ {
+		c.Put(&data.LogRecordPos{Fid: 1, Offset: int64(i)}, make([]byte, 100))
+	}
+	assert.Equal(t, 3, c.Len())
+
+	// 访问第一个，淘汰的应该是第二个
+	_, ok := c.Get(&data.LogRecordPos{Fid: 1, Offset: 0})
+	assert.True(t, ok)
+	c.Put(&data.LogRecordPos{Fid: 1, Offset: 3}, make([]byte, 100))
+	assert.Equal(t, 3, c.Len())
+
+	_, ok = c.Get(&data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.False(t, ok)
+	_, ok = c.Get(&data.LogRecordPos{Fid: 1, Offset: 0})
+	assert.True(t, ok)
+	assert.LessOrEqual(t, c.Size(), int64(3*(100+entryOverhead)))
+
+	// 超过容量的数据不缓存
+	c.Put(&data.LogRecordPos{Fid: 1, Offset: 4}, make([]byte, 1024))
+	_, ok = c.Get(&data.LogRecordPos{Fid: 1, Offset: 4})
+	assert.False(t, ok)
+}
+
+func TestCache_RemoveFile(t *testing.T) {
+	c := NewCache(1024)
+	c.Put(&data.LogRecordPos{Fid: 1, Offset: 0}, []byte("a"))
+	c.Put(&data.LogRecordPos{Fid: 1, Offset: 10}, []byte("b"))
+	c.Put(&data.LogRecordPos{Fid: 2, Offset: 0}, []byte("c"))
+
+	c.RemoveFile(1)
+	assert.Equal(t, 1, c.Len())
+	_, ok := c.Get(&data.LogRecordPos{Fid: 1, Offset: 0})
+	assert.False(t, ok)
+	_, ok = c.Get(&data.LogRecordPos{Fid: 2, Offset: 0})
+	assert.True(t, ok)
+	assert.Equal(t, int64(1+entryOverhead), c.Size())
+}
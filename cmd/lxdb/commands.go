@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	LustreDB "github.com/lustresix/lxdb"
+	"github.com/lustresix/lxdb/data"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var errVerifyFailed = errors.New("data is corrupted")
+
+// JSON 输出中的一条数据，不是合法 UTF-8 的 key 或 value 使用 base64 编码
+type kvOutput struct {
+	Key           string `json:"key"`
+	KeyEncoding   string `json:"key_encoding,omitempty"`
+	Value         string `json:"value,omitempty"`
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
+
+func newKVOutput(key, value []byte) *kvOutput {
+	out := &kvOutput{}
+	out.Key, out.KeyEncoding = encodeField(key)
+	if value != nil {
+		out.Value, out.ValueEncoding = encodeField(value)
+	}
+	return out
+}
+
+func encodeField(field []byte) (string, string) {
+	if utf8.Valid(field) {
+		return string(field), ""
+	}
+	return base64.StdEncoding.EncodeToString(field), "base64"
+}
+
+// 人类可读的格式，不可打印的数据使用转义
+func formatField(field []byte) string {
+	if utf8.Valid(field) {
+		return string(field)
+	}
+	return strconv.Quote(string(field))
+}
+
+func (c *cli) printJSON(v any) error {
+	return json.NewEncoder(c.stdout).Encode(v)
+}
+
+func (c *cli) printOK() error {
+	if c.json {
+		return c.printJSON(map[string]string{"status": "ok"})
+	}
+	_, err := fmt.Fprintln(c.stdout, "OK")
+	return err
+}
+
+func getCmd(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	value, err := c.db.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(newKVOutput([]byte(args[0]), value))
+	}
+	_, err = fmt.Fprintln(c.stdout, formatField(value))
+	return err
+}
+
+func putCmd(c *cli, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	value := []byte(args[1])
+	if args[1] == "-" {
+		var err error
+		value, err = io.ReadAll(c.stdin)
+		if err != nil {
+			return err
+		}
+	}
+	err := c.db.Put([]byte(args[0]), value)
+	if err != nil {
+		return err
+	}
+	return c.printOK()
+}
+
+func delCmd(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	err := c.db.Delete([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	return c.printOK()
+}
+
+func scanCmd(c *cli, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prefix := flags.String("prefix", "", "key 的前缀")
+	start := flags.String("start", "", "起始 key（包含）")
+	end := flags.String("end", "", "结束 key（不包含）")
+	reverse := flags.Bool("reverse", false, "反向遍历")
+	limit := flags.Int("limit", 0, "最多输出的数量，0 表示不限制")
+	keysOnly := flags.Bool("keys", false, "只输出 key")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	iterator := c.db.NewIterator(LustreDB.IteratorOptions{
+		Prefix:  []byte(*prefix),
+		Reverse: *reverse,
+	})
+	defer iterator.Close()
+
+	// 正向遍历从 start 开始，反向遍历从 end 开始
+	iterator.Rewind()
+	if !*reverse && *start != "" {
+		iterator.Seek([]byte(*start))
+	} else if *reverse && *end != "" {
+		iterator.Seek([]byte(*end))
+	}
+
+	var count int
+	for ; iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if *start != "" && bytes.Compare(key, []byte(*start)) < 0 {
+			if *reverse {
+				break
+			}
+			continue
+		}
+		if *end != "" && bytes.Compare(key, []byte(*end)) >= 0 {
+			if !*reverse {
+				break
+			}
+			continue
+		}
+
+		var value []byte
+		if !*keysOnly {
+			var err error
+			value, err = iterator.Value()
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		switch {
+		case c.json:
+			err = c.printJSON(newKVOutput(key, value))
+		case *keysOnly:
+			_, err = fmt.Fprintln(c.stdout, formatField(key))
+		default:
+			_, err = fmt.Fprintf(c.stdout, "%s\t%s\n", formatField(key), formatField(value))
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+		if *limit > 0 && count >= *limit {
+			break
+		}
+	}
+	return nil
+}
+
+func countCmd(c *cli, args []string) error {
+	flags := flag.NewFlagSet("count", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prefix := flags.String("prefix", "", "key 的前缀")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	var count int
+	if *prefix == "" {
+		stat, err := c.db.Stat()
+		if err != nil {
+			return err
+		}
+		count = int(stat.KeyNum)
+	} else {
+		iterator := c.db.NewIterator(LustreDB.IteratorOptions{Prefix: []byte(*prefix)})
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			count++
+		}
+		iterator.Close()
+	}
+
+	if c.json {
+		return c.printJSON(map[string]int{"count": count})
+	}
+	_, err := fmt.Fprintln(c.stdout, count)
+	return err
+}
+
+func statCmd(c *cli, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	stat, err := c.db.Stat()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]any{
+			"key_num":       stat.KeyNum,
+			"data_file_num": stat.DataFileNum,
+			"disk_size":     stat.DiskSize,
+		})
+	}
+	_, err = fmt.Fprintf(c.stdout, "keys:       %d\ndata files: %d\ndisk size:  %d bytes\n",
+		stat.KeyNum, stat.DataFileNum, stat.DiskSize)
+	return err
+}
+
+func mergeCmd(c *cli, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	err := c.db.Merge()
+	if err != nil {
+		return err
+	}
+	return c.printOK()
+}
+
+func parseDumpFormat(name string) (LustreDB.DumpFormat, error) {
+	switch name {
+	case "jsonl":
+		return LustreDB.DumpJSONLines, nil
+	case "binary":
+		return LustreDB.DumpBinary, nil
+	default:
+		return 0, fmt.Errorf("unknown format: %s", name)
+	}
+}
+
+func exportCmd(c *cli, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	formatName := flags.String("format", "jsonl", "导出格式 jsonl|binary")
+	output := flags.String("o", "", "输出文件，默认输出到标准输出")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	format, err := parseDumpFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return c.db.Export(c.stdout, format)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	err = c.db.Export(file, format)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func importCmd(c *cli, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	formatName := flags.String("format", "jsonl", "导入格式 jsonl|binary")
+	prefix := flags.String("prefix", "", "只导入以此为前缀的 key")
+	input := flags.String("i", "", "输入文件，默认从标准输入读取")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	format, err := parseDumpFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	reader := c.stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		reader = file
+	}
+	err = c.db.Import(reader, format, []byte(*prefix))
+	if err != nil {
+		return err
+	}
+	return c.printOK()
+}
+
+func verifyCmd(c *cli, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	maxProblems := flags.Int("max", 0, "最多输出的问题数量，0 表示不限制")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	opts := LustreDB.DefaultVerifyOptions
+	opts.MaxProblems = *maxProblems
+	report, err := LustreDB.VerifyDir(c.dir, opts)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		problems := make([]map[string]any, 0, len(report.Problems))
+		for _, p := range report.Problems {
+			problems = append(problems, map[string]any{
+				"kind":   p.Kind.String(),
+				"file":   p.File,
+				"offset": p.Offset,
+				"error":  p.Err.Error(),
+			})
+		}
+		err = c.printJSON(map[string]any{
+			"ok":            report.OK(),
+			"data_files":    report.DataFileNum,
+			"records":       report.RecordNum,
+			"hint_entries":  report.HintEntryNum,
+			"index_entries": report.IndexEntryNum,
+			"problems":      problems,
+		})
+	} else {
+		for _, p := range report.Problems {
+			if _, err := fmt.Fprintln(c.stdout, p); err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(c.stdout, "%d data files, %d records, %d hint entries, %d index entries, %d problems\n",
+			report.DataFileNum, report.RecordNum, report.HintEntryNum, report.IndexEntryNum, len(report.Problems))
+	}
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+func inspectCmd(c *cli, args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	key := flags.String("key", "", "只输出此 key 的记录")
+	types := flags.String("type", "", "只输出这些类型的记录，多个类型用逗号分隔")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	var opts LustreDB.InspectOptions
+	if *key != "" {
+		opts.Key = []byte(*key)
+	}
+	if *types != "" {
+		for _, name := range strings.Split(*types, ",") {
+			typ, ok := parseRecordType(name)
+			if !ok {
+				return fmt.Errorf("unknown record type: %s", name)
+			}
+			opts.Types = append(opts.Types, typ)
+		}
+	}
+
+	// 文件名可以是绝对路径，也可以是数据库目录中的文件名
+	path := flags.Arg(0)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = filepath.Join(c.dir, path)
+	}
+
+	var writeErr error
+	info, err := LustreDB.InspectFile(path, opts, func(record *LustreDB.InspectedRecord) bool {
+		if c.json {
+			writeErr = c.printJSON(newInspectOutput(record))
+		} else {
+			_, writeErr = fmt.Fprintln(c.stdout, formatInspectedRecord(record))
+		}
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if !c.json {
+		_, err = fmt.Fprintf(c.stdout, "# %s file, format v%d, %s\n", info.Kind, info.Version, checksumName(info.Checksum))
+	}
+	return err
+}
+
+// JSON 输出中的一条原始记录
+type inspectOutput struct {
+	Offset      int64  `json:"offset"`
+	Size        int64  `json:"size"`
+	Type        string `json:"type,omitempty"`
+	Seq         uint64 `json:"seq"`
+	Key         string `json:"key,omitempty"`
+	KeyEncoding string `json:"key_encoding,omitempty"`
+	ValueSize   int    `json:"value_size"`
+	Fid         uint32 `json:"fid,omitempty"`
+	PosOffset   int64  `json:"pos_offset,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func newInspectOutput(record *LustreDB.InspectedRecord) *inspectOutput {
+	out := &inspectOutput{
+		Offset:    record.Offset,
+		Size:      record.Size,
+		Seq:       record.Seq,
+		ValueSize: record.ValueSize,
+	}
+	if record.Size > 0 {
+		out.Type = data.LogRecordTypeName(record.Type)
+		out.Key, out.KeyEncoding = encodeField(record.Key)
+	}
+	if record.Pos != nil {
+		out.Fid, out.PosOffset = record.Pos.Fid, record.Pos.Offset
+	}
+	if record.Value != nil {
+		out.Value, _ = encodeField(record.Value)
+	}
+	if record.Err != nil {
+		out.Error = record.Err.Error()
+	}
+	return out
+}
+
+// offset size type seq key value_size crc
+func formatInspectedRecord(record *LustreDB.InspectedRecord) string {
+	status := "ok"
+	if record.Err != nil {
+		status = record.Err.Error()
+	}
+	if record.Size == 0 {
+		return fmt.Sprintf("%d\t-\t-\t-\t-\t-\t%s", record.Offset, status)
+	}
+	s := fmt.Sprintf("%d\t%d\t%s\t%d\t%s\t%d\t%s", record.Offset, record.Size,
+		data.LogRecordTypeName(record.Type), record.Seq, formatField(record.Key), record.ValueSize, status)
+	if record.Pos != nil {
+		s += fmt.Sprintf("\t-> %d:%d", record.Pos.Fid, record.Pos.Offset)
+	}
+	if record.Value != nil {
+		s += "\t" + formatField(record.Value)
+	}
+	return s
+}
+
+func parseRecordType(name string) (data.LogRecordType, bool) {
+	for _, typ := range []data.LogRecordType{
+		data.LogRecordNormal, data.LogRecordDelete, data.LogRecordFinish, data.LogRecordChunk, data.LogRecordStream,
+	} {
+		if strings.EqualFold(name, data.LogRecordTypeName(typ)) {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+func checksumName(checksum data.ChecksumType) string {
+	if checksum == data.ChecksumCRC32C {
+		return "crc32c"
+	}
+	return "crc32"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	LustreDB "github.com/lustresix/lxdb"
+	"github.com/lustresix/lxdb/index"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `lxdb 命令行工具
+
+用法:
+  lxdb [全局参数] <命令> [命令参数]
+
+全局参数:
+  -dir string     数据库目录（必填）
+  -index string   索引类型 btree|art|bptree|sharded-btree|sharded-art|skiplist|hash|diskhash（默认 art）
+  -json           以 JSON 格式输出
+
+命令:
+  get <key>                             读取 key 对应的 value
+  put <key> <value>                     写入数据，value 为 - 时从标准输入读取
+  del <key>                             删除数据
+  scan [-prefix p] [-start k] [-end k] [-reverse] [-limit n] [-keys]
+                                        遍历数据，范围为 [start, end)
+  count [-prefix p]                     统计 key 的数量
+  stat                                  查看数据库的统计信息
+  merge                                 清理无效数据
+  export [-format jsonl|binary] [-o file]
+                                        导出数据，默认输出到标准输出
+  import [-format jsonl|binary] [-prefix p] [-i file]
+                                        导入数据，默认从标准输入读取
+  verify [-max n]                       不打开数据库，校验数据文件、hint 文件和索引
+  inspect [-key k] [-type t1,t2] <file> 不打开数据库，输出文件中的原始记录
+                                        file 为数据文件、hint、merge 或 seq-no 文件名
+`
+
+// 命令的执行环境
+type cli struct {
+	db     *LustreDB.DB
+	dir    string
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+type command func(c *cli, args []string) error
+
+var commands = map[string]command{
+	"get":     getCmd,
+	"put":     putCmd,
+	"del":     delCmd,
+	"scan":    scanCmd,
+	"count":   countCmd,
+	"stat":    statCmd,
+	"merge":   mergeCmd,
+	"export":  exportCmd,
+	"import":  importCmd,
+	"verify":  verifyCmd,
+	"inspect": inspectCmd,
+}
+
+// 不需要打开数据库的命令，打开数据库时会重建索引，损坏的数据会导致无法打开
+var offlineCommands = map[string]bool{
+	"verify":  true,
+	"inspect": true,
+}
+
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run 执行命令，返回进程的退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lxdb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, usage)
+	}
+	dir := flags.String("dir", "", "数据库目录")
+	indexType := flags.String("index", "art", "索引类型 btree|art|bptree|sharded-btree|sharded-art|skiplist|hash|diskhash")
+	jsonOutput := flags.Bool("json", false, "以 JSON 格式输出")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *dir == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		_, _ = fmt.Fprintf(stderr, "unknown command: %s\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	options := LustreDB.DefaultOptions
+	options.DirPath = *dir
+	options.IndexType, ok = parseIndexType(*indexType)
+	if !ok {
+		_, _ = fmt.Fprintf(stderr, "unknown index type: %s\n", *indexType)
+		return 2
+	}
+
+	c := &cli{dir: *dir, json: *jsonOutput, stdin: stdin, stdout: stdout}
+	var err error
+	if offlineCommands[flags.Arg(0)] {
+		err = cmd(c, flags.Args()[1:])
+	} else {
+		c.db, err = LustreDB.Open(options)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "open %s: %v\n", *dir, err)
+			return 1
+		}
+		err = cmd(c, flags.Args()[1:])
+		closeErr := c.db.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errUsage) {
+			flags.Usage()
+			return 2
+		}
+		_, _ = fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+func parseIndexType(name string) (index.IndexerType, bool) {
+	switch strings.ToLower(name) {
+	case "btree":
+		return LustreDB.BTree, true
+	case "art":
+		return LustreDB.ART, true
+	case "bptree":
+		return LustreDB.BPtree, true
+	case "sharded-btree":
+		return LustreDB.ShardedBTree, true
+	case "sharded-art":
+		return LustreDB.ShardedART, true
+	case "skiplist":
+		return LustreDB.SkipList, true
+	case "hash":
+		return LustreDB.Hash, true
+	case "diskhash":
+		return LustreDB.DiskHash, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runCmd(t *testing.T, dir string, stdin string, args ...string) (int, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-dir", dir}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String()
+}
+
+func TestRun(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "lxdb-cli")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	code, out := runCmd(t, dir, "", "put", "a", "1")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "OK\n", out)
+	code, _ = runCmd(t, dir, "value-from-stdin", "put", "b", "-")
+	assert.Equal(t, 0, code)
+	code, _ = runCmd(t, dir, "", "put", "c", "3")
+	assert.Equal(t, 0, code)
+
+	code, out = runCmd(t, dir, "", "get", "b")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "value-from-stdin\n", out)
+	code, out = runCmd(t, dir, "", "-json", "get", "a")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, `{"key":"a","value":"1"}`+"\n", out)
+
+	code, out = runCmd(t, dir, "", "scan", "-start", "b", "-keys")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "b\nc\n", out)
+	code, out = runCmd(t, dir, "", "scan", "-end", "c", "-reverse")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "b\tvalue-from-stdin\na\t1\n", out)
+
+	code, _ = runCmd(t, dir, "", "del", "c")
+	assert.Equal(t, 0, code)
+	code, out = runCmd(t, dir, "", "count")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "2\n", out)
+	code, _ = runCmd(t, dir, "", "get", "c")
+	assert.Equal(t, 1, code)
+
+	code, out = runCmd(t, dir, "", "verify")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 data files, 4 records, 0 hint entries, 0 index entries, 0 problems\n", out)
+
+	code, out = runCmd(t, dir, "", "inspect", "-type", "delete", "000000000.lx")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "\tDelete\t0\tc\t0\tok\n# data file, format v1, crc32c\n")
+
+	// 导出之后导入到另一个数据库
+	dumpFile := filepath.Join(dir, "dump.bin")
+	code, _ = runCmd(t, dir, "", "export", "-format", "binary", "-o", dumpFile)
+	assert.Equal(t, 0, code)
+	dir2, _ := os.MkdirTemp("", "lxdb-cli-import")
+	defer func() {
+		_ = os.RemoveAll(dir2)
+	}()
+	code, _ = runCmd(t, dir2, "", "import", "-format", "binary", "-i", dumpFile)
+	assert.Equal(t, 0, code)
+	code, out = runCmd(t, dir2, "", "get", "a")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1\n", out)
+}
+
+func TestRun_Usage(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "lxdb-cli-usage")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	code, _ := runCmd(t, dir, "", "unknown")
+	assert.Equal(t, 2, code)
+	code, _ = runCmd(t, dir, "", "get")
+	assert.Equal(t, 2, code)
+	code, _ = runCmd(t, dir, "", "-index", "unknown", "count")
+	assert.Equal(t, 2, code)
+}
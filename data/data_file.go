@@ -7,6 +7,7 @@ import (
 	"hash/crc32"
 	io2 "io"
 	"path/filepath"
+	"sync/atomic"
 )
 
 const (
@@ -14,6 +15,7 @@ const (
 	HintFileName       = "hint"
 	MergeFileName      = "merge"
 	SeqNoName          = "seq-no"
+	IndexSnapshotName  = "index-snapshot"
 )
 
 // DataFile 数据文件
@@ -27,14 +29,130 @@ type DataFile struct {
 
 	// io 读写管理
 	IOManager io.IOManager
+
+	// 文件的格式版本
+	Version uint16
+
+	// 文件中数据使用的 crc 算法
+	Checksum ChecksumType
+
+	// 引用计数，打开文件的一方持有一个引用，读取时临时增加引用，减为 0 时才真正关闭文件
+	refs int32
+
+	// 是否已经释放了打开文件时持有的引用
+	closed int32
 }
 
-// OpenDataFile 打开新的数据文件
+// OpenDataFile 打开数据文件，文件不存在时使用 IEEE crc 新建
 func OpenDataFile(dirPath string, fileId uint32) (*DataFile, error) {
+	return OpenDataFileWithChecksum(dirPath, fileId, ChecksumIEEE)
+}
+
+// OpenDataFileWithChecksum 打开数据文件，文件不存在时以当前的格式版本和指定的 crc 算法新建
+// 已经存在的文件按照文件头部记录的版本和算法读取，没有头部的是旧格式的文件
+func OpenDataFileWithChecksum(dirPath string, fileId uint32, checksum ChecksumType) (*DataFile, error) {
+	if ChecksumTable(checksum) == nil {
+		return nil, utils.ErrUnsupportedFileFormat
+	}
+
 	// 地址/fileId.lx
 	name := GetDataFileName(dirPath, fileId)
 	// 初始化 IOManager 管理器接口
-	return newDataFile(name, fileId)
+	dataFile, err := newDataFile(name, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := dataFile.IOManager.Size()
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+
+	// 新文件写入头部
+	if size == 0 {
+		header := &FileHeader{Version: CurrentFileFormat, Checksum: checksum}
+		err = dataFile.Write(EncodeFileHeader(header))
+		if err != nil {
+			_ = dataFile.Close()
+			return nil, err
+		}
+		dataFile.Version = header.Version
+		dataFile.Checksum = header.Checksum
+		return dataFile, nil
+	}
+
+	err = dataFile.readFileHeader(size)
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// OpenDataFileReadOnly 以只读方式打开已经存在的数据文件，文件不存在时返回错误，空文件不会写入头部
+func OpenDataFileReadOnly(dirPath string, fileId uint32) (*DataFile, error) {
+	dataFile, err := OpenFileReadOnly(GetDataFileName(dirPath, fileId), fileId)
+	if err != nil {
+		return nil, err
+	}
+	size, err := dataFile.IOManager.Size()
+	if err == nil {
+		err = dataFile.readFileHeader(size)
+	}
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// OpenFileReadOnly 以只读方式打开已经存在的文件，不读取头部，用于 hint、merge 和 seq-no 文件
+func OpenFileReadOnly(fileName string, fileId uint32) (*DataFile, error) {
+	manager, err := io.NewReadOnlyIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return newDataFileWithManager(manager, fileId), nil
+}
+
+// 读取文件头部中的格式版本和 crc 算法，没有头部的是旧格式的文件
+func (df *DataFile) readFileHeader(size int64) error {
+	if size < FileHeaderSize {
+		return nil
+	}
+	b, err := df.readNBytes(FileHeaderSize, 0)
+	if err != nil {
+		return err
+	}
+	header, err := DecodeFileHeader(b)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		df.Version = header.Version
+		df.Checksum = header.Checksum
+	}
+	return nil
+}
+
+// DataOffset 第一条数据的偏移，有头部的文件数据从头部之后开始
+func (df *DataFile) DataOffset() int64 {
+	if df.Version == FileFormatV0 {
+		return 0
+	}
+	return FileHeaderSize
+}
+
+// 根据文件的格式版本获取 crc 表
+func (df *DataFile) crcTable() *crc32.Table {
+	switch df.Version {
+	case FileFormatV0:
+		// 旧格式只支持 IEEE
+		return crc32.IEEETable
+	default:
+		return ChecksumTable(df.Checksum)
+	}
 }
 
 func OpenHintFile(dirPath string) (*DataFile, error) {
@@ -62,12 +180,18 @@ func newDataFile(fileName string, fileId uint32) (*DataFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newDataFileWithManager(manager, fileId), nil
+}
 
+func newDataFileWithManager(manager io.IOManager, fileId uint32) *DataFile {
 	return &DataFile{
 		FileId:    fileId,
 		WriteOff:  0,
 		IOManager: manager,
-	}, nil
+		Version:   FileFormatV0,
+		Checksum:  ChecksumIEEE,
+		refs:      1,
+	}
 }
 
 // 根据 offset 从文件中读取数据 LogRecord
@@ -101,9 +225,18 @@ func (df *DataFile) Read(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, io2.EOF
 	}
 
+	err = header.checkSize()
+	if err != nil {
+		return nil, 0, err
+	}
+
 	// 获取 key 和 value 的长度
-	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	keySize, valueSize := header.keySize, header.valueSize
 	var recordSize = keySize + valueSize + h
+	// 数据不完整，比如写入的过程中崩溃了，当作读到了文件的末尾
+	if offset+recordSize > size {
+		return nil, 0, io2.EOF
+	}
 
 	record := &LogRecord{
 		Type: header.recordType,
@@ -120,13 +253,80 @@ func (df *DataFile) Read(offset int64) (*LogRecord, int64, error) {
 		record.Value = bytes[keySize:]
 	}
 	// 校验 crc 是否正确
-	crc := GetLogRecordCrc(record, b[crc32.Size:h])
+	// 校验不通过时也返回读取到的数据和长度，调用方可以查看损坏的数据或者跳过这条数据继续读取
+	crc := getLogRecordCrc(record, b[crc32.Size:h], df.crcTable())
 	if crc != header.crc {
-		return nil, 0, utils.ErrorIncorrectCrc
+		return record, recordSize, utils.ErrorIncorrectCrc
 	}
 	return record, recordSize, nil
 }
 
+// ReadRecord 根据位置信息读取 LogRecord
+// 位置信息中记录了数据的长度时，只需要一次读取就能拿到整条数据
+func (df *DataFile) ReadRecord(pos *LogRecordPos) (*LogRecord, error) {
+	if pos.Size == 0 {
+		record, _, err := df.Read(pos.Offset)
+		return record, err
+	}
+
+	b, err := df.readNBytes(int64(pos.Size), pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	header, h := DecodeLogRecordHeader(b)
+	if header == nil {
+		return nil, utils.ErrDataDirectoryCorrupted
+	}
+	if err := header.checkSize(); err != nil {
+		return nil, err
+	}
+	keySize, valueSize := header.keySize, header.valueSize
+	if h+keySize+valueSize != int64(len(b)) {
+		return nil, utils.ErrDataDirectoryCorrupted
+	}
+
+	record := &LogRecord{
+		Key:   b[h : h+keySize],
+		Value: b[h+keySize:],
+		Type:  header.recordType,
+	}
+	crc := getLogRecordCrc(record, b[crc32.Size:h], df.crcTable())
+	if crc != header.crc {
+		return nil, utils.ErrorIncorrectCrc
+	}
+	return record, nil
+}
+
+// ReadValueSize 根据位置信息读取 value 的长度，只读取头部，不读取 value
+func (df *DataFile) ReadValueSize(pos *LogRecordPos) (int64, LogRecordType, error) {
+	var headerBytes int64 = maxLogRecordHeaderSize
+	if pos.Size != 0 && int64(pos.Size) < headerBytes {
+		headerBytes = int64(pos.Size)
+	} else if pos.Size == 0 {
+		size, err := df.IOManager.Size()
+		if err != nil {
+			return 0, 0, err
+		}
+		if pos.Offset+headerBytes > size {
+			headerBytes = size - pos.Offset
+		}
+	}
+
+	b, err := df.readNBytes(headerBytes, pos.Offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	header, _ := DecodeLogRecordHeader(b)
+	if header == nil {
+		return 0, 0, utils.ErrDataDirectoryCorrupted
+	}
+	if err := header.checkSize(); err != nil {
+		return 0, 0, err
+	}
+	return header.valueSize, header.recordType, nil
+}
+
 func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	recordPos := EncodeLogRecordPos(pos)
 	record := &LogRecord{
@@ -138,9 +338,15 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	return df.Write(logRecord)
 }
 
+// Write 追加写入数据，写入失败时把文件截断回写入之前的大小，不会留下不完整的记录
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IOManager.Write(buf)
 	if err != nil {
+		// 磁盘写满时可能已经写入了一部分
+		// 截断失败时文件末尾留下了不完整的数据，偏移量也要跟着前进，保证之后写入的位置是正确的
+		if n > 0 && df.IOManager.Truncate(df.WriteOff) != nil {
+			df.WriteOff += int64(n)
+		}
 		return err
 	}
 	df.WriteOff += int64(n)
@@ -152,8 +358,34 @@ func (df *DataFile) Sync() error {
 	return df.IOManager.Sync()
 }
 
+// Close 释放打开文件时持有的引用，还有其他引用时等到最后一个引用释放之后再关闭文件
 func (df *DataFile) Close() error {
-	return df.IOManager.Close()
+	if !atomic.CompareAndSwapInt32(&df.closed, 0, 1) {
+		return nil
+	}
+	return df.Release()
+}
+
+// Acquire 增加一个引用，文件已经关闭时返回 false
+// 增加引用成功之后在 Release 之前文件都不会被关闭
+func (df *DataFile) Acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&df.refs)
+		if refs <= 0 || atomic.LoadInt32(&df.closed) == 1 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&df.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Release 释放一个引用，最后一个引用释放时关闭文件
+func (df *DataFile) Release() error {
+	if atomic.AddInt32(&df.refs, -1) == 0 {
+		return df.IOManager.Close()
+	}
+	return nil
 }
 
 // 指定读多少个字节，从而调用 ioManager 来读取数据
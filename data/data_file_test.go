@@ -1,8 +1,13 @@
 package data
 
 import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lustresix/lxdb/io"
+	"github.com/lustresix/lxdb/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"syscall"
 	"testing"
 )
 
@@ -54,3 +59,193 @@ func TestDataFile_Read(t *testing.T) {
 	err = file.Sync()
 	assert.Nil(t, err)
 }
+
+func TestDataFile_ReadRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-file")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file, err := OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+
+	var positions []*LogRecordPos
+	for i := 0; i < 3; i++ {
+		buf, size := EncodeLogRecord(&LogRecord{
+			Key:   []byte(fmt.Sprintf("key-%d", i)),
+			Value: []byte(fmt.Sprintf("value-%d", i)),
+		})
+		positions = append(positions, &LogRecordPos{Offset: file.WriteOff, Size: uint32(size)})
+		err = file.Write(buf)
+		assert.Nil(t, err)
+	}
+
+	for i, pos := range positions {
+		record, err := file.ReadRecord(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("key-%d", i)), record.Key)
+		assert.Equal(t, []byte(fmt.Sprintf("value-%d", i)), record.Value)
+
+		valueSize, typ, err := file.ReadValueSize(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(record.Value)), valueSize)
+		assert.Equal(t, LogRecordNormal, typ)
+
+		// 没有长度时退回到原来的读取方式
+		record, err = file.ReadRecord(&LogRecordPos{Offset: pos.Offset})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value-%d", i)), record.Value)
+	}
+
+	// 长度不对
+	_, err = file.ReadRecord(&LogRecordPos{Offset: positions[0].Offset, Size: positions[0].Size + 1})
+	assert.NotNil(t, err)
+}
+
+func TestDataFile_ReadOversizedHeader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-file-oversized")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file, err := OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+
+	// 头部中的长度超过了 uint32，不能被截断后当作正常数据读取
+	buf := make([]byte, maxLogRecordHeaderSize+binary.MaxVarintLen64)
+	buf[4] = LogRecordNormal
+	n := 5
+	n += binary.PutVarint(buf[n:], 5<<30)
+	n += binary.PutVarint(buf[n:], 0)
+	err = file.Write(buf[:n])
+	assert.Nil(t, err)
+	err = file.Write(make([]byte, 64))
+	assert.Nil(t, err)
+
+	_, _, err = file.Read(file.DataOffset())
+	assert.Equal(t, utils.ErrKeyTooLarge, err)
+}
+
+func TestOpenDataFileWithChecksum(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-file-header")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 新文件写入头部
+	file, err := OpenDataFileWithChecksum(dir, 0, ChecksumCRC32C)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentFileFormat, file.Version)
+	assert.Equal(t, ChecksumCRC32C, file.Checksum)
+	assert.Equal(t, int64(FileHeaderSize), file.WriteOff)
+
+	buf, size := EncodeLogRecordWithChecksum(&LogRecord{Key: []byte("key"), Value: []byte("value")}, ChecksumCRC32C)
+	err = file.Write(buf)
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	// 重新打开时按照头部中的算法读取
+	file, err = OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, ChecksumCRC32C, file.Checksum)
+	record, n, err := file.Read(file.DataOffset())
+	assert.Nil(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, []byte("value"), record.Value)
+	_ = file.Close()
+
+	// 没有头部的旧格式文件
+	legacy, _ := EncodeLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("legacy")})
+	err = os.WriteFile(GetDataFileName(dir, 1), legacy, 0644)
+	assert.Nil(t, err)
+	file, err = OpenDataFileWithChecksum(dir, 1, ChecksumCRC32C)
+	assert.Nil(t, err)
+	assert.Equal(t, FileFormatV0, file.Version)
+	assert.Equal(t, int64(0), file.DataOffset())
+	record, _, err = file.Read(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("legacy"), record.Value)
+	_ = file.Close()
+
+	// 不支持的版本
+	header := EncodeFileHeader(&FileHeader{Version: CurrentFileFormat + 1, Checksum: ChecksumIEEE})
+	err = os.WriteFile(GetDataFileName(dir, 2), header, 0644)
+	assert.Nil(t, err)
+	_, err = OpenDataFile(dir, 2)
+	assert.Equal(t, utils.ErrUnsupportedFileFormat, err)
+
+	// 头部损坏
+	header = EncodeFileHeader(&FileHeader{Version: CurrentFileFormat, Checksum: ChecksumIEEE})
+	header[6] = ChecksumCRC32C
+	err = os.WriteFile(GetDataFileName(dir, 3), header, 0644)
+	assert.Nil(t, err)
+	_, err = OpenDataFile(dir, 3)
+	assert.Equal(t, utils.ErrDataDirectoryCorrupted, err)
+}
+
+func TestDataFile_Acquire(t *testing.T) {
+	dir := os.TempDir()
+	file, err := OpenDataFile(dir, 9876)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.Remove(GetDataFileName(dir, 9876))
+	}()
+
+	assert.True(t, file.Acquire())
+	// 还有引用时关闭之后仍然可以读取
+	err = file.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(FileHeaderSize), mustSize(t, file))
+	assert.False(t, file.Acquire())
+
+	// 重复关闭不会释放读取方的引用
+	err = file.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(FileHeaderSize), mustSize(t, file))
+
+	err = file.Release()
+	assert.Nil(t, err)
+	_, err = file.IOManager.Size()
+	assert.NotNil(t, err)
+}
+
+func mustSize(t *testing.T, file *DataFile) int64 {
+	size, err := file.IOManager.Size()
+	assert.Nil(t, err)
+	return size
+}
+
+// 只写入一部分数据然后返回磁盘已满的错误
+type partialWriteIO struct {
+	io.IOManager
+}
+
+func (p *partialWriteIO) Write(b []byte) (int, error) {
+	n, _ := p.IOManager.Write(b[:len(b)/2])
+	return n, syscall.ENOSPC
+}
+
+func TestDataFile_WriteRollback(t *testing.T) {
+	dir := os.TempDir()
+	file, err := OpenDataFile(dir, 9877)
+	assert.Nil(t, err)
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(GetDataFileName(dir, 9877))
+	}()
+	err = file.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	size := mustSize(t, file)
+
+	// 写入失败之后截断掉写入的部分数据，偏移量不变
+	manager := file.IOManager
+	file.IOManager = &partialWriteIO{IOManager: manager}
+	err = file.Write([]byte("bbbbbbbb"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, size, file.WriteOff)
+	assert.Equal(t, size, mustSize(t, file))
+
+	file.IOManager = manager
+	err = file.Write([]byte("cccc"))
+	assert.Nil(t, err)
+	assert.Equal(t, size+4, file.WriteOff)
+	assert.Equal(t, size+4, mustSize(t, file))
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"encoding/binary"
+	"github.com/lustresix/lxdb/utils"
+	"hash/crc32"
+)
+
+// 数据文件的格式版本
+const (
+	// FileFormatV0 最早的格式，文件没有头部，crc 只支持 IEEE
+	FileFormatV0 uint16 = iota
+
+	// FileFormatV1 文件开头有固定长度的头部，记录格式版本和 crc 算法
+	FileFormatV1
+
+	// CurrentFileFormat 新建的数据文件使用的格式版本
+	CurrentFileFormat = FileFormatV1
+)
+
+// ChecksumType 数据的校验算法
+type ChecksumType = byte
+
+const (
+	// ChecksumIEEE crc32 IEEE 多项式
+	ChecksumIEEE ChecksumType = iota + 1
+
+	// ChecksumCRC32C crc32 Castagnoli 多项式，大部分 CPU 有硬件指令支持
+	ChecksumCRC32C
+)
+
+// 文件头部 magic = 4  version = 2  checksum = 1  reserved = 5  crc = 4  total = 16
+const FileHeaderSize = 16
+
+// fileMagic 数据文件的魔数 "LXDB"
+const fileMagic uint32 = 0x4244584c
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileHeader 数据文件的头部
+type FileHeader struct {
+	// 格式版本
+	Version uint16
+
+	// crc 算法
+	Checksum ChecksumType
+}
+
+// EncodeFileHeader 对文件头部进行编码
+func EncodeFileHeader(header *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	binary.LittleEndian.PutUint32(buf[:4], fileMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], header.Version)
+	buf[6] = header.Checksum
+	crc := crc32.ChecksumIEEE(buf[:FileHeaderSize-4])
+	binary.LittleEndian.PutUint32(buf[FileHeaderSize-4:], crc)
+	return buf
+}
+
+// DecodeFileHeader 解码文件头部，没有魔数的文件是没有头部的旧格式文件，返回 nil
+func DecodeFileHeader(buf []byte) (*FileHeader, error) {
+	if len(buf) < FileHeaderSize || binary.LittleEndian.Uint32(buf[:4]) != fileMagic {
+		return nil, nil
+	}
+
+	crc := crc32.ChecksumIEEE(buf[:FileHeaderSize-4])
+	if crc != binary.LittleEndian.Uint32(buf[FileHeaderSize-4:FileHeaderSize]) {
+		return nil, utils.ErrDataDirectoryCorrupted
+	}
+
+	header := &FileHeader{
+		Version:  binary.LittleEndian.Uint16(buf[4:6]),
+		Checksum: buf[6],
+	}
+	if header.Version == FileFormatV0 || header.Version > CurrentFileFormat {
+		return nil, utils.ErrUnsupportedFileFormat
+	}
+	if ChecksumTable(header.Checksum) == nil {
+		return nil, utils.ErrUnsupportedFileFormat
+	}
+	return header, nil
+}
+
+// ChecksumTable 根据校验算法获取 crc 表，不支持的算法返回 nil
+func ChecksumTable(checksum ChecksumType) *crc32.Table {
+	switch checksum {
+	case ChecksumIEEE:
+		return crc32.IEEETable
+	case ChecksumCRC32C:
+		return castagnoliTable
+	default:
+		return nil
+	}
+}
@@ -2,7 +2,9 @@ package data
 
 import (
 	"encoding/binary"
+	"github.com/lustresix/lxdb/utils"
 	"hash/crc32"
+	"math"
 )
 
 type LogRecordType = byte
@@ -11,11 +13,44 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDelete
 	LogRecordFinish
+	// LogRecordChunk 流式写入的大 value 的一个分块，不会直接出现在索引中
+	LogRecordChunk
+	// LogRecordStream 流式写入的大 value，数据部分是分块的位置信息
+	LogRecordStream
 )
 
+// LogRecordTypeName 获取记录类型的名称
+func LogRecordTypeName(typ LogRecordType) string {
+	switch typ {
+	case LogRecordNormal:
+		return "Normal"
+	case LogRecordDelete:
+		return "Delete"
+	case LogRecordFinish:
+		return "Finish"
+	case LogRecordChunk:
+		return "Chunk"
+	case LogRecordStream:
+		return "Stream"
+	default:
+		return "Unknown"
+	}
+}
+
 // crc = 4  type = 1 keySize = 5 valueSize = 5 total = 15
 const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
 
+// MaxLogRecordFieldSize 单条记录中 key 或 value 的最大长度，头部中的长度是 uint32
+const MaxLogRecordFieldSize = math.MaxUint32
+
+// MaxLogRecordSize 单条记录编码之后的最大长度，LogRecordPos 中的长度是 uint32
+const MaxLogRecordSize = math.MaxUint32
+
+// MaxLogRecordValueSize key 的长度为 keySize 时 value 的最大长度，保证整条记录不超过 MaxLogRecordSize
+func MaxLogRecordValueSize(keySize int64) int64 {
+	return MaxLogRecordSize - maxLogRecordHeaderSize - keySize
+}
+
 // LogRecord 写入到数据文件的记录
 type LogRecord struct {
 	Key   []byte
@@ -26,8 +61,8 @@ type LogRecord struct {
 type LogRecordHeader struct {
 	crc        uint32
 	recordType LogRecordType
-	keySize    uint32
-	valueSize  uint32
+	keySize    int64
+	valueSize  int64
 }
 
 // LogRecordPos 数据内存索引，描述数据在磁盘上的位置
@@ -39,6 +74,9 @@ type LogRecordPos struct {
 
 	// 偏移量，表示数据存储到了数据文件的哪个位置
 	Offset int64
+
+	// 数据编码之后的总长度，为 0 表示未知（旧版本的 hint 文件中没有记录）
+	Size uint32
 }
 
 type TransactionRecord struct {
@@ -46,8 +84,13 @@ type TransactionRecord struct {
 	Pos    *LogRecordPos
 }
 
-// EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
+// EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度，使用 IEEE crc
 func EncodeLogRecord(LogRecord *LogRecord) ([]byte, int64) {
+	return EncodeLogRecordWithChecksum(LogRecord, ChecksumIEEE)
+}
+
+// EncodeLogRecordWithChecksum 使用指定的校验算法对 LogRecord 进行编码，返回字节数组及长度
+func EncodeLogRecordWithChecksum(LogRecord *LogRecord, checksum ChecksumType) ([]byte, int64) {
 	bytes := make([]byte, maxLogRecordHeaderSize)
 
 	// 第四位的数是类型
@@ -73,7 +116,7 @@ func EncodeLogRecord(LogRecord *LogRecord) ([]byte, int64) {
 	copy(finalByte[index+len(LogRecord.Key):], LogRecord.Value)
 
 	// 编码
-	crc := crc32.ChecksumIEEE(finalByte[4:])
+	crc := crc32.Checksum(finalByte[4:], ChecksumTable(checksum))
 	binary.LittleEndian.PutUint32(finalByte[:4], crc)
 
 	return finalByte, int64(size)
@@ -85,6 +128,7 @@ func EncodeLogRecordPos(pos *LogRecordPos) []byte {
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
+	index += binary.PutVarint(buf[index:], int64(pos.Size))
 	return buf[:index]
 }
 
@@ -94,10 +138,17 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	fid, i := binary.Varint(buf[index:])
 	index += i
 	offset, i := binary.Varint(buf[index:])
-	return &LogRecordPos{
+	index += i
+	pos := &LogRecordPos{
 		Fid:    uint32(fid),
 		Offset: offset,
 	}
+	// 兼容没有记录长度的旧数据
+	if index < len(buf) {
+		size, _ := binary.Varint(buf[index:])
+		pos.Size = uint32(size)
+	}
+	return pos
 }
 
 // DecodeLogRecordHeader 解码 返回值 头部信息 头部长度
@@ -115,25 +166,40 @@ func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	var index = 5
 
 	kSize, n := binary.Varint(buf[index:])
-	header.keySize = uint32(kSize)
+	header.keySize = kSize
 	index += n
 
 	vSize, n := binary.Varint(buf[index:])
-	header.valueSize = uint32(vSize)
+	header.valueSize = vSize
 	index += n
 
 	return header, int64(index)
 }
 
+// 校验头部中的长度，超出限制的数据是损坏的，不能按照截断后的长度去读取
+func (h *LogRecordHeader) checkSize() error {
+	if h.keySize < 0 || h.keySize > MaxLogRecordFieldSize {
+		return utils.ErrKeyTooLarge
+	}
+	if h.valueSize < 0 || h.valueSize > MaxLogRecordFieldSize {
+		return utils.ErrValueTooLarge
+	}
+	return nil
+}
+
 // GetLogRecordCrc 校验 crc
 func GetLogRecordCrc(log *LogRecord, header []byte) uint32 {
+	return getLogRecordCrc(log, header, crc32.IEEETable)
+}
+
+func getLogRecordCrc(log *LogRecord, header []byte, table *crc32.Table) uint32 {
 	if log == nil {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(header[:])
-	crc = crc32.Update(crc, crc32.IEEETable, log.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, log.Value)
+	crc := crc32.Checksum(header[:], table)
+	crc = crc32.Update(crc, table, log.Key)
+	crc = crc32.Update(crc, table, log.Value)
 
 	return crc
 }
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
 	"hash/crc32"
 	"testing"
@@ -39,3 +40,42 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	header, _ := DecodeLogRecordHeader(logRecord)
 	t.Log(header)
 }
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 1024, Size: 77}
+	decoded := DecodeLogRecordPos(EncodeLogRecordPos(pos))
+	assert.Equal(t, pos, decoded)
+
+	// 旧版本的编码中没有长度
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	n := binary.PutVarint(buf, 3)
+	n += binary.PutVarint(buf[n:], 1024)
+	decoded = DecodeLogRecordPos(buf[:n])
+	assert.Equal(t, &LogRecordPos{Fid: 3, Offset: 1024}, decoded)
+}
+
+func TestEncodeStreamManifest(t *testing.T) {
+	m := &StreamManifest{
+		Size: 3 << 20,
+		Crc:  12345,
+		Chunks: []*LogRecordPos{
+			{Fid: 1, Offset: 0, Size: 1 << 20},
+			{Fid: 1, Offset: 1 << 20, Size: 1 << 20},
+			{Fid: 2, Offset: 0, Size: 1 << 20},
+		},
+	}
+	decoded, err := DecodeStreamManifest(EncodeStreamManifest(m))
+	assert.Nil(t, err)
+	assert.Equal(t, m, decoded)
+
+	_, err = DecodeStreamManifest(EncodeStreamManifest(m)[:10])
+	assert.NotNil(t, err)
+}
+
+func TestMaxLogRecordValueSize(t *testing.T) {
+	// 最长的记录加上头部刚好是 LogRecordPos.Size 能表示的最大值
+	keySize := int64(64 * 1024)
+	valueSize := MaxLogRecordValueSize(keySize)
+	assert.Equal(t, int64(MaxLogRecordSize), maxLogRecordHeaderSize+keySize+valueSize)
+	assert.LessOrEqual(t, len(binary.AppendVarint(nil, valueSize)), binary.MaxVarintLen32)
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"encoding/binary"
+	"github.com/lustresix/lxdb/utils"
+)
+
+// StreamManifest 流式写入的大 value 的描述信息
+// value 被切分成多个 LogRecordChunk 分块写入数据文件，最后写入一条记录了所有分块位置的 LogRecordStream
+type StreamManifest struct {
+	// value 的总长度
+	Size int64
+
+	// 整个 value 的 crc
+	Crc uint32
+
+	// 按顺序排列的分块位置
+	Chunks []*LogRecordPos
+}
+
+// EncodeStreamManifest 对分块信息进行编码
+// size(varint) + crc(4) + count(uvarint) + [len(uvarint) + pos]...
+func EncodeStreamManifest(m *StreamManifest) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2+4)
+	var index = 0
+	index += binary.PutVarint(buf[index:], m.Size)
+	binary.LittleEndian.PutUint32(buf[index:], m.Crc)
+	index += 4
+	index += binary.PutUvarint(buf[index:], uint64(len(m.Chunks)))
+	buf = buf[:index]
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, pos := range m.Chunks {
+		encPos := EncodeLogRecordPos(pos)
+		n := binary.PutUvarint(lenBuf, uint64(len(encPos)))
+		buf = append(buf, lenBuf[:n]...)
+		buf = append(buf, encPos...)
+	}
+	return buf
+}
+
+// DecodeStreamManifest 解码分块信息
+func DecodeStreamManifest(buf []byte) (*StreamManifest, error) {
+	var index = 0
+	size, n := binary.Varint(buf[index:])
+	if n <= 0 || len(buf) < index+n+4 {
+		return nil, utils.ErrDataDirectoryCorrupted
+	}
+	index += n
+	crc := binary.LittleEndian.Uint32(buf[index:])
+	index += 4
+	count, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, utils.ErrDataDirectoryCorrupted
+	}
+	index += n
+
+	m := &StreamManifest{
+		Size: size,
+		Crc:  crc,
+	}
+	for i := uint64(0); i < count; i++ {
+		l, n := binary.Uvarint(buf[index:])
+		if n <= 0 || uint64(len(buf)-index-n) < l {
+			return nil, utils.ErrDataDirectoryCorrupted
+		}
+		index += n
+		m.Chunks = append(m.Chunks, DecodeLogRecordPos(buf[index:index+int(l)]))
+		index += int(l)
+	}
+	return m, nil
+}
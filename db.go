@@ -1,6 +1,7 @@
 package LustreDB
 
 import (
+	"github.com/lustresix/lxdb/cache"
 	"github.com/lustresix/lxdb/data"
 	"github.com/lustresix/lxdb/index"
 	"github.com/lustresix/lxdb/utils"
@@ -8,6 +9,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const seqNoKey = "seq.no"
@@ -17,41 +20,87 @@ type DB struct {
 	// 配置项
 	options Options
 
-	// 读写锁
+	// 读写锁，写入时持有写锁，Get 读取数据不需要持有
 	lo *sync.RWMutex
 
+	// 流式写入时持有读锁，merge 切换活跃文件时持有写锁
+	streamLock *sync.RWMutex
+
 	// 文件 id，只能在加载索引的时候使用，不能在其他地方更新或使用
 	fileIds []int
 
-	// 活跃文件
-	activeFiles *data.DataFile
-
-	// 旧的数据文件
-	olderFiles map[uint32]*data.DataFile
+	// 活跃文件和旧的数据文件，读取时不需要加锁
+	files atomic.Pointer[fileView]
 
 	// 内存索引
 	index index.Indexer
 
+	// 读缓存，为空表示没有开启
+	cache *cache.Cache
+
 	// 事物序列号
 	seqNo uint64
 
 	// 是否在merge
 	merged bool
 
-	// 是否存在seqNo文件
-	seqNoFileExists bool
-
 	// 是否初始化
 	isInitial bool
+
+	// 同一时间只能有一个索引快照在写入
+	snapshotLock *sync.Mutex
+
+	// merge 替换数据文件的次数，替换之前创建的索引快照中的位置已经失效，不能再保存
+	mergeEpoch atomic.Uint64
+
+	// 关闭时通知定时保存索引快照的协程退出
+	checkpointDone chan struct{}
+	checkpointWg   sync.WaitGroup
+
+	// 当前创建的二级索引，需要持有锁访问
+	secondaryIndexes map[string]*secondaryIndex
+
+	// 二级索引数据的数量，即内部 key 的数量（不包括保存数量的 key）
+	secondaryEntryNum int
+
+	// 数据目录和 merge 目录占用的磁盘空间，只在设置了 MaxDiskUsage 时统计，需要持有锁访问
+	diskUsage int64
+
+	// 磁盘写满之后进入只读状态，拒绝所有的写入，merge 完成之后空间足够时恢复，需要持有锁访问
+	readOnly bool
+}
+
+// Stat 存储引擎的统计信息
+type Stat struct {
+	// key 的总数量
+	KeyNum uint
+
+	// 数据文件的数量
+	DataFileNum uint
+
+	// 数据目录占据的磁盘空间大小
+	DiskSize int64
+
+	// 是否因为磁盘写满处于只读状态
+	ReadOnly bool
 }
 
 func Open(options Options) (*DB, error) {
+	start := time.Now()
+
 	// 对用户传入的配置项的校验
 	err := checkOptions(options)
 	if err != nil {
 		return nil, err
 	}
 
+	if options.EventListener == nil {
+		options.EventListener = NopEventListener{}
+	}
+	if options.Checksum == 0 {
+		options.Checksum = data.ChecksumIEEE
+	}
+
 	var isInitial bool
 
 	// 目录是否存在，如果目录不存在则创建
@@ -74,11 +123,18 @@ func Open(options Options) (*DB, error) {
 
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		lo:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
+		options:      options,
+		lo:           new(sync.RWMutex),
+		streamLock:   new(sync.RWMutex),
+		snapshotLock: new(sync.Mutex),
+		isInitial:    isInitial,
+	}
+	db.index, err = newIndexer(options)
+	if err != nil {
+		return nil, err
+	}
+	if options.CacheSize > 0 {
+		db.cache = cache.NewCache(options.CacheSize)
 	}
 
 	err = db.loadMergeFiles()
@@ -92,44 +148,109 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
-	if options.IndexType != BPtree {
-		// 是否有索引文件，如果有从索引文件中加载
-		err = db.loadIndexFromHintFile()
-		if err != nil {
-			return nil, err
+	var fromSnapshot bool
+	if !isPersistentIndex(options.IndexType) {
+		// 优先从索引快照中加载，只需要重放快照之后写入的数据
+		start := db.loadIndexFromSnapshot()
+		fromSnapshot = start != nil
+		if !fromSnapshot {
+			// 是否有索引文件，如果有从索引文件中加载
+			err = db.loadIndexFromHintFile()
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// 从数据文件中加载索引
-		err = db.loadIndexFromDataFiles()
+		err = db.loadIndexFromDataFiles(start)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if options.IndexType == BPtree {
+	if isPersistentIndex(options.IndexType) {
 		err := db.loadSeqNo()
 		if err != nil {
 			return nil, err
 		}
-		if db.activeFiles != nil {
-			size, err := db.activeFiles.IOManager.Size()
-			if err != nil {
-				return nil, err
-			}
-			db.activeFiles.WriteOff = size
+		// 索引保存在磁盘上，只需要重放最后一次更新索引之后写入的数据
+		err = db.recoverPersistentIndex()
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	err = db.loadSecondaryEntryNum()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.refreshDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.IndexCheckpointInterval > 0 {
+		db.startCheckpoint()
+	}
+
+	db.options.EventListener.OnOpen(&OpenStats{
+		DataFileNum:  len(db.fileIds),
+		KeyNum:       db.keyNum(),
+		FromSnapshot: fromSnapshot,
+		Duration:     time.Since(start),
+	})
+
 	return db, nil
 }
 
+// 根据配置项初始化索引，只有打开保存在磁盘上的索引时可能返回错误
+func newIndexer(options Options) (index.Indexer, error) {
+	switch options.IndexType {
+	case ShardedBTree:
+		return index.NewShardedIndex(index.Btree, options.IndexShards), nil
+	case ShardedART:
+		return index.NewShardedIndex(index.ART, options.IndexShards), nil
+	case Hash:
+		return index.NewHashIndex(options.IndexShards), nil
+	}
+	indexer, err := index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites)
+	if err != nil {
+		return nil, err
+	}
+	// 磁盘哈希索引的桶页损坏时通知监听器，下次打开时会重建索引
+	if dh, ok := indexer.(*index.DiskHashIndex); ok {
+		dh.SetCorruptionHandler(func(offset int64, err error) {
+			options.EventListener.OnCorruption(IndexFileFid, offset, err)
+		})
+	}
+	return indexer, nil
+}
+
+// 从索引中取出 key 的位置信息，保存在磁盘上的索引读取失败时返回错误，而不是当作 key 不存在
+func (db *DB) lookup(key []byte) (*data.LogRecordPos, error) {
+	if checked, ok := db.index.(index.CheckedIndexer); ok {
+		return checked.GetChecked(key)
+	}
+	return db.index.Get(key), nil
+}
+
 // Close 关闭数据库
 func (db *DB) Close() error {
-	if db.activeFiles == nil {
+	db.stopCheckpoint()
+	if db.activeFile() == nil {
 		return nil
 	}
 	db.lo.Lock()
 	defer db.lo.Unlock()
+
+	// 保存索引快照，下次打开时不需要重建索引
+	if snapshot := db.takeIndexSnapshot(); snapshot != nil {
+		if err := db.writeIndexSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
 	err := db.index.Close()
 	if err != nil {
 		return err
@@ -155,38 +276,68 @@ func (db *DB) Close() error {
 	if err != nil {
 		return err
 	}
+	_ = file.Close()
 
-	err = db.activeFiles.Close()
-	if err != nil {
-		return err
+	return db.closeDataFiles()
+}
+
+// Stat 返回数据库的统计信息
+func (db *DB) Stat() (*Stat, error) {
+	db.lo.RLock()
+	defer db.lo.RUnlock()
+
+	var dataFiles = uint(len(db.olderFiles()))
+	if db.activeFile() != nil {
+		dataFiles++
 	}
 
-	return nil
+	dirSize, err := utils.DirSize(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Stat{
+		KeyNum:      uint(db.keyNum()),
+		DataFileNum: dataFiles,
+		DiskSize:    dirSize,
+		ReadOnly:    db.readOnly,
+	}, nil
 }
 
 // Sync 持久化数据文件
 func (db *DB) Sync() error {
-	if db.activeFiles == nil {
+	if db.activeFile() == nil {
 		return nil
 	}
 	db.lo.Lock()
 	defer db.lo.Unlock()
-	return db.activeFiles.Sync()
+	return db.syncActiveFile()
 }
 
 // Delete 根据 key 来删除对应的数据
 func (db *DB) Delete(key []byte) error {
 	// 判断 key 的有效性
-	if len(key) == 0 {
-		return utils.ErrKeyIsEmpty
+	if err := checkUserKey(key); err != nil {
+		return err
 	}
 
+	// 写入数据和更新索引需要在同一把锁中完成，否则索引快照可能只包含了数据而没有包含索引
+	db.lo.Lock()
+	defer db.lo.Unlock()
+
 	// 检查 key 是否存在
-	get := db.index.Get(key)
+	get, err := db.lookup(key)
+	if err != nil {
+		return err
+	}
 	if get == nil {
 		return utils.ErrKeyNotFound
 	}
 
+	// 有二级索引时需要和索引数据一起在事务中删除
+	if len(db.secondaryIndexes) > 0 {
+		return db.commitRecords([]*data.LogRecord{{Key: key, Type: data.LogRecordDelete}}, false)
+	}
+
 	// 构造 LogRecord 文件 标记为这个是被删除的数据
 	logRecord := &data.LogRecord{
 		Key:  logRecordKeyWithSeq(key, nonTransactionSeq),
@@ -194,15 +345,14 @@ func (db *DB) Delete(key []byte) error {
 	}
 
 	// 把数据追加写入到文档中
-	_, err := db.appendLogRecordWithLock(logRecord)
+	_, err = db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
 
 	// 在内存索引中删除 key
-	b := db.index.Delete(key)
-	if !b {
-		return utils.ErrKeyNotFound
+	if !db.applyIndex(nil, nil, [][]byte{key}) {
+		return utils.ErrIndexUpdateFailed
 	}
 
 	return nil
@@ -211,9 +361,14 @@ func (db *DB) Delete(key []byte) error {
 
 // Put 写入 Key/Value 数据， Key 不为空
 func (db *DB) Put(key []byte, value []byte) error {
-	// 判断 key 是否有效
-	if len(key) == 0 {
-		return utils.ErrKeyIsEmpty
+	// 判断 key 和 value 是否有效
+	err := db.checkKeySize(key)
+	if err != nil {
+		return err
+	}
+	err = db.checkValueSize(key, int64(len(value)), false)
+	if err != nil {
+		return err
 	}
 
 	// 构造 LogRecord 结构体
@@ -222,15 +377,22 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Value: value,
 		Type:  data.LogRecordNormal,
 	}
+	db.lo.Lock()
+	defer db.lo.Unlock()
+
+	// 有二级索引时需要和索引数据一起在事务中写入
+	if len(db.secondaryIndexes) > 0 {
+		return db.commitRecords([]*data.LogRecord{{Key: key, Value: value}}, false)
+	}
+
 	// 追加写入到当前活跃的数据库中
-	logRecord, err := db.appendLogRecordWithLock(record)
+	logRecord, err := db.appendLogRecord(record)
 	if err != nil {
 		return err
 	}
 
 	// 更新索引
-	put := db.index.Put(key, logRecord)
-	if !put {
+	if !db.applyIndex([][]byte{key}, []*data.LogRecordPos{logRecord}, nil) {
 		return utils.ErrIndexUpdateFailed
 	}
 
@@ -238,34 +400,106 @@ func (db *DB) Put(key []byte, value []byte) error {
 }
 
 // Get 根据 key 来读取数据，key 不能为空
+// 读取不需要持有数据库的锁，不会被写入阻塞，读取期间通过引用计数保证数据文件不会被关闭
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.lo.RLock()
-	defer db.lo.RUnlock()
-
 	// 判断 key 是否有效
 	if len(key) == 0 {
 		return nil, utils.ErrKeyIsEmpty
 	}
 
-	// 从内存的数据结构中取出 key 对应索引的位置信息
-	get := db.index.Get(key)
-	// 如果找不到说明 key 不存在
-	if get == nil {
+	// 二级索引的内部 key 对用户不可见
+	if isInternalKey(key) {
 		return nil, utils.ErrKeyNotFound
 	}
-	value, err := db.getValue(get)
-	return value, err
+
+	for {
+		// 从内存的数据结构中取出 key 对应索引的位置信息
+		get, err := db.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		// 如果找不到说明 key 不存在
+		if get == nil {
+			return nil, utils.ErrKeyNotFound
+		}
+		value, err := db.getValue(nil, get)
+		if err == utils.ErrDataFileNotFound && db.relocated(key, get) {
+			continue
+		}
+		return value, err
+	}
+}
+
+// 读取时找不到 pos 所在的数据文件，是否因为 merge 已经替换了这个文件，此时 key 在索引中已经指向了新的位置，需要重新读取
+// merge 先更新索引再从视图中去掉旧文件，所以找不到文件时重新查找一定能拿到新的位置
+func (db *DB) relocated(key []byte, pos *data.LogRecordPos) bool {
+	current, err := db.lookup(key)
+	return err == nil && current != nil && (current.Fid != pos.Fid || current.Offset != pos.Offset)
+}
+
+// ValueSize 获取 key 对应的 value 的长度，只读取数据的头部，不读取 value
+func (db *DB) ValueSize(key []byte) (int64, error) {
+	if len(key) == 0 {
+		return 0, utils.ErrKeyIsEmpty
+	}
+	if isInternalKey(key) {
+		return 0, utils.ErrKeyNotFound
+	}
+
+	for {
+		get, err := db.lookup(key)
+		if err != nil {
+			return 0, err
+		}
+		if get == nil {
+			return 0, utils.ErrKeyNotFound
+		}
+		size, err := db.valueSize(get)
+		if err == utils.ErrDataFileNotFound && db.relocated(key, get) {
+			continue
+		}
+		return size, err
+	}
+}
+
+// 读取 get 位置的数据的 value 长度
+func (db *DB) valueSize(get *data.LogRecordPos) (int64, error) {
+	dataFile := db.acquireDataFile(get.Fid)
+	if dataFile == nil {
+		return 0, utils.ErrDataFileNotFound
+	}
+	size, typ, err := dataFile.ReadValueSize(get)
+	_ = dataFile.Release()
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case data.LogRecordDelete:
+		return 0, utils.ErrDataFileNotFound
+	case data.LogRecordStream:
+		// 流式写入的数据，长度记录在分块信息中
+		read, err := db.readLogRecord(get)
+		if err != nil {
+			return 0, err
+		}
+		manifest, err := data.DecodeStreamManifest(read.Value)
+		if err != nil {
+			return 0, err
+		}
+		return manifest.Size, nil
+	}
+	return size, nil
 }
 
-// ListKeys 获取数据库中所有的key
+// ListKeys 获取数据库中所有的key，不包括二级索引的内部 key
 func (db *DB) ListKeys() [][]byte {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	keys := make([][]byte, 0, db.index.Size())
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if !isInternalKey(iterator.Key()) {
+			keys = append(keys, iterator.Key())
+		}
 	}
 	return keys
 }
@@ -278,7 +512,10 @@ func (db *DB) Fold(fn func(key, value []byte) bool) error {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		value, err := db.getValue(iterator.Value())
+		if isInternalKey(iterator.Key()) {
+			continue
+		}
+		value, err := db.getValue(nil, iterator.Value())
 		if err != nil {
 			return err
 		}
@@ -289,30 +526,74 @@ func (db *DB) Fold(fn func(key, value []byte) bool) error {
 	return nil
 }
 
-func (db *DB) getValue(get *data.LogRecordPos) ([]byte, error) {
-	// 根据文件的 id 找到数据文件,如果活跃文件里没有，就从旧的数据文件里面找
-	var dataFile *data.DataFile
-	if db.activeFiles.FileId == get.Fid {
-		dataFile = db.activeFiles
-	} else {
-		dataFile = db.olderFiles[get.Fid]
+// 根据位置读取 value，files 不为空时优先从 files 中读取，为空时从当前的视图中读取
+func (db *DB) getValue(files *fileView, get *data.LogRecordPos) ([]byte, error) {
+	// 先从缓存中查找，数据的位置是不可变的，所以缓存的数据一定是有效的
+	if db.cache != nil {
+		if value, ok := db.cache.Get(get); ok {
+			return value, nil
+		}
 	}
 
-	if dataFile == nil {
+	// 根据位置读取数据
+	read, err := db.readLogRecordIn(files, get)
+	if err != nil {
+		return nil, err
+	}
+
+	value := read.Value
+	switch read.Type {
+	case data.LogRecordDelete:
+		// 判断此条数据是否有被删除
 		return nil, utils.ErrDataFileNotFound
+	case data.LogRecordStream:
+		// 流式写入的数据需要读取所有的分块
+		manifest, err := data.DecodeStreamManifest(read.Value)
+		if err != nil {
+			return nil, err
+		}
+		value, err = db.readStream(files, manifest)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// 根据偏移量读取数据
-	read, _, err := dataFile.Read(get.Offset)
-	if err != nil {
-		return nil, err
+	if db.cache != nil {
+		db.cache.Put(get, value)
 	}
+	return value, nil
+}
 
-	// 判断此条数据是否有被删除
-	if read.Type == data.LogRecordDelete {
+// 根据位置信息从对应的数据文件中读取 LogRecord
+// 读取期间持有数据文件的引用，不需要持有锁
+func (db *DB) readLogRecord(pos *data.LogRecordPos) (*data.LogRecord, error) {
+	dataFile := db.acquireDataFile(pos.Fid)
+	if dataFile == nil {
 		return nil, utils.ErrDataFileNotFound
 	}
-	return read.Value, nil
+	defer func() {
+		_ = dataFile.Release()
+	}()
+	return db.readRecordFrom(dataFile, pos)
+}
+
+// 同 readLogRecord，files 不为空时优先从 files 中读取，files 中的文件已经持有引用，不需要再增加
+func (db *DB) readLogRecordIn(files *fileView, pos *data.LogRecordPos) (*data.LogRecord, error) {
+	if files != nil {
+		if dataFile := files.get(pos.Fid); dataFile != nil {
+			return db.readRecordFrom(dataFile, pos)
+		}
+	}
+	return db.readLogRecord(pos)
+}
+
+func (db *DB) readRecordFrom(dataFile *data.DataFile, pos *data.LogRecordPos) (*data.LogRecord, error) {
+	record, err := dataFile.ReadRecord(pos)
+	if err != nil {
+		db.notifyCorruption(pos.Fid, pos.Offset, err)
+		return nil, err
+	}
+	return record, nil
 }
 
 func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
@@ -324,56 +605,68 @@ func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecor
 
 // 追加写入到当前活跃的文件中
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	if db.readOnly {
+		return nil, utils.ErrReadOnly
+	}
+
 	// 判断当前活跃数据文件是否存在
 	// 如果为空则初始化文件
-	if db.activeFiles == nil {
+	if db.activeFile() == nil {
 		err := db.setActiveData()
 		if err != nil {
-			return nil, err
+			return nil, db.checkDiskFull(err)
 		}
 	}
 
-	// 写入数据编码
-	record, size := data.EncodeLogRecord(logRecord)
-
-	// 如果这个数据满了那么将当前的转换为旧的数据文件，创建新的数据文件
-	if db.activeFiles.WriteOff+size > db.options.DataFileSize {
-		// 先将数据持久化
-		err := db.activeFiles.Sync()
+	// 旧格式或者 crc 算法和配置不一致的活跃文件不再追加写入，切换到新的文件
+	if db.activeFile().Version != data.CurrentFileFormat || db.activeFile().Checksum != db.options.Checksum {
+		err := db.rotateActiveFile()
 		if err != nil {
-			return nil, err
+			return nil, db.checkDiskFull(err)
 		}
-		// 将活跃文件转化为旧文件
-		db.olderFiles[db.activeFiles.FileId] = db.activeFiles
+	}
+
+	// 写入数据编码
+	record, size := data.EncodeLogRecordWithChecksum(logRecord, db.options.Checksum)
 
-		// 打开新的数据文件
-		err = db.setActiveData()
+	err := db.checkDiskUsage(size)
+	if err != nil {
+		return nil, err
+	}
+
+	// 如果这个数据满了那么将当前的转换为旧的数据文件，创建新的数据文件
+	if db.activeFile().WriteOff+size > db.options.DataFileSize {
+		err := db.rotateActiveFile()
 		if err != nil {
-			return nil, err
+			return nil, db.checkDiskFull(err)
 		}
 	}
 
 	// 数据的偏移地址
-	off := db.activeFiles.WriteOff
+	off := db.activeFile().WriteOff
 
-	// 写入数据
-	err := db.activeFiles.Write(record)
+	// 写入数据，失败时数据文件会回滚写入的部分数据
+	err = db.activeFile().Write(record)
 
 	if err != nil {
-		return nil, err
+		return nil, db.checkDiskFull(err)
+	}
+	if db.options.MaxDiskUsage > 0 {
+		db.diskUsage += size
 	}
 
 	// 根据用户所选是否需要持久化
 	if db.options.SyncWrites {
-		err := db.activeFiles.Sync()
+		err := db.syncActiveFile()
 		if err != nil {
-			return nil, err
+			return nil, db.checkDiskFull(err)
 		}
 	}
 
 	pos := &data.LogRecordPos{
-		Fid:    db.activeFiles.FileId,
+		Fid:    db.activeFile().FileId,
 		Offset: off,
+		Size:   uint32(size),
 	}
 
 	return pos, nil
@@ -387,8 +680,9 @@ func DestroyDB(db *DB) {
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.options.DirPath, data.SeqNoName)
 	_, err := os.Stat(fileName)
+	// 新建的数据库还没有保存过序列号
 	if os.IsNotExist(err) {
-		return err
+		return nil
 	}
 
 	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
@@ -407,7 +701,6 @@ func (db *DB) loadSeqNo() error {
 	}
 
 	db.seqNo = atoi
-	db.seqNoFileExists = true
 
 	return os.Remove(fileName)
 }
@@ -1,8 +1,14 @@
 package LustreDB
 
 import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
 	"github.com/lustresix/lxdb/utils"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
 	"testing"
 )
 
@@ -18,3 +24,615 @@ func TestDB_Close(t *testing.T) {
 	t.Log(string(get))
 	assert.Nil(t, err)
 }
+
+func TestDB_GetWithCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cache")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.CacheSize = 64 * 1024
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 100; i++ {
+		values[i] = utils.RandomValue(64)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+	assert.Equal(t, 100, db.cache.Len())
+
+	// 命中缓存，并且返回的数据被修改不影响缓存
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	value[0] = 'x'
+	value, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, values[1], value)
+
+	// 覆盖写之后读到的是新值
+	values[1] = utils.RandomValue(64)
+	err = db.Put(utils.GetTestKey(1), values[1])
+	assert.Nil(t, err)
+	value, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, values[1], value)
+
+	// merge 之后文件 id 会被复用，重启后读到的数据依然正确
+	for i := 0; i < 50; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(values, i)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	for i := 100; i < 150; i++ {
+		values[i] = utils.RandomValue(64)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 150; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		if expected, ok := values[i]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, expected, value)
+		} else {
+			assert.Equal(t, utils.ErrKeyNotFound, err)
+		}
+	}
+}
+
+func TestDB_ValueSize(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-value-size")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.ValueSize(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+
+	err = db.Put(utils.GetTestKey(1), make([]byte, 1000))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2), make([]byte, 20))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	size, err := db.ValueSize(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), size)
+
+	// 重启之后事务中的数据也要指向自己的位置
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	size, err = db.ValueSize(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), size)
+	value, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(value))
+}
+
+func TestDB_PutTooLarge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-too-large")
+	opts.DirPath = dir
+	opts.MaxKeySize = 16
+	opts.MaxValueSize = 1024
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(make([]byte, 17), []byte("value"))
+	assert.Equal(t, utils.ErrKeyTooLarge, err)
+	err = db.Put([]byte("key"), make([]byte, 1025))
+	assert.Equal(t, utils.ErrValueTooLarge, err)
+	err = db.Put(make([]byte, 16), make([]byte, 1024))
+	assert.Nil(t, err)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(make([]byte, 17), []byte("value"))
+	assert.Equal(t, utils.ErrKeyTooLarge, err)
+	err = wb.Put([]byte("key"), make([]byte, 1025))
+	assert.Equal(t, utils.ErrValueTooLarge, err)
+
+	err = db.PutReader([]byte("stream"), bytes.NewReader(make([]byte, 2048)), 2048)
+	assert.Equal(t, utils.ErrValueTooLarge, err)
+
+	_, err = Open(Options{DirPath: dir, MaxKeySize: -1})
+	assert.NotNil(t, err)
+}
+
+func TestDB_PutRecordSizeLimit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-record-size")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	// 默认配置下最长的 key 和最长的 value 也能放进一条记录中
+	key := make([]byte, opts.MaxKeySize)
+	assert.Equal(t, data.MaxLogRecordValueSize(opts.MaxKeySize+binary.MaxVarintLen64), opts.MaxValueSize)
+	assert.Nil(t, db.checkValueSize(key, opts.MaxValueSize, false))
+	assert.Equal(t, utils.ErrValueTooLarge, db.checkValueSize(key, opts.MaxValueSize+1, false))
+
+	// 没有限制 value 的长度时，普通写入的 value 受 key 的长度影响，流式写入不受影响
+	db.options.MaxValueSize = 0
+	limit := maxValueSize(3)
+	assert.Nil(t, db.checkValueSize([]byte("key"), limit, false))
+	assert.Equal(t, utils.ErrValueTooLarge, db.checkValueSize([]byte("key"), limit+1, false))
+	assert.Equal(t, utils.ErrValueTooLarge, db.checkValueSize([]byte("key"), math.MaxUint32, false))
+	assert.Nil(t, db.checkValueSize([]byte("key"), math.MaxUint32+1, true))
+
+	_, err = Open(Options{DirPath: dir, MaxKeySize: math.MaxUint32})
+	assert.NotNil(t, err)
+}
+
+func TestDB_Stat(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stat")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(900), stat.KeyNum)
+	assert.Greater(t, stat.DataFileNum, uint(1))
+	assert.Greater(t, stat.DiskSize, int64(0))
+}
+
+func TestDB_OpenParallel(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-open-parallel")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.IndexType = BTree
+	opts.IndexSnapshot = false
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i%500), utils.RandomValue(16))
+		assert.Nil(t, err)
+		if i%7 == 0 {
+			err := db.Delete(utils.GetTestKey(i % 500))
+			assert.Nil(t, err)
+		}
+		// 事务的数据会跨越多个数据文件
+		if i%300 == 0 {
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			for j := 0; j < 200; j++ {
+				err := wb.Put(utils.GetTestKey(j), utils.RandomValue(16))
+				assert.Nil(t, err)
+			}
+			err := wb.Commit()
+			assert.Nil(t, err)
+		}
+	}
+	assert.Greater(t, len(db.olderFiles()), 10)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	opts.IndexLoadWorkers = 1
+	db1, err := Open(opts)
+	assert.Nil(t, err)
+	opts.IndexLoadWorkers = 8
+	db8, err := Open(opts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, db1.seqNo, db8.seqNo)
+	assert.Equal(t, db1.activeFile().WriteOff, db8.activeFile().WriteOff)
+	assert.Equal(t, db1.index.Size(), db8.index.Size())
+	iterator := db1.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, iterator.Value(), db8.index.Get(iterator.Key()))
+	}
+	iterator.Close()
+	_ = db1.Close()
+	_ = db8.Close()
+}
+
+func TestDB_ShardedIndex(t *testing.T) {
+	for _, indexType := range []index.IndexerType{ShardedBTree, ShardedART} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-sharded")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.IndexShards = 4
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		keys := db.ListKeys()
+		assert.Equal(t, 100, len(keys))
+		assert.Equal(t, utils.GetTestKey(0), keys[0])
+
+		// 重启之后从索引快照中加载
+		err = db.Close()
+		assert.Nil(t, err)
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		value, err := db.Get(utils.GetTestKey(99))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(99), value)
+		DestroyDB(db)
+	}
+}
+
+func TestDB_BPtree(t *testing.T) {
+	testPersistentIndex(t, BPtree)
+}
+
+func TestDB_DiskHash(t *testing.T) {
+	testPersistentIndex(t, DiskHash)
+
+	// key 的长度受桶页大小的限制
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-disk-hash")
+	opts.DirPath = dir
+	opts.IndexType = DiskHash
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	err = db.Put(make([]byte, index.DiskHashMaxKeySize+1), []byte("value"))
+	assert.Equal(t, utils.ErrKeyTooLarge, err)
+	err = db.Put(bytes.Repeat([]byte("k"), index.DiskHashMaxKeySize), []byte("value"))
+	assert.Nil(t, err)
+}
+
+func TestDB_DiskHashCorrupted(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-disk-hash-corrupted")
+	opts.DirPath = dir
+	opts.IndexType = DiskHash
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 损坏所有的桶页
+	indexFile, err := os.OpenFile(index.DiskHashIndexFileName(dir), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	stat, err := indexFile.Stat()
+	assert.Nil(t, err)
+	for offset := int64(4096); offset < stat.Size(); offset += 4096 {
+		_, err = indexFile.WriteAt([]byte("corrupted"), offset+100)
+		assert.Nil(t, err)
+	}
+	_ = indexFile.Close()
+
+	// 读取索引失败时返回错误，而不是 key 不存在，并且通知监听器
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.NotNil(t, err)
+	assert.NotEqual(t, utils.ErrKeyNotFound, err)
+	assert.Equal(t, 1, len(listener.corruptions))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 重新打开时从数据文件中重建索引
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	for i := 0; i < 100; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), value)
+	}
+}
+
+func TestDB_DiskHashOpenFailed(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-disk-hash-open-failed")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+	opts.IndexType = DiskHash
+	// 索引文件的位置是一个目录，无法打开时返回错误而不是 panic
+	err := os.MkdirAll(index.DiskHashIndexFileName(dir), os.ModePerm)
+	assert.Nil(t, err)
+	db, err := Open(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, db)
+}
+
+// 保存在磁盘上的索引的读写和重新打开
+func testPersistentIndex(t *testing.T, indexType index.IndexerType) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-persistent-index")
+	opts.DirPath = dir
+	opts.IndexType = indexType
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("prefix-a"), []byte("a"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("prefix-b"), []byte("b"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put([]byte("batch"), []byte("batch"))
+	assert.Nil(t, err)
+	err = wb.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		_, err := db.Get(utils.GetTestKey(0))
+		assert.Equal(t, utils.ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, utils.ErrKeyNotFound, err)
+		value, err := db.Get([]byte("batch"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("batch"), value)
+		size, err := db.ValueSize(utils.GetTestKey(50))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(utils.GetTestKey(50))), size)
+
+		keys := db.ListKeys()
+		assert.Equal(t, 101, len(keys))
+		assert.Equal(t, []byte("batch"), keys[0])
+
+		var count int
+		err = db.Fold(func(key, value []byte) bool {
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 101, count)
+
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, uint(101), stat.KeyNum)
+
+		// 前缀遍历
+		iterator := db.NewIterator(IteratorOptions{Prefix: []byte("prefix-")})
+		var prefixKeys []string
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			prefixKeys = append(prefixKeys, string(iterator.Key()))
+		}
+		iterator.Close()
+		assert.Equal(t, []string{"prefix-a", "prefix-b"}, prefixKeys)
+
+		iterator = db.NewIterator(IteratorOptions{Reverse: true})
+		iterator.Seek([]byte("prefix-az"))
+		assert.Equal(t, []byte("prefix-a"), iterator.Key())
+		value, err = iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("a"), value)
+		iterator.Close()
+	}
+	check(db)
+
+	var buf bytes.Buffer
+	err = db.Export(&buf, DumpJSONLines)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, bytes.Count(buf.Bytes(), []byte("\n")))
+
+	// 重启之后索引仍然存在，事务也可以继续使用
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put([]byte("batch2"), []byte("batch2"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), db.seqNo)
+	DestroyDB(db)
+}
+
+func TestDB_BPtreeRecover(t *testing.T) {
+	testPersistentIndexRecover(t, BPtree)
+}
+
+func TestDB_DiskHashRecover(t *testing.T) {
+	testPersistentIndexRecover(t, DiskHash)
+}
+
+// 保存在磁盘上的索引崩溃之后从已经应用的位置重放数据文件
+func testPersistentIndexRecover(t *testing.T, indexType index.IndexerType) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-persistent-index-recover")
+	opts.DirPath = dir
+	opts.IndexType = indexType
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	// 数据已经写入，但是还没有更新索引就崩溃了
+	_, err = db.appendLogRecordWithLock(&data.LogRecord{
+		Key:   logRecordKeyWithSeq([]byte("not-indexed"), nonTransactionSeq),
+		Value: []byte("value"),
+		Type:  data.LogRecordNormal,
+	})
+	assert.Nil(t, err)
+	_, err = db.appendLogRecordWithLock(&data.LogRecord{
+		Key:  logRecordKeyWithSeq(utils.GetTestKey(1), nonTransactionSeq),
+		Type: data.LogRecordDelete,
+	})
+	assert.Nil(t, err)
+
+	// 不保存序列号，模拟崩溃之后重启
+	_ = db.index.Close()
+	_ = db.closeDataFiles()
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), db.seqNo)
+	value, err := db.Get([]byte("not-indexed"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	assert.Equal(t, 99, len(db.ListKeys()))
+
+	// 崩溃之后仍然可以使用事务
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(0), utils.GetTestKey(0))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), db.seqNo)
+
+	// 索引已经更新，但是数据没有刷盘就丢失了
+	pos := db.index.Get(utils.GetTestKey(50))
+	_ = db.index.Close()
+	_ = db.closeDataFiles()
+	err = os.Truncate(data.GetDataFileName(dir, pos.Fid), pos.Offset)
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), value)
+	}
+	for i := 50; i < 100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, utils.ErrKeyNotFound, err)
+	}
+	assert.Equal(t, 50, len(db.ListKeys()))
+	// 序列号不会回退
+	assert.Equal(t, uint64(2), db.seqNo)
+	DestroyDB(db)
+}
+
+func TestDB_SkipList(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-skiplist")
+	opts.DirPath = dir
+	opts.IndexType = SkipList
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	keys := db.ListKeys()
+	assert.Equal(t, 99, len(keys))
+	assert.Equal(t, utils.GetTestKey(1), keys[0])
+
+	iterator := db.NewIterator(IteratorOptions{Reverse: true})
+	iterator.Rewind()
+	assert.Equal(t, utils.GetTestKey(99), iterator.Key())
+	iterator.Close()
+
+	// 重启之后从索引快照中加载
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(db.ListKeys()))
+	value, err := db.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(99), value)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	DestroyDB(db)
+}
+
+func TestDB_HashIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hash")
+	opts.DirPath = dir
+	opts.IndexType = Hash
+	opts.IndexShards = 4
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("prefix-a"), []byte("a"))
+	assert.Nil(t, err)
+	keys := db.ListKeys()
+	assert.Equal(t, 101, len(keys))
+	assert.Equal(t, utils.GetTestKey(0), keys[0])
+
+	// 不要求顺序的前缀遍历
+	iterator := db.NewIterator(IteratorOptions{Prefix: []byte("prefix-"), Unordered: true})
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, []byte("prefix-a"), iterator.Key())
+		count++
+	}
+	iterator.Close()
+	assert.Equal(t, 1, count)
+
+	iterator = db.NewIterator(IteratorOptions{Unordered: true})
+	count = 0
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, value)
+		count++
+	}
+	iterator.Close()
+	assert.Equal(t, 101, count)
+
+	// 重启之后从索引快照中加载
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	value, err := db.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(99), value)
+	DestroyDB(db)
+}
@@ -0,0 +1,117 @@
+package LustreDB
+
+import (
+	"errors"
+	"github.com/lustresix/lxdb/utils"
+	"os"
+	"syscall"
+)
+
+// 磁盘空间管理
+// 设置了 MaxDiskUsage 时在内存中统计数据目录和 merge 目录的大小，写入之前检查，超过限制直接返回 ErrDiskQuotaExceeded
+// 统计的大小在打开、切换活跃文件和 merge 之后重新计算，期间只累加写入数据文件的数据
+// merge 期间 merge 目录和旧的数据文件同时占用空间，所以也计算在限制之内，merge 完成之后直接替换旧的数据文件释放空间
+// 写入时磁盘写满（ENOSPC）会回滚写入的部分数据，并进入只读状态，读取不受影响
+// merge 完成之后重新检查，空间足够时自动恢复写入
+
+// 获取可用的磁盘空间，测试时替换
+var availableDiskSize = utils.AvailableDiskSize
+
+// 检查写入 size 大小的数据之后是否会超过磁盘空间的限制，调用时需要持有锁
+func (db *DB) checkDiskUsage(size int64) error {
+	if db.options.MaxDiskUsage > 0 && db.diskUsage+size > db.options.MaxDiskUsage {
+		return utils.ErrDiskQuotaExceeded
+	}
+	return nil
+}
+
+// 持有读锁检查磁盘空间和只读状态，用于在写入多条数据之前提前失败
+func (db *DB) checkWritable(size int64) error {
+	db.lo.RLock()
+	defer db.lo.RUnlock()
+	if db.readOnly {
+		return utils.ErrReadOnly
+	}
+	return db.checkDiskUsage(size)
+}
+
+// 写入返回的错误是磁盘已满时进入只读状态，返回原来的错误，调用时需要持有锁
+func (db *DB) checkDiskFull(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		db.readOnly = true
+	}
+	return err
+}
+
+// 重新统计数据目录和 merge 目录的大小，调用时需要持有锁
+func (db *DB) refreshDiskUsage() error {
+	if db.options.MaxDiskUsage <= 0 {
+		return nil
+	}
+	size, err := utils.DirSize(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	mergeSize, err := utils.DirSize(db.getMergePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db.diskUsage = size + mergeSize
+	return nil
+}
+
+// merge 的实例最多可以使用的磁盘空间，为 0 表示不限制，调用时需要持有锁
+// merge 只重写旧数据文件中的有效数据，完成之后旧文件会被删除，所以剩余的限额不够时最多可以使用旧数据文件大小的空间，
+// merge 期间数据目录可以暂时超过 MaxDiskUsage，只有磁盘实际剩余的空间放不下有效数据时 merge 才会失败
+// 之前的 merge 目录会被这次 merge 删除，它占用的空间也可以使用
+func (db *DB) mergeDiskQuota(olderSize int64) (int64, error) {
+	if db.options.MaxDiskUsage <= 0 {
+		return 0, nil
+	}
+	mergeSize, err := utils.DirSize(db.getMergePath())
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	quota := db.options.MaxDiskUsage - db.diskUsage + mergeSize
+	if quota < olderSize {
+		quota = olderSize
+	}
+	available, err := availableDiskSize(db.options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	// 无法获取可用空间时返回 -1，只按照旧数据文件的大小限制
+	if available >= 0 && quota > available+mergeSize {
+		quota = available + mergeSize
+	}
+	if quota <= 0 {
+		return 0, utils.ErrDiskQuotaExceeded
+	}
+	return quota, nil
+}
+
+// merge 完成之后重新统计磁盘空间，只读状态下只有空间足够时才恢复写入
+// 没有超过 MaxDiskUsage 并且剩余的磁盘空间能够写满一个数据文件才算足够
+func (db *DB) resumeWrites() error {
+	db.lo.Lock()
+	defer db.lo.Unlock()
+	if err := db.refreshDiskUsage(); err != nil {
+		return err
+	}
+	if !db.readOnly {
+		return nil
+	}
+	if db.options.MaxDiskUsage > 0 && db.diskUsage >= db.options.MaxDiskUsage {
+		return nil
+	}
+	available, err := availableDiskSize(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	// 无法获取可用空间时返回 -1，只能依赖 MaxDiskUsage 判断
+	if available >= 0 && available < db.options.DataFileSize {
+		return nil
+	}
+	db.readOnly = false
+	return nil
+}
@@ -0,0 +1,215 @@
+package LustreDB
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/io"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// 模拟磁盘写满，只写入一部分数据然后返回 ENOSPC
+type diskFullIO struct {
+	io.IOManager
+}
+
+func (d *diskFullIO) Write(b []byte) (int, error) {
+	n, _ := d.IOManager.Write(b[:len(b)/2])
+	return n, &os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}
+}
+
+func TestDB_MaxDiskUsage(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-disk-usage")
+	opts.DirPath = dir
+	opts.MaxDiskUsage = 64 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+
+	var count int
+	for ; ; count++ {
+		err = db.Put(utils.GetTestKey(count), utils.RandomValue(128))
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, err)
+	assert.Greater(t, count, 0)
+	size, err := utils.DirSize(dir)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, size, opts.MaxDiskUsage)
+
+	// 批量写入和流式写入在写入之前就会失败
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch"), utils.RandomValue(1024)))
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, wb.Commit())
+	value := utils.RandomValue(128 * 1024)
+	err = db.PutReader([]byte("stream"), bytes.NewReader(value), int64(len(value)))
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, err)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, size, stat.DiskSize)
+	// 超过限制不是只读状态
+	assert.False(t, stat.ReadOnly)
+
+	for i := 0; i < count; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	opts.MaxDiskUsage = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_DiskFull(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-disk-full")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		DestroyDB(db)
+	}()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	// 写入失败之后回滚写入的部分数据，进入只读状态
+	active := db.activeFile()
+	writeOff := active.WriteOff
+	active.IOManager = &diskFullIO{IOManager: active.IOManager}
+	err = db.Put(utils.GetTestKey(100), utils.RandomValue(1024))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, writeOff, active.WriteOff)
+	size, err := active.IOManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, size)
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.ReadOnly)
+	assert.Equal(t, utils.ErrReadOnly, db.Put(utils.GetTestKey(100), utils.GetTestKey(100)))
+	assert.Equal(t, utils.ErrReadOnly, db.Delete(utils.GetTestKey(0)))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(100), utils.GetTestKey(100)))
+	assert.Equal(t, utils.ErrReadOnly, wb.Commit())
+	err = db.PutReader(utils.GetTestKey(100), bytes.NewReader([]byte("value")), 5)
+	assert.Equal(t, utils.ErrReadOnly, err)
+
+	// 只读状态下仍然可以读取
+	value, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(0), value)
+
+	// merge 之后磁盘剩余的空间仍然不够写满一个数据文件时保持只读状态
+	available := availableDiskSize
+	defer func() {
+		availableDiskSize = available
+	}()
+	availableDiskSize = func(string) (int64, error) {
+		return opts.DataFileSize - 1, nil
+	}
+	assert.Nil(t, db.Merge())
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.ReadOnly)
+	assert.Equal(t, utils.ErrReadOnly, db.Put(utils.GetTestKey(100), utils.GetTestKey(100)))
+
+	// 空间足够之后再次 merge，重新检查之后自动恢复写入
+	availableDiskSize = func(string) (int64, error) {
+		return opts.DataFileSize, nil
+	}
+	assert.Nil(t, db.Merge())
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.False(t, stat.ReadOnly)
+	assert.Nil(t, db.Put(utils.GetTestKey(100), utils.GetTestKey(100)))
+
+	// 没有留下不完整的记录，重新打开之后数据完整
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i <= 100; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), value)
+	}
+}
+
+func TestDB_MergeDiskUsage(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-disk-usage")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MaxDiskUsage = 256 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		DestroyDB(db)
+	}()
+
+	// 只有 10 个有效的 key，反复覆盖直到超过限制
+	values := make(map[int][]byte)
+	for i := 0; err == nil; i++ {
+		value := utils.RandomValue(1024)
+		err = db.Put(utils.GetTestKey(i%10), value)
+		if err == nil {
+			values[i%10] = value
+		}
+	}
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, err)
+
+	// 剩余的限额不够，但是有效数据放得下，merge 之后直接替换旧的文件，不需要重新打开就可以继续写入
+	assert.Nil(t, db.Merge())
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	size, err := utils.DirSize(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, size, db.diskUsage)
+	assert.Less(t, db.diskUsage, opts.MaxDiskUsage/2)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("after merge")))
+	values[0] = []byte("after merge")
+	check := func(db *DB) {
+		for i, expected := range values {
+			value, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, expected, value)
+		}
+	}
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+
+	// 磁盘实际剩余的空间放不下有效数据时 merge 失败，没有完成的 merge 目录会被删除
+	for err == nil {
+		err = db.Put(utils.GetTestKey(0), utils.RandomValue(1024))
+	}
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, err)
+	available := availableDiskSize
+	defer func() {
+		availableDiskSize = available
+	}()
+	availableDiskSize = func(string) (int64, error) {
+		return 4 * 1024, nil
+	}
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, db.Merge())
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	size, err = utils.DirSize(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, size, db.diskUsage)
+	assert.Equal(t, utils.ErrDiskQuotaExceeded, db.Put(utils.GetTestKey(0), utils.RandomValue(1024)))
+
+	// 空间足够之后 merge 恢复写入
+	availableDiskSize = available
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(1024)))
+}
@@ -0,0 +1,207 @@
+package LustreDB
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"io"
+	"unicode/utf8"
+)
+
+// DumpFormat 导出和导入数据使用的格式
+type DumpFormat int8
+
+const (
+	// DumpJSONLines 每行一个 JSON 对象，不是合法 UTF-8 的 key 或 value 使用 base64 编码
+	DumpJSONLines DumpFormat = iota + 1
+
+	// DumpBinary 紧凑的二进制格式，magic + [keySize + key + valueSize + value]... + 0
+	DumpBinary
+)
+
+// 二进制格式的文件头
+var dumpMagic = []byte("LXDUMP1\n")
+
+const dumpEncodingBase64 = "base64"
+
+// JSON Lines 格式中的一行
+type dumpEntry struct {
+	Key           string `json:"key"`
+	KeyEncoding   string `json:"key_encoding,omitempty"`
+	Value         string `json:"value"`
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
+
+// Export 将数据库中的所有数据按照指定的格式写入 w
+func (db *DB) Export(w io.Writer, format DumpFormat) error {
+	bw := bufio.NewWriter(w)
+
+	var writeEntry func(key, value []byte) error
+	switch format {
+	case DumpJSONLines:
+		encoder := json.NewEncoder(bw)
+		writeEntry = func(key, value []byte) error {
+			entry := &dumpEntry{}
+			entry.Key, entry.KeyEncoding = encodeDumpField(key)
+			entry.Value, entry.ValueEncoding = encodeDumpField(value)
+			return encoder.Encode(entry)
+		}
+	case DumpBinary:
+		if _, err := bw.Write(dumpMagic); err != nil {
+			return err
+		}
+		lenBuf := make([]byte, binary.MaxVarintLen64)
+		writeEntry = func(key, value []byte) error {
+			for _, field := range [][]byte{key, value} {
+				n := binary.PutUvarint(lenBuf, uint64(len(field)))
+				if _, err := bw.Write(lenBuf[:n]); err != nil {
+					return err
+				}
+				if _, err := bw.Write(field); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	default:
+		return utils.ErrUnsupportedDumpFormat
+	}
+
+	var writeErr error
+	err := db.Fold(func(key, value []byte) bool {
+		writeErr = writeEntry(key, value)
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	// 二进制格式以长度为 0 的 key 结尾，用于发现被截断的数据
+	if format == DumpBinary {
+		if err := bw.WriteByte(0); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import 从 r 中读取指定格式的数据写入数据库，prefix 不为空时只导入以 prefix 开头的 key
+// 数据按照 DefaultWriteBatchOptions.MaxBatchNum 分批使用 WriteBatch 提交
+func (db *DB) Import(r io.Reader, format DumpFormat, prefix []byte) error {
+	var readEntry func() ([]byte, []byte, error)
+	switch format {
+	case DumpJSONLines:
+		decoder := json.NewDecoder(r)
+		readEntry = func() ([]byte, []byte, error) {
+			entry := &dumpEntry{}
+			if err := decoder.Decode(entry); err != nil {
+				return nil, nil, err
+			}
+			key, err := decodeDumpField(entry.Key, entry.KeyEncoding)
+			if err != nil {
+				return nil, nil, err
+			}
+			value, err := decodeDumpField(entry.Value, entry.ValueEncoding)
+			if err != nil {
+				return nil, nil, err
+			}
+			return key, value, nil
+		}
+	case DumpBinary:
+		br := bufio.NewReader(r)
+		magic := make([]byte, len(dumpMagic))
+		if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, dumpMagic) {
+			return utils.ErrInvalidDump
+		}
+		readEntry = func() ([]byte, []byte, error) {
+			key, err := readDumpField(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			// 结束标识
+			if len(key) == 0 {
+				return nil, nil, io.EOF
+			}
+			value, err := readDumpField(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			return key, value, nil
+		}
+	default:
+		return utils.ErrUnsupportedDumpFormat
+	}
+
+	batchOptions := DefaultWriteBatchOptions
+	wb := db.NewWriteBatch(batchOptions)
+	for {
+		key, value, err := readEntry()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(prefix) > 0 && !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if err := wb.Put(key, value); err != nil {
+			return err
+		}
+		if uint(len(wb.pendingWrites)) >= batchOptions.MaxBatchNum {
+			if err := wb.Commit(); err != nil {
+				return err
+			}
+		}
+	}
+	return wb.Commit()
+}
+
+// 不是合法 UTF-8 的数据使用 base64 编码
+func encodeDumpField(field []byte) (string, string) {
+	if utf8.Valid(field) {
+		return string(field), ""
+	}
+	return base64.StdEncoding.EncodeToString(field), dumpEncodingBase64
+}
+
+func decodeDumpField(field, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(field), nil
+	case dumpEncodingBase64:
+		return base64.StdEncoding.DecodeString(field)
+	default:
+		return nil, utils.ErrInvalidDump
+	}
+}
+
+func readDumpField(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			// 没有读到结束标识说明数据被截断了
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if size > data.MaxLogRecordFieldSize {
+		return nil, utils.ErrInvalidDump
+	}
+	field := make([]byte, size)
+	if _, err := io.ReadFull(br, field); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return field, nil
+}
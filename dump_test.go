@@ -0,0 +1,89 @@
+package LustreDB
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func openDumpTestDB(t *testing.T, pattern string) (*DB, Options) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", pattern)
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	return db, opts
+}
+
+func TestDB_ExportImport(t *testing.T) {
+	for _, format := range []DumpFormat{DumpJSONLines, DumpBinary} {
+		src, _ := openDumpTestDB(t, "bitcask-go-export")
+		values := make(map[string][]byte)
+		for i := 0; i < 100; i++ {
+			values[string(utils.GetTestKey(i))] = utils.RandomValue(16)
+		}
+		// 不是合法 UTF-8 的 key 和 value
+		values[string([]byte{0xff, 0xfe, 0x01})] = []byte{0x00, 0xc3, 0x28}
+		values["empty-value"] = []byte{}
+		for key, value := range values {
+			err := src.Put([]byte(key), value)
+			assert.Nil(t, err)
+		}
+
+		buf := new(bytes.Buffer)
+		err := src.Export(buf, format)
+		assert.Nil(t, err)
+		if format == DumpJSONLines {
+			assert.Equal(t, len(values), strings.Count(buf.String(), "\n"))
+		}
+
+		dst, _ := openDumpTestDB(t, "bitcask-go-import")
+		err = dst.Import(bytes.NewReader(buf.Bytes()), format, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, len(values), len(dst.ListKeys()))
+		for key, value := range values {
+			got, err := dst.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, len(value), len(got))
+			assert.Equal(t, string(value), string(got))
+		}
+
+		// 按前缀导入
+		filtered, _ := openDumpTestDB(t, "bitcask-go-import-prefix")
+		err = filtered.Import(bytes.NewReader(buf.Bytes()), format, []byte("bitcask-go-key-00000001"))
+		assert.Nil(t, err)
+		assert.Equal(t, 10, len(filtered.ListKeys()))
+
+		DestroyDB(src)
+		DestroyDB(dst)
+		DestroyDB(filtered)
+	}
+}
+
+func TestDB_ImportInvalid(t *testing.T) {
+	src, _ := openDumpTestDB(t, "bitcask-go-export-invalid")
+	defer DestroyDB(src)
+	err := src.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	err = src.Export(buf, DumpBinary)
+	assert.Nil(t, err)
+
+	dst, _ := openDumpTestDB(t, "bitcask-go-import-invalid")
+	defer DestroyDB(dst)
+
+	// 被截断的数据
+	err = dst.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), DumpBinary, nil)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	err = dst.Import(strings.NewReader("not a dump"), DumpBinary, nil)
+	assert.Equal(t, utils.ErrInvalidDump, err)
+
+	err = dst.Import(strings.NewReader(""), DumpFormat(100), nil)
+	assert.Equal(t, utils.ErrUnsupportedDumpFormat, err)
+}
@@ -0,0 +1,101 @@
+package LustreDB
+
+import (
+	"errors"
+	"github.com/lustresix/lxdb/utils"
+	"math"
+	"time"
+)
+
+// EventListener 生命周期事件监听器，引擎发生重要事件时回调用户的代码
+// 回调在引擎内部同步执行，实现中不应该做耗时的操作，也不能再调用 DB 的方法
+type EventListener interface {
+	// OnFileRotated 活跃文件写满转为旧文件，并打开新的活跃文件之后调用
+	OnFileRotated(oldFid, newFid uint32)
+
+	// OnMergeBegin merge 开始时调用
+	OnMergeBegin()
+
+	// OnMergeEnd merge 结束时调用，无论成功还是失败
+	OnMergeEnd(stats *MergeStats)
+
+	// OnSync 活跃文件持久化之后调用
+	OnSync(duration time.Duration)
+
+	// OnCorruption 读取数据时 crc 校验不通过时调用
+	// 磁盘哈希索引的桶页读取失败或者损坏时 fid 为 IndexFileFid，offset 是页在索引文件中的偏移
+	OnCorruption(fid uint32, offset int64, err error)
+
+	// OnOpen 数据库打开完成之后调用
+	OnOpen(stats *OpenStats)
+}
+
+// MergeStats merge 的统计信息
+type MergeStats struct {
+	// 参与 merge 的数据文件数量
+	FileNum int
+
+	// 重写到新文件中的有效记录数量
+	ValidRecords int
+
+	// 被丢弃的无效记录数量
+	DiscardedRecords int
+
+	// merge 耗时
+	Duration time.Duration
+
+	// merge 失败时的错误
+	Err error
+}
+
+// OpenStats 数据库打开时的统计信息
+type OpenStats struct {
+	// 数据文件数量
+	DataFileNum int
+
+	// 索引中 key 的数量
+	KeyNum int
+
+	// 索引是否从索引快照中加载
+	FromSnapshot bool
+
+	// 打开数据库的耗时
+	Duration time.Duration
+}
+
+// IndexFileFid 磁盘哈希索引文件损坏时传给 OnCorruption 的 fid，不会和数据文件的 id 重复
+const IndexFileFid = math.MaxUint32
+
+// NopEventListener 不做任何操作的监听器，用户没有设置监听器时使用
+type NopEventListener struct{}
+
+func (NopEventListener) OnFileRotated(uint32, uint32) {}
+
+func (NopEventListener) OnMergeBegin() {}
+
+func (NopEventListener) OnMergeEnd(*MergeStats) {}
+
+func (NopEventListener) OnSync(time.Duration) {}
+
+func (NopEventListener) OnCorruption(uint32, int64, error) {}
+
+func (NopEventListener) OnOpen(*OpenStats) {}
+
+// 读取数据出错时，如果是 crc 校验不通过就通知监听器
+func (db *DB) notifyCorruption(fid uint32, offset int64, err error) {
+	if errors.Is(err, utils.ErrorIncorrectCrc) {
+		db.options.EventListener.OnCorruption(fid, offset, err)
+	}
+}
+
+// 持久化当前活跃文件，并通知监听器
+// 在访问此方法必须要持有互斥锁
+func (db *DB) syncActiveFile() error {
+	start := time.Now()
+	err := db.activeFile().Sync()
+	if err != nil {
+		return err
+	}
+	db.options.EventListener.OnSync(time.Since(start))
+	return nil
+}
@@ -0,0 +1,109 @@
+package LustreDB
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+type testEventListener struct {
+	NopEventListener
+	rotated     [][2]uint32
+	mergeBegin  int
+	mergeStats  []*MergeStats
+	syncs       int
+	corruptions []int64
+	opens       []*OpenStats
+}
+
+func (l *testEventListener) OnFileRotated(oldFid, newFid uint32) {
+	l.rotated = append(l.rotated, [2]uint32{oldFid, newFid})
+}
+
+func (l *testEventListener) OnMergeBegin() {
+	l.mergeBegin++
+}
+
+func (l *testEventListener) OnMergeEnd(stats *MergeStats) {
+	l.mergeStats = append(l.mergeStats, stats)
+}
+
+func (l *testEventListener) OnSync(time.Duration) {
+	l.syncs++
+}
+
+func (l *testEventListener) OnCorruption(_ uint32, offset int64, _ error) {
+	l.corruptions = append(l.corruptions, offset)
+}
+
+func (l *testEventListener) OnOpen(stats *OpenStats) {
+	l.opens = append(l.opens, stats)
+}
+
+func TestEventListener(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-event")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.IndexType = BTree
+	opts.EventListener = listener
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(listener.opens))
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.NotEmpty(t, listener.rotated)
+	for _, r := range listener.rotated {
+		assert.Equal(t, r[0]+1, r[1])
+	}
+
+	syncs := listener.syncs
+	err = db.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, syncs+1, listener.syncs)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, listener.mergeBegin)
+	assert.Equal(t, 1, len(listener.mergeStats))
+	assert.Nil(t, listener.mergeStats[0].Err)
+	assert.Equal(t, 100, listener.mergeStats[0].ValidRecords)
+}
+
+func TestEventListener_OnCorruption(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-event-corruption")
+	opts.DirPath = dir
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	_ = os.Remove(dir + "/" + data.SeqNoName)
+	_ = os.Remove(dir + "/" + data.IndexSnapshotName)
+
+	// 改坏数据文件中的一个字节
+	name := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	buf[len(buf)-1] ^= 0xff
+	err = os.WriteFile(name, buf, 0644)
+	assert.Nil(t, err)
+
+	opts.EventListener = listener
+	_, err = Open(opts)
+	assert.Equal(t, utils.ErrorIncorrectCrc, err)
+	assert.Equal(t, []int64{data.FileHeaderSize}, listener.corruptions)
+	_ = os.RemoveAll(dir)
+}
@@ -0,0 +1,163 @@
+package LustreDB
+
+import (
+	"github.com/lustresix/lxdb/data"
+)
+
+// fileView 数据文件的不可变视图
+// 切换活跃文件时创建新的视图整体替换，读取时拿到的视图不会再变化，不需要加锁
+type fileView struct {
+	// 活跃文件
+	active *data.DataFile
+
+	// 旧的数据文件
+	older map[uint32]*data.DataFile
+}
+
+// 根据文件的 id 找到数据文件,如果活跃文件里没有，就从旧的数据文件里面找
+func (v *fileView) get(fid uint32) *data.DataFile {
+	if v.active != nil && v.active.FileId == fid {
+		return v.active
+	}
+	return v.older[fid]
+}
+
+// 以 file 作为新的活跃文件创建新的视图，原来的活跃文件转为旧文件
+func (v *fileView) rotate(file *data.DataFile) *fileView {
+	older := make(map[uint32]*data.DataFile)
+	if v != nil {
+		for fid, f := range v.older {
+			older[fid] = f
+		}
+		if v.active != nil {
+			older[v.active.FileId] = v.active
+		}
+	}
+	return &fileView{active: file, older: older}
+}
+
+// 加入 added 中的文件，去掉 removed 中的文件，创建新的视图，merge 替换数据文件时使用
+func (v *fileView) replace(added, removed map[uint32]*data.DataFile) *fileView {
+	older := make(map[uint32]*data.DataFile, len(v.older)+len(added))
+	for fid, f := range v.older {
+		if _, ok := removed[fid]; !ok {
+			older[fid] = f
+		}
+	}
+	for fid, f := range added {
+		older[fid] = f
+	}
+	return &fileView{active: v.active, older: older}
+}
+
+// 增加视图中所有文件的引用，有文件已经被关闭时返回 false
+func (v *fileView) acquireAll() bool {
+	var acquired []*data.DataFile
+	for _, file := range v.files() {
+		if !file.Acquire() {
+			for _, f := range acquired {
+				_ = f.Release()
+			}
+			return false
+		}
+		acquired = append(acquired, file)
+	}
+	return true
+}
+
+// 释放 pinFiles 增加的引用
+func (v *fileView) unpin() {
+	for _, file := range v.files() {
+		_ = file.Release()
+	}
+}
+
+func (v *fileView) files() []*data.DataFile {
+	files := make([]*data.DataFile, 0, len(v.older)+1)
+	for _, f := range v.older {
+		files = append(files, f)
+	}
+	if v.active != nil {
+		files = append(files, v.active)
+	}
+	return files
+}
+
+// 当前的活跃文件
+func (db *DB) activeFile() *data.DataFile {
+	view := db.files.Load()
+	if view == nil {
+		return nil
+	}
+	return view.active
+}
+
+// 当前的旧数据文件，不能修改
+func (db *DB) olderFiles() map[uint32]*data.DataFile {
+	view := db.files.Load()
+	if view == nil {
+		return nil
+	}
+	return view.older
+}
+
+// 找到数据文件并增加引用，读取结束之后需要调用 Release
+// 不需要持有锁，引用期间文件不会被关闭
+func (db *DB) acquireDataFile(fid uint32) *data.DataFile {
+	for {
+		view := db.files.Load()
+		if view == nil {
+			return nil
+		}
+		file := view.get(fid)
+		if file == nil {
+			return nil
+		}
+		if file.Acquire() {
+			return file
+		}
+		// 文件已经被关闭，视图没有变化说明数据库已经关闭了
+		if db.files.Load() == view {
+			return nil
+		}
+	}
+}
+
+// 增加当前视图中所有文件的引用，之后 merge 从视图中去掉了其中的文件也可以继续读取，用完之后需要调用 unpin
+// 迭代器和流式读取会在之后读取创建时从索引中取出的位置，需要保证这些位置所在的文件不会被关闭
+// 数据库已经关闭时返回空
+func (db *DB) pinFiles() *fileView {
+	for {
+		view := db.files.Load()
+		if view == nil {
+			return nil
+		}
+		if view.acquireAll() {
+			return view
+		}
+		if db.files.Load() == view {
+			return nil
+		}
+	}
+}
+
+// 关闭所有的数据文件，正在读取的文件等读取结束之后再关闭
+// 在访问此方法必须要持有互斥锁
+func (db *DB) closeDataFiles() error {
+	view := db.files.Swap(nil)
+	if view == nil {
+		return nil
+	}
+	var closeErr error
+	for _, file := range view.older {
+		if err := file.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	if view.active != nil {
+		if err := view.active.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
@@ -0,0 +1,193 @@
+package LustreDB
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 并发读写，读取不加锁，数据文件会不断切换，运行时需要加上 -race
+func TestDB_ConcurrentGet(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-concurrent-get")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.IndexType = BTree
+	opts.CacheSize = 8 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+
+	const keyNum = 200
+	for i := 0; i < keyNum; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	var stop int32
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+				key := utils.GetTestKey((i*7 + w) % keyNum)
+				value, err := db.Get(key)
+				// 写入的 value 总是等于 key，或者被删除了
+				if err == nil {
+					assert.Equal(t, key, value)
+				} else {
+					assert.Equal(t, utils.ErrKeyNotFound, err)
+				}
+				_, _ = db.ValueSize(key)
+			}
+		}(w)
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := utils.GetTestKey(i % keyNum)
+		switch i % 10 {
+		case 0:
+			_ = db.Delete(key)
+		case 1:
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			_ = wb.Put(key, key)
+			_ = wb.Commit()
+		default:
+			err := db.Put(key, key)
+			assert.Nil(t, err)
+		}
+		// merge 在运行中替换数据文件，读取到旧位置的请求重新查找之后读取新的位置
+		if i%1000 == 500 {
+			err := db.Merge()
+			assert.Nil(t, err)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	assert.Greater(t, len(db.olderFiles()), 1)
+}
+
+// 关闭数据库时还在读取的数据文件要等读取结束之后再关闭
+func TestDB_GetWhileClose(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-get-close")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.IndexType = ART
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				value, err := db.Get(utils.GetTestKey(i % 500))
+				if err == nil {
+					assert.Equal(t, utils.GetTestKey(i%500), value)
+				} else {
+					assert.Equal(t, utils.ErrDataFileNotFound, err)
+				}
+			}
+		}()
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	wg.Wait()
+
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrDataFileNotFound, err)
+}
+
+// merge 替换掉的数据文件在迭代器和流式读取释放引用之后才会关闭，它们仍然可以读取创建时的数据
+func TestDB_MergePinnedFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-pinned")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.IndexType = ART
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+
+	for i := 0; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	stream := utils.RandomValue(40 * 1024)
+	err = db.PutReader([]byte("stream"), bytes.NewReader(stream), int64(len(stream)))
+	assert.Nil(t, err)
+
+	var older []*data.DataFile
+	for _, file := range db.olderFiles() {
+		older = append(older, file)
+	}
+	older = append(older, db.activeFile())
+	iterator := db.NewIterator(IteratorOptions{})
+	reader, err := db.GetReader([]byte("stream"))
+	assert.Nil(t, err)
+
+	// merge 之后旧的位置被覆盖和删除，新的数据写到新的文件中
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("stream"), []byte("new"))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	for fid := range db.olderFiles() {
+		for _, file := range older {
+			assert.NotEqual(t, file.FileId, fid)
+		}
+	}
+
+	// 迭代器和流式读取仍然读到 merge 之前的数据
+	count := 0
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		assert.Nil(t, err)
+		if bytes.Equal(iterator.Key(), []byte("stream")) {
+			assert.Equal(t, stream, value)
+		} else {
+			assert.Equal(t, iterator.Key(), value)
+		}
+		count++
+	}
+	assert.Equal(t, 201, count)
+	value, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, stream, value)
+
+	// 释放引用之后旧文件才被关闭
+	for _, file := range older {
+		_, err := file.IOManager.Size()
+		assert.Nil(t, err)
+	}
+	iterator.Close()
+	assert.Nil(t, reader.Close())
+	for _, file := range older {
+		_, err := file.IOManager.Size()
+		assert.NotNil(t, err)
+	}
+
+	value, err = db.Get([]byte("stream"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), value)
+	assert.Equal(t, 101, len(db.ListKeys()))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/lustresix/lxdb/utils"
 )
 
 type Request struct {
@@ -18,6 +20,10 @@ func (CommonApi) PutApi(c *gin.Context) {
 		return
 	}
 	err := putData(cr.Data)
+	if errors.Is(err, utils.ErrKeyTooLarge) || errors.Is(err, utils.ErrValueTooLarge) {
+		FailWithCode(TOO_LARGE, err.Error(), c)
+		return
+	}
 	if err != nil {
 		FailWithMsg(err.Error(), c)
 		return
@@ -9,9 +9,10 @@ import (
 
 var db *LustreDB.DB
 
+var options = LustreDB.DefaultOptions
+
 func init() {
 	var err error
-	options := LustreDB.DefaultOptions
 	dir, err := os.MkdirTemp("", "bitcask-go-http")
 	options.DirPath = dir
 	db, err = LustreDB.Open(options)
@@ -1,13 +1,21 @@
 package main
 
+import LustreDB "github.com/lustresix/lxdb"
+
+// 使用批量写入，任意一条数据的长度超出限制时所有数据都不会写入
+// 批次的大小不做限制，是否持久化和数据库的 SyncWrites 一致
 func putData(data map[string]string) error {
+	wb := db.NewWriteBatch(LustreDB.WriteBatchOptions{
+		MaxBatchNum: uint(len(data)),
+		SyncWrite:   options.SyncWrites,
+	})
 	for key, value := range data {
-		err := db.Put([]byte(key), []byte(value))
+		err := wb.Put([]byte(key), []byte(value))
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return wb.Commit()
 }
 
 func getValue(data []string) ([]string, error) {
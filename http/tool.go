@@ -6,8 +6,9 @@ import (
 )
 
 const (
-	SUCCESS = 200
-	ERROR   = 500
+	SUCCESS   = 200
+	TOO_LARGE = 413
+	ERROR     = 500
 )
 
 type Response struct {
@@ -20,6 +21,10 @@ func FailWithMsg(msg string, c *gin.Context) {
 	Result(ERROR, map[string]any{}, msg, c)
 }
 
+func FailWithCode(code int, msg string, c *gin.Context) {
+	Result(code, map[string]any{}, msg, c)
+}
+
 func OKWithMsg(msg string, c *gin.Context) {
 	Result(SUCCESS, map[string]any{}, msg, c)
 }
@@ -3,17 +3,81 @@ package index
 import (
 	"bytes"
 	"github.com/lustresix/lxdb/data"
-	goart "github.com/plar/go-adaptive-radix-tree"
-	"sort"
 	"sync"
+	"sync/atomic"
 )
 
-// AdaptiveRadixTree 封装https://github.com/plar/go-adaptive-radix-tree
+// 自适应基数树
+// 内部节点按照子节点的数量分为 4、16、48、256 四种，子节点变多或者变少时切换节点的类型
+// 内部节点保存压缩的公共前缀，只有一个子节点的路径会被合并，叶子节点保存完整的 key
+// key 可以是另一个 key 的前缀，在内部节点结束的 key 保存在节点的 leaf 中，排在所有子节点之前
+// 迭代器保存从根节点到当前叶子节点的路径，Seek 时沿着 key 向下查找，不需要从头遍历
+//
+// 写时复制：每棵树有自己的代数，节点记录创建它的树的代数，代数相同的节点只属于这棵树，可以直接修改
+// 创建迭代器时生成一个和原来的树共享所有节点的快照，原来的树换一个新的代数，之后修改共享的节点时先复制一份
+// 叶子节点创建之后不会被修改，更新位置信息时替换为新的叶子节点
+//
+// 叶子节点的 key 拷贝到 keyArena 中连续存放，内部节点的前缀直接引用叶子节点的 key
+// 删除的 key 超过内存池的一半时重建整棵树，把 key 拷贝到新的内存池中
+
+type artKind uint8
+
+const (
+	artNode4 artKind = iota
+	artNode16
+	artNode48
+	artNode256
+)
+
+// 子节点是 *artNode 或者 *artLeaf
+type artChild interface{}
+
+// 叶子节点，key 指向内存池，位置信息内联保存，一共 32 字节
+type artLeaf struct {
+	key string
+	pos packedPos
+}
+
+// 内部节点
+type artNode struct {
+	kind artKind
+
+	// 压缩的公共前缀
+	prefix []byte
+
+	// 正好在这个节点结束的 key
+	leaf *artLeaf
+
+	// 子节点的数量
+	num int
+
+	// node4、node16 中是排好序的边，和 children 一一对应
+	// node48 中是 256 个槽位，保存边对应的子节点在 children 中的下标加一，node256 中为空
+	keys []byte
+
+	children []artChild
+
+	// 创建这个节点的树的代数
+	gen uint64
+}
+
+// AdaptiveRadixTree 自适应基数树索引
 type AdaptiveRadixTree struct {
-	tree goart.Tree
+	root artChild
+	size int
+
+	// 当前的代数，只有代数相同的节点可以直接修改
+	gen uint64
+
+	// 叶子节点的 key 所在的内存池
+	arena *keyArena
+
 	lock *sync.RWMutex
 }
 
+// 所有的树共用的代数，保证不同的树的代数都不相同
+var artGeneration atomic.Uint64
+
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
@@ -21,16 +85,50 @@ func (art *AdaptiveRadixTree) Close() error {
 // NewArt 初始化索引
 func NewArt() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
+		gen:   artGeneration.Add(1),
+		arena: newKeyArena(),
+		lock:  new(sync.RWMutex),
+	}
+}
+
+// 生成和当前的树共享节点的快照，两棵树之后修改共享的节点时都会先复制
+// 快照只用来遍历，不会分配新的 key，不需要自己的内存池
+func (art *AdaptiveRadixTree) snapshot() *AdaptiveRadixTree {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	snap := &AdaptiveRadixTree{
+		root: art.root,
+		size: art.size,
+		gen:  artGeneration.Add(1),
 		lock: new(sync.RWMutex),
 	}
+	art.gen = artGeneration.Add(1)
+	return snap
+}
+
+// 返回可以修改的节点，节点属于其他的代数时复制一份，调用方负责替换掉原来的节点
+func (art *AdaptiveRadixTree) ownNode(n *artNode) *artNode {
+	if n.gen == art.gen {
+		return n
+	}
+	node := *n
+	node.gen = art.gen
+	if n.keys != nil {
+		node.keys = make([]byte, len(n.keys), cap(n.keys))
+		copy(node.keys, n.keys)
+	}
+	if n.children != nil {
+		node.children = make([]artChild, len(n.children), cap(n.children))
+		copy(node.children, n.children)
+	}
+	return &node
 }
 
 // Put 向索引中存储 key 对应的数据位置的信息
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) bool {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	art.tree.Insert(key, pos)
+	art.insert(&art.root, key, packPos(pos), 0)
 	return true
 }
 
@@ -38,112 +136,713 @@ func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) bool {
 func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	value, found := art.tree.Search(key)
-	if !found {
-		return nil
+	if leaf := art.get(key); leaf != nil {
+		return leaf.pos.unpack()
 	}
-	return value.(*data.LogRecordPos)
+	return nil
+}
+
+// 查找 key 对应的叶子节点，调用时需要持有锁
+func (art *AdaptiveRadixTree) get(key []byte) *artLeaf {
+	child := art.root
+	depth := 0
+	for child != nil {
+		switch c := child.(type) {
+		case *artLeaf:
+			if c.key == string(key) {
+				return c
+			}
+			return nil
+		case *artNode:
+			if !bytes.HasPrefix(key[depth:], c.prefix) {
+				return nil
+			}
+			depth += len(c.prefix)
+			if depth == len(key) {
+				return c.leaf
+			}
+			slot := c.findChild(key[depth])
+			if slot == nil {
+				return nil
+			}
+			child = *slot
+			depth++
+		}
+	}
+	return nil
 }
 
 // Delete 根据 key 值删除对应的索引
 func (art *AdaptiveRadixTree) Delete(key []byte) bool {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	_, deleted := art.tree.Delete(key)
-	return deleted
+	return art.remove(key)
+}
+
+// PutBatch 批量存储 key 对应的数据位置的信息，只加一次锁
+func (art *AdaptiveRadixTree) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	for i, key := range keys {
+		art.insert(&art.root, key, packPos(positions[i]), 0)
+	}
+	return true
+}
+
+// DeleteBatch 批量删除 key 对应的索引，只加一次锁
+func (art *AdaptiveRadixTree) DeleteBatch(keys [][]byte) bool {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	for _, key := range keys {
+		art.remove(key)
+	}
+	return true
 }
 
 // Size 返回大小
 func (art *AdaptiveRadixTree) Size() int {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	size := art.tree.Size()
-	return size
+	return art.size
 }
 
-// Iterator 返回迭代器
-func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newArtIterator(art.tree, reverse)
+// 把 key 插入到 ref 指向的子树中，depth 是子树之前已经匹配的长度，调用时需要持有写锁
+func (art *AdaptiveRadixTree) insert(ref *artChild, key []byte, pos packedPos, depth int) {
+	switch c := (*ref).(type) {
+	case nil:
+		*ref = art.newLeaf(key, pos)
+	case *artLeaf:
+		if c.key == string(key) {
+			*ref = &artLeaf{key: c.key, pos: pos}
+			return
+		}
+		// 两个 key 从公共前缀之后分开
+		leaf := art.newLeaf(key, pos)
+		leafKey := stringToBytes(leaf.key)
+		n := commonPrefixLen(stringToBytes(c.key)[depth:], leafKey[depth:])
+		node := &artNode{kind: artNode4, prefix: leafKey[depth : depth+n], gen: art.gen}
+		node.addLeaf(c, depth+n)
+		node.addLeaf(leaf, depth+n)
+		*ref = node
+	case *artNode:
+		// 插入一定会修改路径上的节点
+		c = art.ownNode(c)
+		*ref = c
+		n := commonPrefixLen(c.prefix, key[depth:])
+		if n < len(c.prefix) {
+			// 前缀不一致，在不一致的位置拆分出一个新的节点
+			leaf := art.newLeaf(key, pos)
+			node := &artNode{kind: artNode4, prefix: c.prefix[:n], gen: art.gen}
+			edge := c.prefix[n]
+			c.prefix = c.prefix[n+1:]
+			node.addChild(edge, c)
+			node.addLeaf(leaf, depth+n)
+			*ref = node
+			return
+		}
+		depth += n
+		if depth == len(key) {
+			if c.leaf != nil {
+				c.leaf = &artLeaf{key: c.leaf.key, pos: pos}
+				return
+			}
+			c.leaf = art.newLeaf(key, pos)
+			return
+		}
+		if slot := c.findChild(key[depth]); slot != nil {
+			art.insert(slot, key, pos, depth+1)
+			return
+		}
+		c.addChild(key[depth], art.newLeaf(key, pos))
+	}
 }
 
-// ArtIterator 索引迭代器
-type ArtIterator struct {
-	currIndex int
-	reverse   bool
-	values    []*Item
+// 新增一个叶子节点，key 拷贝到内存池中，调用方之后可能会修改
+func (art *AdaptiveRadixTree) newLeaf(key []byte, pos packedPos) *artLeaf {
+	art.size++
+	return &artLeaf{key: art.arena.alloc(key), pos: pos}
+}
+
+// 删除 key，调用时需要持有写锁
+// 先确认 key 存在，避免不存在的 key 也复制路径上共享的节点
+func (art *AdaptiveRadixTree) remove(key []byte) bool {
+	leaf := art.get(key)
+	if leaf == nil || !art.delete(&art.root, key, 0) {
+		return false
+	}
+	art.size--
+	art.arena.free(leaf.key)
+	if art.arena.needCompact() {
+		art.compact()
+	}
+	return true
+}
+
+// 重建整棵树，所有的 key 拷贝到新的内存池中，原来的内存块在没有引用之后被回收
+// 快照仍然引用原来的节点，不受影响
+func (art *AdaptiveRadixTree) compact() {
+	root := art.root
+	art.root, art.size, art.arena = nil, 0, newKeyArena()
+	walkArtLeaves(root, func(leaf *artLeaf) {
+		art.insert(&art.root, stringToBytes(leaf.key), leaf.pos, 0)
+	})
+}
+
+// 依次访问子树中所有的叶子节点
+func walkArtLeaves(child artChild, fn func(leaf *artLeaf)) {
+	switch c := child.(type) {
+	case *artLeaf:
+		fn(c)
+	case *artNode:
+		if c.leaf != nil {
+			fn(c.leaf)
+		}
+		for e, next := c.nextChild(0); next != nil; e, next = c.nextChild(e + 1) {
+			walkArtLeaves(next, fn)
+		}
+	}
 }
 
-func newArtIterator(tree goart.Tree, reverse bool) *ArtIterator {
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
+// 从 ref 指向的子树中删除 key，删除之后合并或者缩小节点
+func (art *AdaptiveRadixTree) delete(ref *artChild, key []byte, depth int) bool {
+	switch c := (*ref).(type) {
+	case *artLeaf:
+		if c.key != string(key) {
+			return false
+		}
+		*ref = nil
+	case *artNode:
+		if !bytes.HasPrefix(key[depth:], c.prefix) {
+			return false
+		}
+		depth += len(c.prefix)
+		c = art.ownNode(c)
+		*ref = c
+		if depth == len(key) {
+			if c.leaf == nil {
+				return false
+			}
+			c.leaf = nil
+		} else {
+			edge := key[depth]
+			slot := c.findChild(edge)
+			if slot == nil || !art.delete(slot, key, depth+1) {
+				return false
+			}
+			if *slot == nil {
+				c.removeChild(edge)
+			}
+		}
+		art.shrink(ref, c)
+	default:
+		return false
+	}
+	return true
+}
+
+// 把叶子节点放到这个节点中，depth 是这个节点之后的位置
+func (n *artNode) addLeaf(leaf *artLeaf, depth int) {
+	if len(leaf.key) == depth {
+		n.leaf = leaf
+		return
 	}
-	values := make([]*Item, tree.Size())
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
+	n.addChild(leaf.key[depth], leaf)
+}
+
+// 查找边对应的子节点，返回子节点所在的位置，可以直接替换
+func (n *artNode) findChild(edge byte) *artChild {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == edge {
+				return &n.children[i]
+			}
+		}
+	case artNode48:
+		if idx := n.keys[edge]; idx != 0 {
+			return &n.children[idx-1]
+		}
+	case artNode256:
+		if n.children[edge] != nil {
+			return &n.children[edge]
+		}
+	}
+	return nil
+}
+
+// 添加一个子节点，节点满了之后切换为更大的类型
+func (n *artNode) addChild(edge byte, child artChild) {
+	switch n.kind {
+	case artNode4, artNode16:
+		if n.num == n.capacity() {
+			n.grow()
+			n.addChild(edge, child)
+			return
+		}
+		if n.keys == nil {
+			n.keys = make([]byte, 0, n.capacity())
+			n.children = make([]artChild, 0, n.capacity())
+		}
+		i := 0
+		for i < n.num && n.keys[i] < edge {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		n.children = append(n.children, nil)
+		copy(n.keys[i+1:], n.keys[i:])
+		copy(n.children[i+1:], n.children[i:])
+		n.keys[i] = edge
+		n.children[i] = child
+	case artNode48:
+		if n.num == 48 {
+			n.grow()
+			n.addChild(edge, child)
+			return
+		}
+		n.children = append(n.children, child)
+		n.keys[edge] = byte(len(n.children))
+	case artNode256:
+		n.children[edge] = child
+	}
+	n.num++
+}
+
+// 删除一个子节点
+func (n *artNode) removeChild(edge byte) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == edge {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				copy(n.children[i:], n.children[i+1:])
+				n.children[len(n.children)-1] = nil
+				n.children = n.children[:len(n.children)-1]
+				break
+			}
+		}
+	case artNode48:
+		// 把最后一个子节点移动到空出来的位置，保持 children 是连续的
+		idx := n.keys[edge]
+		n.keys[edge] = 0
+		last := byte(len(n.children))
+		if idx != last {
+			n.children[idx-1] = n.children[last-1]
+			for e, i := range n.keys {
+				if i == last {
+					n.keys[e] = idx
+					break
+				}
+			}
 		}
-		values[idx] = item
-		if reverse {
-			idx--
+		n.children[last-1] = nil
+		n.children = n.children[:last-1]
+	case artNode256:
+		n.children[edge] = nil
+	}
+	n.num--
+}
+
+// 删除之后整理节点，ref 指向这个节点
+// 没有子节点时替换为自己的叶子节点，只有一个子节点时和子节点合并，子节点太少时切换为更小的类型
+func (art *AdaptiveRadixTree) shrink(ref *artChild, n *artNode) {
+	if n.num == 0 {
+		if n.leaf != nil {
+			*ref = n.leaf
 		} else {
-			idx++
+			*ref = nil
+		}
+		return
+	}
+	if n.num == 1 && n.leaf == nil {
+		edge, child := n.nextChild(0)
+		if node, ok := child.(*artNode); ok {
+			node = art.ownNode(node)
+			child = node
+			prefix := make([]byte, 0, len(n.prefix)+1+len(node.prefix))
+			prefix = append(prefix, n.prefix...)
+			prefix = append(prefix, byte(edge))
+			node.prefix = append(prefix, node.prefix...)
+		}
+		*ref = child
+		return
+	}
+	switch {
+	case n.kind == artNode16 && n.num <= 3,
+		n.kind == artNode48 && n.num <= 12,
+		n.kind == artNode256 && n.num <= 37:
+		n.resize(n.kind - 1)
+	}
+}
+
+// 切换为更大的类型
+func (n *artNode) grow() {
+	n.resize(n.kind + 1)
+}
+
+// 按照边的顺序把子节点重新放到新类型的节点中
+func (n *artNode) resize(kind artKind) {
+	var edges []byte
+	var children []artChild
+	for e, child := n.nextChild(0); child != nil; e, child = n.nextChild(e + 1) {
+		edges = append(edges, byte(e))
+		children = append(children, child)
+	}
+	n.kind = kind
+	n.num = 0
+	switch kind {
+	case artNode4, artNode16:
+		n.keys = make([]byte, 0, n.capacity())
+		n.children = make([]artChild, 0, n.capacity())
+	case artNode48:
+		n.keys = make([]byte, 256)
+		n.children = make([]artChild, 0, 48)
+	case artNode256:
+		n.keys = nil
+		n.children = make([]artChild, 256)
+	}
+	for i, edge := range edges {
+		n.addChild(edge, children[i])
+	}
+}
+
+func (n *artNode) capacity() int {
+	if n.kind == artNode4 {
+		return 4
+	}
+	return 16
+}
+
+// 找到边大于等于 edge 的第一个子节点，没有时返回 -1
+func (n *artNode) nextChild(edge int) (int, artChild) {
+	if edge > 255 {
+		return -1, nil
+	}
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if int(k) >= edge {
+				return int(k), n.children[i]
+			}
 		}
-		return true
+	case artNode48:
+		for e := edge; e < 256; e++ {
+			if idx := n.keys[e]; idx != 0 {
+				return e, n.children[idx-1]
+			}
+		}
+	case artNode256:
+		for e := edge; e < 256; e++ {
+			if n.children[e] != nil {
+				return e, n.children[e]
+			}
+		}
+	}
+	return -1, nil
+}
+
+// 找到边小于等于 edge 的最后一个子节点，没有时返回 -1
+func (n *artNode) prevChild(edge int) (int, artChild) {
+	if edge < 0 {
+		return -1, nil
+	}
+	if edge > 255 {
+		edge = 255
 	}
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := len(n.keys) - 1; i >= 0; i-- {
+			if int(n.keys[i]) <= edge {
+				return int(n.keys[i]), n.children[i]
+			}
+		}
+	case artNode48:
+		for e := edge; e >= 0; e-- {
+			if idx := n.keys[e]; idx != 0 {
+				return e, n.children[idx-1]
+			}
+		}
+	case artNode256:
+		for e := edge; e >= 0; e-- {
+			if n.children[e] != nil {
+				return e, n.children[e]
+			}
+		}
+	}
+	return -1, nil
+}
 
-	tree.ForEach(saveValues)
-	return &ArtIterator{
-		values:    values,
-		reverse:   reverse,
-		currIndex: 0,
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
 	}
+	return n
+}
+
+// Iterator 返回迭代器，迭代器遍历的是创建时索引的快照
+// 快照和索引共享节点，不需要拷贝数据，之后的写入只会复制被修改的路径
+func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+	arti := &ArtIterator{art: art.snapshot(), reverse: reverse}
+	arti.Rewind()
+	return arti
+}
+
+// ArtIterator 索引迭代器
+// 在快照上保存从根节点到当前叶子节点的路径，快照不会被修改，遍历时不需要加锁
+type ArtIterator struct {
+	art     *AdaptiveRadixTree
+	reverse bool
+
+	// 从根节点到当前位置经过的内部节点
+	stack []artFrame
+
+	// 当前的数据
+	key []byte
+	pos *data.LogRecordPos
+}
+
+// 路径上的一个内部节点和当前所在的边，边为 -1 表示在节点自己的叶子节点上
+type artFrame struct {
+	node *artNode
+	edge int
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (arti *ArtIterator) Rewind() {
-	arti.currIndex = 0
+	arti.reset()
+	if arti.art.root == nil {
+		return
+	}
+	if arti.reverse {
+		arti.descendLast(arti.art.root)
+	} else {
+		arti.descendFirst(arti.art.root)
+	}
 }
 
 // Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
 func (arti *ArtIterator) Seek(key []byte) {
-	if arti.reverse {
-		// 二分查找
-		sort.Search(len(arti.values), func(i int) bool {
-			return bytes.Compare(arti.values[i].key, key) <= 0
-		})
-	} else {
-		// 相反
-		sort.Search(len(arti.values), func(i int) bool {
-			return bytes.Compare(arti.values[i].key, key) >= 0
-		})
-	}
+	arti.seek(key)
 }
 
 // Next 跳转到下一个 key
 func (arti *ArtIterator) Next() {
-	arti.currIndex++
+	if arti.key == nil {
+		return
+	}
+	if arti.reverse {
+		arti.prev()
+	} else {
+		arti.next()
+	}
 }
 
 // Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
 func (arti *ArtIterator) Valid() bool {
-	return arti.currIndex < len(arti.values)
+	return arti.key != nil
 }
 
 // Key 当前遍历位置的 Key 数据
 func (arti *ArtIterator) Key() []byte {
-	return arti.values[arti.currIndex].key
+	return arti.key
 }
 
 // Value 当前遍历位置的 Value 数据
 func (arti *ArtIterator) Value() *data.LogRecordPos {
-	return arti.values[arti.currIndex].pos
+	return arti.pos
 }
 
 // Close 关闭迭代器，释放相应资源
 func (arti *ArtIterator) Close() {
-	arti.values = nil
+	arti.stack = nil
+	arti.key = nil
+	arti.pos = nil
+}
+
+func (arti *ArtIterator) reset() {
+	arti.stack = arti.stack[:0]
+	arti.key = nil
+	arti.pos = nil
+}
+
+func (arti *ArtIterator) setLeaf(leaf *artLeaf) {
+	arti.key = stringToBytes(leaf.key)
+	if arti.key == nil {
+		// 空的 key 也要是非 nil 的切片，nil 表示遍历结束
+		arti.key = []byte{}
+	}
+	arti.pos = leaf.pos.unpack()
+}
+
+// 沿着 key 向下查找，正向遍历时定位到第一个大于等于 key 的数据，反向遍历时定位到最后一个小于等于 key 的数据
+// 子树中的数据都在 key 的另一侧时，从路径上的上一个节点继续移动
+func (arti *ArtIterator) seek(key []byte) {
+	arti.reset()
+	child := arti.art.root
+	depth := 0
+	for child != nil {
+		switch c := child.(type) {
+		case *artLeaf:
+			cmp := bytes.Compare(stringToBytes(c.key), key)
+			if cmp == 0 || (cmp > 0) != arti.reverse {
+				arti.setLeaf(c)
+			} else {
+				arti.move()
+			}
+			return
+		case *artNode:
+			rest := key[depth:]
+			n := commonPrefixLen(c.prefix, rest)
+			if n < len(c.prefix) {
+				// 前缀不一致，整个子树都大于或者都小于 key
+				greater := n == len(rest) || c.prefix[n] > rest[n]
+				if greater != arti.reverse {
+					arti.descend(c)
+				} else {
+					arti.move()
+				}
+				return
+			}
+			depth += n
+			if depth == len(key) {
+				// 节点的叶子节点等于 key，所有的子节点都大于 key
+				if !arti.reverse {
+					arti.descendFirst(c)
+				} else if c.leaf != nil {
+					arti.stack = append(arti.stack, artFrame{node: c, edge: -1})
+					arti.setLeaf(c.leaf)
+				} else {
+					arti.prev()
+				}
+				return
+			}
+
+			edge := int(key[depth])
+			var e int
+			var next artChild
+			if arti.reverse {
+				e, next = c.prevChild(edge)
+				if next == nil {
+					// 只剩下比 key 短的叶子节点
+					if c.leaf != nil {
+						arti.stack = append(arti.stack, artFrame{node: c, edge: -1})
+						arti.setLeaf(c.leaf)
+					} else {
+						arti.prev()
+					}
+					return
+				}
+			} else {
+				e, next = c.nextChild(edge)
+				if next == nil {
+					arti.next()
+					return
+				}
+			}
+			arti.stack = append(arti.stack, artFrame{node: c, edge: e})
+			if e != edge {
+				arti.descend(next)
+				return
+			}
+			child = next
+			depth++
+		}
+	}
+}
+
+// 按照遍历的方向定位到子树中的第一个数据
+func (arti *ArtIterator) descend(child artChild) {
+	if arti.reverse {
+		arti.descendLast(child)
+	} else {
+		arti.descendFirst(child)
+	}
+}
+
+// 按照遍历的方向移动到下一个数据
+func (arti *ArtIterator) move() {
+	if arti.reverse {
+		arti.prev()
+	} else {
+		arti.next()
+	}
+}
+
+// 定位到子树中最小的 key
+func (arti *ArtIterator) descendFirst(child artChild) {
+	for {
+		switch c := child.(type) {
+		case *artLeaf:
+			arti.setLeaf(c)
+			return
+		case *artNode:
+			if c.leaf != nil {
+				arti.stack = append(arti.stack, artFrame{node: c, edge: -1})
+				arti.setLeaf(c.leaf)
+				return
+			}
+			e, next := c.nextChild(0)
+			arti.stack = append(arti.stack, artFrame{node: c, edge: e})
+			child = next
+		}
+	}
+}
+
+// 定位到子树中最大的 key
+func (arti *ArtIterator) descendLast(child artChild) {
+	for {
+		switch c := child.(type) {
+		case *artLeaf:
+			arti.setLeaf(c)
+			return
+		case *artNode:
+			e, next := c.prevChild(255)
+			if next == nil {
+				arti.stack = append(arti.stack, artFrame{node: c, edge: -1})
+				arti.setLeaf(c.leaf)
+				return
+			}
+			arti.stack = append(arti.stack, artFrame{node: c, edge: e})
+			child = next
+		}
+	}
+}
+
+// 移动到下一个更大的 key，从路径的末尾向上找到还有更大的子节点的节点
+func (arti *ArtIterator) next() {
+	for len(arti.stack) > 0 {
+		top := &arti.stack[len(arti.stack)-1]
+		e, child := top.node.nextChild(top.edge + 1)
+		if child != nil {
+			top.edge = e
+			arti.descendFirst(child)
+			return
+		}
+		arti.stack = arti.stack[:len(arti.stack)-1]
+	}
+	arti.key = nil
+	arti.pos = nil
+}
+
+// 移动到下一个更小的 key，节点自己的叶子节点比所有的子节点都小
+func (arti *ArtIterator) prev() {
+	for len(arti.stack) > 0 {
+		top := &arti.stack[len(arti.stack)-1]
+		if top.edge >= 0 {
+			e, child := top.node.prevChild(top.edge - 1)
+			if child != nil {
+				top.edge = e
+				arti.descendLast(child)
+				return
+			}
+			if top.node.leaf != nil {
+				top.edge = -1
+				arti.setLeaf(top.node.leaf)
+				return
+			}
+		}
+		arti.stack = arti.stack[:len(arti.stack)-1]
+	}
+	arti.key = nil
+	arti.pos = nil
 }
@@ -2,7 +2,10 @@ package index
 
 import (
 	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
 	"testing"
 )
 
@@ -68,3 +71,245 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	}
 
 }
+
+func TestAdaptiveRadixTree_PutBatch(t *testing.T) {
+	art := NewArt()
+	ok := art.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}, []*data.LogRecordPos{
+		{Fid: 1, Offset: 1}, {Fid: 1, Offset: 2}, {Fid: 1, Offset: 3},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, 3, art.Size())
+	assert.Equal(t, int64(2), art.Get([]byte("b")).Offset)
+
+	ok = art.DeleteBatch([][]byte{[]byte("a"), []byte("unknown")})
+	assert.True(t, ok)
+	assert.Nil(t, art.Get([]byte("a")))
+	assert.Equal(t, 2, art.Size())
+}
+
+func TestAdaptiveRadixTree_IteratorSeek(t *testing.T) {
+	art := NewArt()
+	for _, key := range []string{"aa", "bb", "cc", "dd"} {
+		art.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	iterator := art.Iterator(false)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("bb"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+
+	// 反向遍历时找到第一个小于等于的 key
+	iterator = art.Iterator(true)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("aa"), iterator.Key())
+	iterator.Seek([]byte("cc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("a"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+}
+
+func TestAdaptiveRadixTree_IteratorModify(t *testing.T) {
+	art := NewArt()
+	for i := 0; i < 100; i++ {
+		art.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 迭代器遍历的是创建时的快照，遍历期间的修改不会被看到
+	iterator := art.Iterator(false)
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+		assert.Equal(t, uint32(1), iterator.Value().Fid)
+		if len(keys) == 10 {
+			art.Delete(utils.GetTestKey(50))
+			art.Put(utils.GetTestKey(60), &data.LogRecordPos{Fid: 2, Offset: 1})
+			art.Put([]byte("zzz"), &data.LogRecordPos{Fid: 2, Offset: 1})
+		}
+	}
+	iterator.Close()
+	assert.Equal(t, 100, len(keys))
+	for i := range keys {
+		assert.Equal(t, utils.GetTestKey(i), keys[i])
+	}
+
+	// 修改只影响原来的索引
+	assert.Nil(t, art.Get(utils.GetTestKey(50)))
+	assert.Equal(t, uint32(2), art.Get(utils.GetTestKey(60)).Fid)
+	assert.Equal(t, 100, art.Size())
+}
+
+// 和排好序的 key 比较，覆盖节点的扩大、缩小和合并，以及一个 key 是另一个 key 的前缀的情况
+func TestAdaptiveRadixTree_Random(t *testing.T) {
+	art := NewArt()
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[string]int64)
+	randomKey := func() []byte {
+		key := make([]byte, rnd.Intn(4))
+		for i := range key {
+			// 只用少量的字符，更容易出现公共前缀；偶尔使用所有的字符，让节点扩大到 256
+			if rnd.Intn(4) == 0 {
+				key[i] = byte(rnd.Intn(256))
+			} else {
+				key[i] = byte('a' + rnd.Intn(3))
+			}
+		}
+		return key
+	}
+	check := func() {
+		keys := make([]string, 0, len(expected))
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		assert.Equal(t, len(keys), art.Size())
+
+		for _, reverse := range []bool{false, true} {
+			var got []string
+			iterator := art.Iterator(reverse)
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				got = append(got, string(iterator.Key()))
+				assert.Equal(t, expected[string(iterator.Key())], iterator.Value().Offset)
+			}
+			want := append([]string(nil), keys...)
+			if reverse {
+				for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+					want[i], want[j] = want[j], want[i]
+				}
+			}
+			if len(want) == 0 {
+				want = nil
+			}
+			assert.Equal(t, want, got)
+
+			// Seek 定位到第一个大于等于（反向时小于等于）的 key
+			for i := 0; i < 20; i++ {
+				target := randomKey()
+				iterator.Seek(target)
+				idx := sort.SearchStrings(keys, string(target))
+				if reverse {
+					if idx == len(keys) || keys[idx] != string(target) {
+						idx--
+					}
+					if idx < 0 {
+						assert.False(t, iterator.Valid())
+						continue
+					}
+				} else if idx == len(keys) {
+					assert.False(t, iterator.Valid())
+					continue
+				}
+				assert.Equal(t, keys[idx], string(iterator.Key()))
+			}
+			iterator.Close()
+		}
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			_, ok := expected[string(key)]
+			assert.Equal(t, ok, art.Delete(key))
+			delete(expected, string(key))
+		} else {
+			art.Put(key, &data.LogRecordPos{Offset: int64(i)})
+			expected[string(key)] = int64(i)
+		}
+		assert.Equal(t, len(expected), art.Size())
+		if i%100 == 0 {
+			check()
+		}
+	}
+	check()
+	for key := range expected {
+		assert.True(t, art.Delete([]byte(key)))
+	}
+	assert.Equal(t, 0, art.Size())
+	assert.Nil(t, art.root)
+}
+
+func TestAdaptiveRadixTree_IteratorModifyReverse(t *testing.T) {
+	art := NewArt()
+	for i := 0; i < 100; i++ {
+		art.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 反向遍历时删除当前的 key，快照中仍然是原来的数据
+	iterator := art.Iterator(true)
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+		if len(keys) == 10 {
+			art.Delete(iterator.Key())
+			art.Delete(utils.GetTestKey(50))
+			art.Put([]byte("0"), &data.LogRecordPos{Fid: 2, Offset: 1})
+		}
+	}
+	iterator.Close()
+	assert.Equal(t, 100, len(keys))
+	for i := range keys {
+		assert.Equal(t, utils.GetTestKey(99-i), keys[i])
+	}
+	assert.Equal(t, 99, art.Size())
+}
+
+// 多个快照和原来的树交替修改，每个快照都保持创建时的数据
+func TestAdaptiveRadixTree_Snapshot(t *testing.T) {
+	art := NewArt()
+	rnd := rand.New(rand.NewSource(2))
+	expected := make(map[string]int64)
+	type snapshot struct {
+		iterator Iterator
+		want     map[string]int64
+	}
+	var snapshots []snapshot
+	for i := 0; i < 5000; i++ {
+		key := []byte{byte('a' + rnd.Intn(4)), byte('a' + rnd.Intn(4)), byte(rnd.Intn(256))}
+		key = key[:1+rnd.Intn(3)]
+		if rnd.Intn(3) == 0 {
+			art.Delete(key)
+			delete(expected, string(key))
+		} else {
+			art.Put(key, &data.LogRecordPos{Offset: int64(i)})
+			expected[string(key)] = int64(i)
+		}
+		if i%500 == 0 {
+			want := make(map[string]int64, len(expected))
+			for k, v := range expected {
+				want[k] = v
+			}
+			snapshots = append(snapshots, snapshot{iterator: art.Iterator(i%1000 == 0), want: want})
+		}
+	}
+	for _, snap := range snapshots {
+		got := make(map[string]int64)
+		for snap.iterator.Rewind(); snap.iterator.Valid(); snap.iterator.Next() {
+			got[string(snap.iterator.Key())] = snap.iterator.Value().Offset
+		}
+		assert.Equal(t, snap.want, got)
+		snap.iterator.Close()
+	}
+	assert.Equal(t, len(expected), art.Size())
+	for k, v := range expected {
+		assert.Equal(t, v, art.Get([]byte(k)).Offset)
+	}
+}
+
+func TestAdaptiveRadixTree_KeyCopied(t *testing.T) {
+	art := NewArt()
+	key := []byte("key")
+	art.Put(key, &data.LogRecordPos{Fid: 1})
+	key[0] = 'x'
+	assert.NotNil(t, art.Get([]byte("key")))
+	assert.Nil(t, art.Get([]byte("xey")))
+}
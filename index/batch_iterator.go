@@ -0,0 +1,81 @@
+package index
+
+import "github.com/lustresix/lxdb/data"
+
+// 迭代器每次从索引中读取的数据数量
+const iteratorBatchSize = 256
+
+// 从 start 开始按迭代方向读取最多 limit 条数据追加到 items 中，start 为空表示从头开始
+// 反向遍历时从第一个小于等于 start 的 key 开始，inclusive 表示是否包含 start 本身
+type batchLoader func(items []*Item, start []byte, inclusive bool, limit int) []*Item
+
+// batchIterator 按批次读取数据的迭代器，不需要一次把所有数据拷贝出来
+// 当前批次遍历完之后从最后一个 key 之后继续读取下一批
+type batchIterator struct {
+	load batchLoader
+	// 当前批次的数据
+	items []*Item
+	// 当前批次中的位置
+	idx int
+	// 当前批次之后是否还有数据
+	more bool
+}
+
+func newBatchIterator(load batchLoader) *batchIterator {
+	bi := &batchIterator{load: load}
+	bi.Rewind()
+	return bi
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (bi *batchIterator) Rewind() {
+	bi.fill(nil, true)
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (bi *batchIterator) Seek(key []byte) {
+	bi.fill(key, true)
+}
+
+// Next 跳转到下一个 key
+func (bi *batchIterator) Next() {
+	bi.idx++
+	if bi.idx == len(bi.items) && bi.more {
+		bi.fill(bi.items[len(bi.items)-1].key, false)
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (bi *batchIterator) Valid() bool {
+	return bi.idx < len(bi.items)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (bi *batchIterator) Key() []byte {
+	return bi.items[bi.idx].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (bi *batchIterator) Value() *data.LogRecordPos {
+	return bi.items[bi.idx].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (bi *batchIterator) Close() {
+	bi.items = nil
+	bi.idx = 0
+	bi.more = false
+}
+
+// 多读取一条数据用来判断之后是否还有数据
+func (bi *batchIterator) fill(start []byte, inclusive bool) {
+	for i := range bi.items {
+		bi.items[i] = nil
+	}
+	bi.items = bi.load(bi.items[:0], start, inclusive, iteratorBatchSize+1)
+	bi.idx = 0
+	bi.more = len(bi.items) > iteratorBatchSize
+	if bi.more {
+		bi.items = bi.items[:iteratorBatchSize]
+	}
+}
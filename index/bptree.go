@@ -1,15 +1,25 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/lustresix/lxdb/data"
 	"go.etcd.io/bbolt"
 	"path/filepath"
+	"time"
 )
 
 const bptreeIndexFileName = "bptree-index"
 
 var indexBucketName = []byte("bitcask-index")
 
+// 元数据，记录已经应用到索引中的日志位置和事务序列号，用于崩溃之后恢复
+var (
+	metaBucketName = []byte("bitcask-meta")
+	appliedKey     = []byte("applied")
+	seqNoKey       = []byte("seq-no")
+)
+
 // B+ 树索引保存到磁盘中
 
 type BPTree struct {
@@ -21,15 +31,20 @@ func (bpt *BPTree) Close() error {
 }
 
 func NewBPTree(dir string, syncWrites bool) *BPTree {
-	options := bbolt.DefaultOptions
-	options.NoSync = syncWrites
-	open, err := bbolt.Open(filepath.Join(dir, bptreeIndexFileName), 0644, options)
+	// 复制一份默认配置，不修改 bbolt 的全局配置
+	options := *bbolt.DefaultOptions
+	// 需要持久化时每次提交都刷盘，否则交给操作系统
+	options.NoSync = !syncWrites
+	open, err := bbolt.Open(filepath.Join(dir, bptreeIndexFileName), 0644, &options)
 	if err != nil {
 		panic("failed to open bPlusTree")
 	}
 
 	if err := open.Update(func(tx *bbolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
 		panic("failed to creat bucket in bptree")
@@ -76,10 +91,117 @@ func (bpt *BPTree) Delete(key []byte) bool {
 	return err == nil
 }
 
+// PutBatch 在一个事务中批量存储 key 对应的数据位置的信息
+func (bpt *BPTree) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		return updateBucket(tx, keys, positions, nil)
+	})
+	return err == nil
+}
+
+// DeleteBatch 在一个事务中批量删除 key 对应的索引
+func (bpt *BPTree) DeleteBatch(keys [][]byte) bool {
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		return updateBucket(tx, nil, nil, keys)
+	})
+	return err == nil
+}
+
+// Apply 在一个事务中更新索引，同时记录已经应用到索引中的日志位置 applied 和事务序列号
+// 打开数据库时从 applied 开始重放日志，索引和数据文件不会因为崩溃而不一致
+func (bpt *BPTree) Apply(putKeys [][]byte, positions []*data.LogRecordPos, deleteKeys [][]byte,
+	applied *data.LogRecordPos, seqNo uint64) bool {
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		if err := updateBucket(tx, putKeys, positions, deleteKeys); err != nil {
+			return err
+		}
+		meta := tx.Bucket(metaBucketName)
+		if err := meta.Put(appliedKey, data.EncodeLogRecordPos(applied)); err != nil {
+			return err
+		}
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, seqNo)
+		return meta.Put(seqNoKey, buf[:n])
+	})
+	return err == nil
+}
+
+// Applied 返回已经应用到索引中的日志位置和事务序列号，没有记录过时位置为 nil
+func (bpt *BPTree) Applied() (*data.LogRecordPos, uint64) {
+	var applied *data.LogRecordPos
+	var seqNo uint64
+	_ = bpt.tree.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucketName)
+		if value := meta.Get(appliedKey); len(value) > 0 {
+			applied = data.DecodeLogRecordPos(value)
+		}
+		if value := meta.Get(seqNoKey); len(value) > 0 {
+			seqNo, _ = binary.Uvarint(value)
+		}
+		return nil
+	})
+	return applied, seqNo
+}
+
+// ApplyMerge 在一个事务中把指向 merge 之前的数据文件（id 小于 fid）的索引替换为 hint 文件中记录的新位置
+// merge 之后被覆盖或删除的 key 已经不指向这些文件了，不会被替换
+// 已经应用的日志位置如果在这些文件中，改为从 fid 文件的开头重放
+func (bpt *BPTree) ApplyMerge(fid uint32, keys [][]byte, positions []*data.LogRecordPos) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for i, key := range keys {
+			value := bucket.Get(key)
+			if len(value) == 0 || data.DecodeLogRecordPos(value).Fid >= fid {
+				continue
+			}
+			if err := bucket.Put(key, data.EncodeLogRecordPos(positions[i])); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(metaBucketName)
+		value := meta.Get(appliedKey)
+		if len(value) == 0 || data.DecodeLogRecordPos(value).Fid >= fid {
+			return nil
+		}
+		return meta.Put(appliedKey, data.EncodeLogRecordPos(&data.LogRecordPos{Fid: fid}))
+	})
+}
+
+// Reset 清空索引和元数据，用于从数据文件中重建索引
+func (bpt *BPTree) Reset() error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{indexBucketName, metaBucketName} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func updateBucket(tx *bbolt.Tx, putKeys [][]byte, positions []*data.LogRecordPos, deleteKeys [][]byte) error {
+	bucket := tx.Bucket(indexBucketName)
+	for i, key := range putKeys {
+		if err := bucket.Put(key, data.EncodeLogRecordPos(positions[i])); err != nil {
+			return err
+		}
+	}
+	for _, key := range deleteKeys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Size 返回大小
 func (bpt *BPTree) Size() int {
 	var size int
-	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		size = bucket.Stats().KeyN
 		return nil
@@ -90,73 +212,106 @@ func (bpt *BPTree) Size() int {
 	return size
 }
 
-// Iterator 返回迭代器
-func (bpt *BPTree) Iterator(reverse bool) Iterator {
-	return nil
-}
-
-// bptIterator 索引迭代器
-type bptIterator struct {
-	tx        *bbolt.Tx
-	cursor    *bbolt.Cursor
-	reverse   bool
-	currKey   []byte
-	currValue []byte
+// ForEach 依次遍历索引中的所有数据，fn 返回 false 时停止遍历
+func (bpt *BPTree) ForEach(fn func(key []byte, pos *data.LogRecordPos) bool) error {
+	return bpt.tree.View(func(tx *bbolt.Tx) error {
+		return forEachBucket(tx, fn)
+	})
 }
 
-func newBPTreeIterator(tree *bbolt.DB, reverse bool) *bptIterator {
-	tx, err := tree.Begin(false)
+// ForEachBPTreeIndex 以只读的方式打开目录中的 B+ 树索引文件并遍历其中的数据，用于不打开数据库的离线检查
+// 索引文件被其他进程打开时会等待一段时间后返回错误
+func ForEachBPTreeIndex(dir string, fn func(key []byte, pos *data.LogRecordPos) bool) error {
+	options := *bbolt.DefaultOptions
+	options.ReadOnly = true
+	options.Timeout = time.Second
+	tree, err := bbolt.Open(BPTreeIndexFileName(dir), 0644, &options)
 	if err != nil {
-		panic("failed to begin a transaction")
-	}
-	bpti := &bptIterator{
-		tx:      tx,
-		cursor:  tx.Cursor(),
-		reverse: reverse,
+		return err
 	}
-	bpti.Rewind()
-	return bpti
+	defer func() {
+		_ = tree.Close()
+	}()
+	return tree.View(func(tx *bbolt.Tx) error {
+		return forEachBucket(tx, fn)
+	})
 }
 
-// Rewind 重新回到迭代器的起点，即第一个数据
-func (bpti *bptIterator) Rewind() {
-	if bpti.reverse {
-		bpti.currKey, bpti.currValue = bpti.cursor.Last()
-	} else {
-		bpti.currKey, bpti.currValue = bpti.cursor.First()
+func forEachBucket(tx *bbolt.Tx, fn func(key []byte, pos *data.LogRecordPos) bool) error {
+	bucket := tx.Bucket(indexBucketName)
+	if bucket == nil {
+		return nil
+	}
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if !fn(k, data.DecodeLogRecordPos(v)) {
+			break
+		}
 	}
+	return nil
 }
 
-// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
-func (bpti *bptIterator) Seek(key []byte) {
-	bpti.currKey, bpti.currValue = bpti.cursor.Seek(key)
+// BPTreeIndexFileName 获取目录中 B+ 树索引文件的路径
+func BPTreeIndexFileName(dir string) string {
+	return filepath.Join(dir, bptreeIndexFileName)
 }
 
-// Next 跳转到下一个 key
-func (bpti *bptIterator) Next() {
-	if bpti.reverse {
-		bpti.currKey, bpti.currValue = bpti.cursor.Prev()
-	} else {
-		bpti.currKey, bpti.currValue = bpti.cursor.Next()
-	}
+// Iterator 返回迭代器，不是快照，遍历期间其他批次的写入可能被看到
+func (bpt *BPTree) Iterator(reverse bool) Iterator {
+	return newBPTreeIterator(bpt.tree, reverse)
 }
 
-// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
-func (bpti *bptIterator) Valid() bool {
-	return len(bpti.currKey) != 0
+// 每次在一个短暂的只读事务中读取一批数据拷贝出来，不会长时间持有事务，遍历期间可以写入
+func newBPTreeIterator(tree *bbolt.DB, reverse bool) Iterator {
+	return newBatchIterator(func(items []*Item, start []byte, inclusive bool, limit int) []*Item {
+		_ = tree.View(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket(indexBucketName)
+			if bucket == nil {
+				return nil
+			}
+			cursor := bucket.Cursor()
+			k, v := positionCursor(cursor, reverse, start, inclusive)
+			for ; k != nil && len(items) < limit; k, v = stepCursor(cursor, reverse) {
+				// 事务结束之后 bbolt 返回的数据就失效了，需要拷贝
+				key := make([]byte, len(k))
+				copy(key, k)
+				items = append(items, &Item{key: key, pos: data.DecodeLogRecordPos(v)})
+			}
+			return nil
+		})
+		return items
+	})
 }
 
-// Key 当前遍历位置的 Key 数据
-func (bpti *bptIterator) Key() []byte {
-	return bpti.currKey
-}
+// 把游标移动到 start 的位置，反向遍历时是第一个小于等于 start 的 key
+func positionCursor(cursor *bbolt.Cursor, reverse bool, start []byte, inclusive bool) ([]byte, []byte) {
+	if start == nil {
+		if reverse {
+			return cursor.Last()
+		}
+		return cursor.First()
+	}
 
-// Value 当前遍历位置的 Value 数据
-func (bpti *bptIterator) Value() *data.LogRecordPos {
-	return data.DecodeLogRecordPos(bpti.currValue)
+	k, v := cursor.Seek(start)
+	if reverse {
+		// 没有大于等于 start 的 key，从最后一个开始
+		if k == nil {
+			return cursor.Last()
+		}
+		if cmp := bytes.Compare(k, start); cmp > 0 || (cmp == 0 && !inclusive) {
+			return cursor.Prev()
+		}
+		return k, v
+	}
+	if k != nil && !inclusive && bytes.Equal(k, start) {
+		return cursor.Next()
+	}
+	return k, v
 }
 
-// Close 关闭迭代器，释放相应资源
-func (bpti *bptIterator) Close() {
-	_ = bpti.tx.Rollback()
+func stepCursor(cursor *bbolt.Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return cursor.Prev()
+	}
+	return cursor.Next()
 }
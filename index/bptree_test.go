@@ -1,7 +1,9 @@
 package index
 
 import (
+	"bytes"
 	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
@@ -18,6 +20,17 @@ func TestNewBPTree(t *testing.T) {
 
 }
 
+func TestNewBPTree_SyncWrites(t *testing.T) {
+	for _, syncWrites := range []bool{true, false} {
+		path, _ := os.MkdirTemp("", "bptree-sync")
+		tree := NewBPTree(path, syncWrites)
+		// 需要持久化时 bbolt 每次提交都要刷盘
+		assert.Equal(t, !syncWrites, tree.tree.NoSync)
+		assert.Nil(t, tree.Close())
+		_ = os.RemoveAll(path)
+	}
+}
+
 func TestBPTree_Put(t *testing.T) {
 	path := filepath.Join(os.TempDir(), "bptree")
 	_ = os.MkdirAll(path, os.ModePerm)
@@ -68,3 +81,154 @@ func TestBPTree_Delete(t *testing.T) {
 	get = tree.Get([]byte("key1"))
 	assert.Nil(t, get)
 }
+
+func TestBPTree_Iterator(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-iter")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPTree(path, false)
+	defer func() {
+		_ = tree.Close()
+	}()
+
+	// 空的索引
+	iterator := tree.Iterator(false)
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+
+	// 数据量超过一个批次
+	for i := 0; i < 1000; i++ {
+		tree.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	iterator = tree.Iterator(false)
+	var count int
+	var prev []byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if prev != nil {
+			assert.True(t, bytes.Compare(prev, iterator.Key()) < 0)
+		}
+		prev = iterator.Key()
+		assert.Equal(t, tree.Get(iterator.Key()), iterator.Value())
+		// 遍历期间可以写入
+		if count == 10 {
+			tree.Put([]byte("zzz"), &data.LogRecordPos{Fid: 2, Offset: 1})
+		}
+		count++
+	}
+	assert.Equal(t, 1001, count)
+	iterator.Close()
+
+	iterator = tree.Iterator(true)
+	count = 0
+	prev = nil
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if prev != nil {
+			assert.True(t, bytes.Compare(prev, iterator.Key()) > 0)
+		}
+		prev = iterator.Key()
+		count++
+	}
+	assert.Equal(t, 1001, count)
+	iterator.Close()
+}
+
+func TestBPTree_IteratorSeek(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-seek")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPTree(path, false)
+	defer func() {
+		_ = tree.Close()
+	}()
+	for _, key := range []string{"aa", "bb", "cc", "dd"} {
+		tree.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	iterator := tree.Iterator(false)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Seek([]byte("bb"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+
+	// 反向遍历时找到第一个小于等于的 key
+	iterator = tree.Iterator(true)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("aa"), iterator.Key())
+	iterator.Seek([]byte("cc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("a"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+}
+
+func TestBPTree_PutBatch(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-batch")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPTree(path, false)
+	defer tree.Close()
+
+	var keys [][]byte
+	var positions []*data.LogRecordPos
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, utils.GetTestKey(i))
+		positions = append(positions, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.True(t, tree.PutBatch(keys, positions))
+	assert.Equal(t, 1000, tree.Size())
+	assert.Equal(t, int64(10), tree.Get(utils.GetTestKey(10)).Offset)
+
+	// 不存在的 key 会被忽略
+	assert.True(t, tree.DeleteBatch([][]byte{utils.GetTestKey(10), []byte("unknown")}))
+	assert.Nil(t, tree.Get(utils.GetTestKey(10)))
+	assert.Equal(t, 999, tree.Size())
+}
+
+func TestBPTree_Apply(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-apply")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPTree(path, false)
+
+	applied, seqNo := tree.Applied()
+	assert.Nil(t, applied)
+	assert.Equal(t, uint64(0), seqNo)
+
+	tree.Put([]byte("key1"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	ok := tree.Apply([][]byte{[]byte("key2")}, []*data.LogRecordPos{{Fid: 1, Offset: 24}},
+		[][]byte{[]byte("key1")}, &data.LogRecordPos{Fid: 1, Offset: 36}, 5)
+	assert.True(t, ok)
+	assert.Nil(t, tree.Get([]byte("key1")))
+	assert.NotNil(t, tree.Get([]byte("key2")))
+
+	// 重新打开之后仍然可以读到
+	_ = tree.Close()
+	tree = NewBPTree(path, false)
+	applied, seqNo = tree.Applied()
+	assert.Equal(t, uint32(1), applied.Fid)
+	assert.Equal(t, int64(36), applied.Offset)
+	assert.Equal(t, uint64(5), seqNo)
+
+	err := tree.Reset()
+	assert.Nil(t, err)
+	applied, _ = tree.Applied()
+	assert.Nil(t, applied)
+	assert.Equal(t, 0, tree.Size())
+	_ = tree.Close()
+}
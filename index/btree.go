@@ -1,22 +1,37 @@
 package index
 
 import (
-	"bytes"
 	"github.com/google/btree"
 	"github.com/lustresix/lxdb/data"
-	"sort"
 	"sync"
 )
 
 // BTree 来自 google 的 btree https://github.com/google/btree
 // BTree from Google's BTree https://github.com/google/btree
+// 条目直接保存在树的节点中，位置信息内联，key 存放在 keyArena 中
 type BTree struct {
-	tree *btree.BTree
+	tree  *btree.BTreeG[btreeEntry]
+	arena *keyArena
 	// " Write operations are not safe for concurrent mutation by multiple
 	// goroutines, but Read operations are." So we need add a lock to protect it
 	lock *sync.RWMutex
 }
 
+// BTree 中的一个条目，32 字节，key 指向 keyArena 中的数据
+type btreeEntry struct {
+	key string
+	pos packedPos
+}
+
+func btreeEntryLess(a, b btreeEntry) bool {
+	return a.key < b.key
+}
+
+// 用于查找的条目，不会拷贝 key
+func btreeProbe(key []byte) btreeEntry {
+	return btreeEntry{key: bytesToString(key)}
+}
+
 func (bt *BTree) Close() error {
 	return nil
 }
@@ -25,138 +40,139 @@ func (bt *BTree) Close() error {
 // initializes BTree index
 func NewBtree() *BTree {
 	return &BTree{
-		tree: btree.New(32),
-		lock: new(sync.RWMutex),
+		tree:  btree.NewG(32, btreeEntryLess),
+		arena: newKeyArena(),
+		lock:  new(sync.RWMutex),
 	}
 }
 
 // Put 向索引中存储 key 对应的数据位置的信息
 // stores information about the data location corresponding to the key in the index
 func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) bool {
-	it := &Item{
-		key: key,
-		pos: pos,
-	}
 	// Lock before storage
 	bt.lock.Lock()
 	defer bt.lock.Unlock()
-	bt.tree.ReplaceOrInsert(it)
+	bt.put(key, pos)
 	return true
 }
 
+// 已经存在的 key 复用原来的内存，只更新位置信息，调用时需要持有锁
+func (bt *BTree) put(key []byte, pos *data.LogRecordPos) {
+	entry, ok := bt.tree.Get(btreeProbe(key))
+	if !ok {
+		entry.key = bt.arena.alloc(key)
+	}
+	entry.pos = packPos(pos)
+	bt.tree.ReplaceOrInsert(entry)
+}
+
 // Get 根据 key 值取出对应的索引信息
 // retrieves the corresponding index information based on the key value
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
-	it := &Item{
-		key: key,
-	}
-	get := bt.tree.Get(it)
-	if get == nil {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	entry, ok := bt.tree.Get(btreeProbe(key))
+	if !ok {
 		return nil
 	}
-	return get.(*Item).pos
+	return entry.pos.unpack()
 }
 
 // Delete 根据 key 值删除对应的索引
 // deletes the corresponding index based on the key value
 func (bt *BTree) Delete(key []byte) bool {
-	it := Item{
-		key: key,
-	}
 	bt.lock.Lock()
-	del := bt.tree.Delete(&it)
-	bt.lock.Unlock()
-	if del != nil {
-		return true
-	}
-	return false
-}
-
-func (bt *BTree) Size() int {
-	size := bt.tree.Len()
-	return size
-}
-
-func (bt *BTree) Iterator(reverse bool) Iterator {
-	if bt.tree == nil {
-		return nil
-	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
-}
-
-// BTree 索引迭代器
-type btreeIterator struct {
-	currIndex int
-	reverse   bool
-	values    []*Item
+	defer bt.lock.Unlock()
+	return bt.delete(key)
 }
 
-func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-
-	// 返回false就终止排序
-	saveValues := func(item btree.Item) bool {
-		values[idx] = item.(*Item)
-		idx++
-		return true
+// 删除之后如果 key 的内存池中无效的数据太多就整理一次，调用时需要持有锁
+func (bt *BTree) delete(key []byte) bool {
+	entry, ok := bt.tree.Delete(btreeProbe(key))
+	if !ok {
+		return false
 	}
-	// 如果数据reverse就是从小到大开始排序
-	if reverse {
-		tree.Descend(saveValues)
-	}
-	tree.Ascend(saveValues)
-
-	return &btreeIterator{
-		values:    values,
-		reverse:   reverse,
-		currIndex: 0,
+	bt.arena.free(entry.key)
+	if bt.arena.needCompact() {
+		bt.compact()
 	}
+	return true
 }
 
-// Rewind 重新回到迭代器的起点，即第一个数据
-func (bti *btreeIterator) Rewind() {
-	bti.currIndex = 0
+// 把所有的 key 拷贝到新的内存池中，重建整棵树，调用时需要持有锁
+// 从大到小插入时分裂出来的节点都是满的，重建之后的树更紧凑
+// 已经创建的迭代器持有的是旧的树，不受影响
+func (bt *BTree) compact() {
+	arena := newKeyArena()
+	tree := btree.NewG(32, btreeEntryLess)
+	bt.tree.Descend(func(entry btreeEntry) bool {
+		entry.key = arena.alloc(stringToBytes(entry.key))
+		tree.ReplaceOrInsert(entry)
+		return true
+	})
+	bt.tree, bt.arena = tree, arena
 }
 
-// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
-func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		// 二分查找
-		sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		// 相反
-		sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
+// PutBatch 批量存储 key 对应的数据位置的信息，只加一次锁
+func (bt *BTree) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	for i, key := range keys {
+		bt.put(key, positions[i])
 	}
+	return true
 }
 
-// Next 跳转到下一个 key
-func (bti *btreeIterator) Next() {
-	bti.currIndex++
-}
-
-// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
-func (bti *btreeIterator) Valid() bool {
-	return bti.currIndex < len(bti.values)
-}
-
-// Key 当前遍历位置的 Key 数据
-func (bti *btreeIterator) Key() []byte {
-	return bti.values[bti.currIndex].key
+// DeleteBatch 批量删除 key 对应的索引，只加一次锁
+func (bt *BTree) DeleteBatch(keys [][]byte) bool {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	for _, key := range keys {
+		bt.delete(key)
+	}
+	return true
 }
 
-// Value 当前遍历位置的 Value 数据
-func (bti *btreeIterator) Value() *data.LogRecordPos {
-	return bti.values[bti.currIndex].pos
+func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	size := bt.tree.Len()
+	return size
 }
 
-// Close 关闭迭代器，释放相应资源
-func (bti *btreeIterator) Close() {
-	bti.values = nil
+// Iterator 返回迭代器，迭代器遍历的是创建时索引的快照
+// 快照通过写时复制的 Clone 得到，不需要拷贝数据，之后的写入只会复制被修改的节点
+func (bt *BTree) Iterator(reverse bool) Iterator {
+	if bt.tree == nil {
+		return nil
+	}
+	// Clone 会修改原来的树，不能和其他的 Clone 并发执行
+	bt.lock.Lock()
+	tree := bt.tree.Clone()
+	bt.lock.Unlock()
+	return newBTreeIterator(tree, reverse)
+}
+
+// BTree 索引迭代器，按批次从快照中读取数据
+func newBTreeIterator(tree *btree.BTreeG[btreeEntry], reverse bool) Iterator {
+	return newBatchIterator(func(items []*Item, start []byte, inclusive bool, limit int) []*Item {
+		saveValues := func(entry btreeEntry) bool {
+			if !inclusive && entry.key == string(start) {
+				return true
+			}
+			items = append(items, &Item{key: stringToBytes(entry.key), pos: entry.pos.unpack()})
+			return len(items) < limit
+		}
+		switch {
+		case start == nil && reverse:
+			tree.Descend(saveValues)
+		case start == nil:
+			tree.Ascend(saveValues)
+		case reverse:
+			tree.DescendLessOrEqual(btreeProbe(start), saveValues)
+		default:
+			tree.AscendGreaterOrEqual(btreeProbe(start), saveValues)
+		}
+		return items
+	})
 }
@@ -1,7 +1,9 @@
 package index
 
 import (
+	"bytes"
 	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -55,3 +57,94 @@ func TestBtreeIterator_Close(t *testing.T) {
 	iterator := bt.Iterator(false)
 	assert.True(t, iterator.Valid())
 }
+
+func TestBTree_PutBatch(t *testing.T) {
+	bt := NewBtree()
+	ok := bt.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}, []*data.LogRecordPos{
+		{Fid: 1, Offset: 1}, {Fid: 1, Offset: 2}, {Fid: 1, Offset: 3},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, 3, bt.Size())
+	assert.Equal(t, int64(2), bt.Get([]byte("b")).Offset)
+
+	ok = bt.DeleteBatch([][]byte{[]byte("a"), []byte("unknown")})
+	assert.True(t, ok)
+	assert.Nil(t, bt.Get([]byte("a")))
+	assert.Equal(t, 2, bt.Size())
+}
+
+func TestBTree_Iterator(t *testing.T) {
+	bt := NewBtree()
+	iterator := bt.Iterator(false)
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+
+	// 数据量超过一个批次
+	for i := 0; i < 1000; i++ {
+		bt.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	iterator = bt.Iterator(false)
+	var count int
+	var prev []byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if prev != nil {
+			assert.True(t, bytes.Compare(prev, iterator.Key()) < 0)
+		}
+		prev = iterator.Key()
+		assert.Equal(t, int64(count), iterator.Value().Offset)
+		// 迭代器遍历的是创建时的快照，之后的写入不可见
+		if count == 10 {
+			bt.Put([]byte("zzz"), &data.LogRecordPos{Fid: 2, Offset: 1})
+			bt.Delete(utils.GetTestKey(999))
+		}
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iterator.Close()
+
+	iterator = bt.Iterator(true)
+	count = 0
+	prev = nil
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if prev != nil {
+			assert.True(t, bytes.Compare(prev, iterator.Key()) > 0)
+		}
+		prev = iterator.Key()
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iterator.Close()
+}
+
+func TestBTree_IteratorSeek(t *testing.T) {
+	bt := NewBtree()
+	for _, key := range []string{"aa", "bb", "cc", "dd"} {
+		bt.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	iterator := bt.Iterator(false)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("bb"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+
+	// 反向遍历时找到第一个小于等于的 key
+	iterator = bt.Iterator(true)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("aa"), iterator.Key())
+	iterator.Seek([]byte("cc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("a"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+}
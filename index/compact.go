@@ -0,0 +1,83 @@
+package index
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"unsafe"
+)
+
+// 紧凑的索引存储
+// 位置信息直接保存在索引的条目中，不需要为每个 key 单独分配一个 *data.LogRecordPos
+// key 拷贝到大块的内存中连续存放，不需要为每个 key 单独分配内存，也减少了 GC 需要扫描的对象
+// BTree 和 ART 同时使用这两种方式，ART 内部节点的前缀直接引用内存池中叶子节点的 key；Hash 只内联位置信息，key 保存为 map 的键
+
+// packedPos 内联保存的位置信息，16 字节
+type packedPos struct {
+	fid    uint32
+	size   uint32
+	offset int64
+}
+
+func packPos(pos *data.LogRecordPos) packedPos {
+	return packedPos{fid: pos.Fid, size: pos.Size, offset: pos.Offset}
+}
+
+// 读取时才分配 *data.LogRecordPos 返回给调用方
+func (p packedPos) unpack() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: p.fid, Offset: p.offset, Size: p.size}
+}
+
+// 每一块内存的大小，超过这个大小的 key 单独分配一块
+const keyArenaSlabSize = 64 * 1024
+
+// keyArena 只追加的 key 内存池
+// 已经写入的 key 不会被修改，返回的切片可以一直安全地使用
+// 删除的 key 占用的空间不会被复用，只记录下来，由使用方决定何时整理
+type keyArena struct {
+	slab []byte
+	// 存放的 key 的总大小
+	used int
+	// 已经被删除的 key 的总大小
+	garbage int
+}
+
+func newKeyArena() *keyArena {
+	return &keyArena{}
+}
+
+// 把 key 拷贝到内存池中，返回指向内存池的字符串，比切片少保存一个容量字段
+func (ka *keyArena) alloc(key []byte) string {
+	ka.used += len(key)
+	if len(key) > keyArenaSlabSize/4 {
+		return string(key)
+	}
+	if len(ka.slab)+len(key) > cap(ka.slab) {
+		ka.slab = make([]byte, 0, keyArenaSlabSize)
+	}
+	start := len(ka.slab)
+	ka.slab = append(ka.slab, key...)
+	return bytesToString(ka.slab[start:len(ka.slab)])
+}
+
+// 记录被删除的 key 的大小
+func (ka *keyArena) free(key string) {
+	ka.garbage += len(key)
+}
+
+// 删除的 key 占用了一半以上的空间时需要整理
+func (ka *keyArena) needCompact() bool {
+	return ka.garbage > keyArenaSlabSize && ka.garbage > ka.used/2
+}
+
+// 不拷贝地把切片转换为字符串，调用方需要保证之后不会再修改切片的内容
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// 不拷贝地把字符串转换为切片，返回的切片不能被修改
+// 迭代器的 Key 通过它直接返回内存池中的 key，整理时会分配新的内存池，旧的内存块在没有引用之后才会被回收
+func stringToBytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
+}
@@ -0,0 +1,165 @@
+package index
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKeyArena(t *testing.T) {
+	ka := newKeyArena()
+	key := []byte("key")
+	stored := ka.alloc(key)
+	assert.Equal(t, "key", stored)
+
+	// 修改原来的 key 不影响内存池中的数据
+	key[0] = 'x'
+	assert.Equal(t, "key", stored)
+	next := ka.alloc([]byte("next"))
+	assert.Equal(t, "next", next)
+	assert.Equal(t, []byte("next"), stringToBytes(next))
+
+	// 较大的 key 单独分配
+	large := ka.alloc(make([]byte, keyArenaSlabSize))
+	assert.Equal(t, keyArenaSlabSize, len(large))
+	assert.Equal(t, 3+4+keyArenaSlabSize, ka.used)
+
+	ka.free(large)
+	assert.False(t, ka.needCompact())
+	ka.free(next)
+	assert.True(t, ka.needCompact())
+}
+
+func TestPackedPos(t *testing.T) {
+	pos := &data.LogRecordPos{Fid: 3, Offset: 1 << 40, Size: 128}
+	assert.Equal(t, pos, packPos(pos).unpack())
+}
+
+func TestBTree_Compact(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 10000; i++ {
+		key := utils.GetTestKey(i)
+		bt.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		// 索引中保存的是 key 的拷贝
+		key[0] = 'x'
+	}
+	// 覆盖写入复用原来的 key
+	used := bt.arena.used
+	bt.Put(utils.GetTestKey(1), &data.LogRecordPos{Fid: 2, Offset: 1})
+	assert.Equal(t, used, bt.arena.used)
+	assert.Equal(t, uint32(2), bt.Get(utils.GetTestKey(1)).Fid)
+
+	iterator := bt.Iterator(false)
+
+	// 删除大部分的 key 之后会整理内存池
+	arena := bt.arena
+	for i := 0; i < 9000; i++ {
+		assert.True(t, bt.Delete(utils.GetTestKey(i)))
+	}
+	assert.NotSame(t, arena, bt.arena)
+	assert.Less(t, bt.arena.garbage, arena.garbage)
+	assert.Equal(t, 1000, bt.Size())
+	for i := 9000; i < 10000; i++ {
+		assert.Equal(t, int64(i), bt.Get(utils.GetTestKey(i)).Offset)
+	}
+
+	// 整理之前创建的迭代器仍然可以遍历原来的数据
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, utils.GetTestKey(count), iterator.Key())
+		count++
+	}
+	assert.Equal(t, 10000, count)
+}
+
+func TestBTree_IteratorKeyStable(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 10000; i++ {
+		bt.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	// 迭代器返回的 key 指向内存池，先保存下来
+	var keys [][]byte
+	iterator := bt.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+	}
+	iterator.Close()
+
+	// 删除、整理和新的写入都不会修改已经返回的 key
+	arena := bt.arena
+	for i := 0; i < 9000; i++ {
+		bt.Delete(utils.GetTestKey(i))
+	}
+	assert.NotSame(t, arena, bt.arena)
+	for i := 0; i < 10000; i++ {
+		bt.Put(utils.GetTestKey(i+10000), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.Equal(t, 10000, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, utils.GetTestKey(i), key)
+	}
+}
+
+func TestArt_PackedPos(t *testing.T) {
+	art := NewArt()
+	pos := &data.LogRecordPos{Fid: 3, Offset: 1 << 40, Size: 128}
+	art.Put([]byte("key"), pos)
+	// 位置信息内联保存，读取时返回新的对象
+	got := art.Get([]byte("key"))
+	assert.Equal(t, pos, got)
+	assert.NotSame(t, pos, got)
+
+	art.Put([]byte("key"), &data.LogRecordPos{Fid: 4, Offset: 1, Size: 1})
+	assert.Equal(t, uint32(4), art.Get([]byte("key")).Fid)
+
+	iterator := art.Iterator(false)
+	assert.Equal(t, uint32(4), iterator.Value().Fid)
+	iterator.Close()
+}
+
+func TestArt_Compact(t *testing.T) {
+	art := NewArt()
+	for i := 0; i < 10000; i++ {
+		key := utils.GetTestKey(i)
+		art.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		// 索引中保存的是 key 的拷贝
+		key[0] = 'x'
+	}
+	// 覆盖写入复用原来的 key
+	used := art.arena.used
+	art.Put(utils.GetTestKey(1), &data.LogRecordPos{Fid: 2, Offset: 1})
+	assert.Equal(t, used, art.arena.used)
+	assert.Equal(t, uint32(2), art.Get(utils.GetTestKey(1)).Fid)
+
+	iterator := art.Iterator(false)
+
+	// 删除大部分的 key 之后会重建整棵树
+	arena := art.arena
+	for i := 0; i < 9000; i++ {
+		assert.True(t, art.Delete(utils.GetTestKey(i)))
+	}
+	assert.NotSame(t, arena, art.arena)
+	assert.Less(t, art.arena.garbage, arena.garbage)
+	assert.Equal(t, 1000, art.Size())
+	for i := 9000; i < 10000; i++ {
+		assert.Equal(t, int64(i), art.Get(utils.GetTestKey(i)).Offset)
+	}
+	var count int
+	current := art.Iterator(true)
+	for current.Rewind(); current.Valid(); current.Next() {
+		assert.Equal(t, utils.GetTestKey(9999-count), current.Key())
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	current.Close()
+
+	// 重建之前创建的迭代器仍然可以遍历原来的数据
+	count = 0
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, utils.GetTestKey(count), iterator.Key())
+		count++
+	}
+	assert.Equal(t, 10000, count)
+	iterator.Close()
+}
@@ -0,0 +1,907 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/lustresix/lxdb/data"
+	"hash/crc32"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// 磁盘哈希索引，使用可扩展哈希（extendible hashing）
+// 索引文件由固定大小的页组成，第 0 页是头部，记录已经应用到索引中的日志位置，之后的每一页都是一个桶
+// 内存中只保存目录，目录的下标是 key 的哈希值的低 globalDepth 位，值是桶所在的页
+// 一个桶的局部深度为 depth 时，哈希值的低 depth 位都等于桶的 pattern 的 key 都保存在这个桶中
+// 桶写满之后分裂为两个局部深度加一的桶，局部深度等于 globalDepth 时先把目录扩大一倍
+// 单点的读写只需要读写一个页，不会像 B+ 树一样写入整条路径
+//
+// 桶页的格式 crc + depth + 保留 + count + pattern + 保留 + [keySize + fid + size + offset + key]...
+// 头部的格式 crc + magic + dirty + hasApplied + corrupted + 保留 + fid + offset + size + seqNo
+//
+// 正常关闭时把目录写入单独的文件，下次打开时直接加载
+// 没有正常关闭（头部的 dirty 不为 0）时扫描所有的桶页重建目录，结构不一致或者校验失败时清空索引，由数据库从数据文件中重建
+// 读写时发现桶页损坏会在头部标记 corrupted 并通知调用方，下次打开时同样清空索引并重建
+
+const (
+	diskHashFileName    = "hash-index"
+	diskHashDirFileName = "hash-index.dir"
+
+	diskHashPageSize = 4096
+
+	diskHashHeaderSize       = 64
+	diskHashBucketHeaderSize = 16
+	diskHashEntryHeaderSize  = 18
+
+	// 局部深度的上限，哈希值只使用低 32 位
+	diskHashMaxDepth = 32
+
+	// DiskHashMaxKeySize 磁盘哈希索引支持的 key 的最大长度，一个条目必须能放进一个桶页中
+	DiskHashMaxKeySize = diskHashPageSize - diskHashBucketHeaderSize - diskHashEntryHeaderSize
+)
+
+var diskHashMagic = []byte("LXHI")
+
+var (
+	errDiskHashCorrupted = errors.New("disk hash index is corrupted")
+	errDiskHashKeyTooBig = errors.New("key is too large for disk hash index")
+	errDiskHashFull      = errors.New("disk hash bucket can not split any more")
+)
+
+var diskHashCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var diskHashPagePool = sync.Pool{
+	New: func() any {
+		return make([]byte, diskHashPageSize)
+	},
+}
+
+// DiskHashIndex 保存在磁盘上的哈希索引，适合 key 的数量超过内存的场景
+type DiskHashIndex struct {
+	lock       *sync.RWMutex
+	file       *os.File
+	dirPath    string
+	syncWrites bool
+
+	directory   []uint32
+	globalDepth uint8
+	// 文件中的页数，包括头部
+	pageNum uint32
+	size    int
+
+	applied *data.LogRecordPos
+	seqNo   uint64
+	// 打开之后是否修改过，修改过的索引在头部标记，正常关闭时清除
+	dirty bool
+	// 是否发现过损坏的桶页，只在清空索引时清除
+	corrupted atomic.Bool
+	// 发现损坏的桶页时调用，offset 是页在索引文件中的偏移
+	onCorruption func(offset int64, err error)
+}
+
+// 内存中的一个桶，修改之后整页写回
+type diskHashBucket struct {
+	page    uint32
+	depth   uint8
+	pattern uint32
+	entries []diskHashEntry
+	// 所有条目编码之后的大小
+	bytes int
+}
+
+type diskHashEntry struct {
+	key []byte
+	pos packedPos
+}
+
+// NewDiskHashIndex 打开目录中的磁盘哈希索引，不存在时创建
+func NewDiskHashIndex(dir string, syncWrites bool) (*DiskHashIndex, error) {
+	file, err := os.OpenFile(DiskHashIndexFileName(dir), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	dh := &DiskHashIndex{
+		lock:       new(sync.RWMutex),
+		file:       file,
+		dirPath:    dir,
+		syncWrites: syncWrites,
+	}
+	if err := dh.open(); err != nil {
+		// 索引文件损坏时清空，已经应用的位置也随之清空，数据库会从数据文件中重建
+		if err = dh.reset(); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return dh, nil
+}
+
+// SetCorruptionHandler 设置发现损坏的桶页时的回调，offset 是页在索引文件中的偏移
+// 回调在持有索引的锁时执行，不能再访问索引
+func (dh *DiskHashIndex) SetCorruptionHandler(fn func(offset int64, err error)) {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	dh.onCorruption = fn
+}
+
+// 读取桶页失败时调用，在头部标记索引已经损坏，下次打开时清空并由数据库从数据文件中重建
+// 调用时需要持有锁，读锁即可
+func (dh *DiskHashIndex) reportCorruption(page uint32, err error) {
+	if dh.corrupted.CompareAndSwap(false, true) {
+		_ = dh.writeHeader(true)
+	}
+	if dh.onCorruption != nil {
+		dh.onCorruption(int64(page)*diskHashPageSize, err)
+	}
+}
+
+// DiskHashIndexFileName 获取目录中磁盘哈希索引文件的路径
+func DiskHashIndexFileName(dir string) string {
+	return filepath.Join(dir, diskHashFileName)
+}
+
+// 读取头部和目录
+func (dh *DiskHashIndex) open() error {
+	stat, err := dh.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < 2*diskHashPageSize {
+		return errDiskHashCorrupted
+	}
+	dirty, err := dh.readHeader()
+	if err != nil {
+		return err
+	}
+	dh.pageNum = uint32(stat.Size() / diskHashPageSize)
+	// 追加桶页时崩溃，末尾可能有不完整的页
+	if stat.Size()%diskHashPageSize != 0 {
+		dirty = true
+	}
+	if !dirty && dh.loadDirectory() == nil {
+		return nil
+	}
+	return dh.scan()
+}
+
+// 读取头部，返回上次是否没有正常关闭
+func (dh *DiskHashIndex) readHeader() (bool, error) {
+	buf := make([]byte, diskHashHeaderSize)
+	if _, err := dh.file.ReadAt(buf, 0); err != nil {
+		return false, err
+	}
+	if crc32.Checksum(buf[4:], diskHashCrcTable) != binary.LittleEndian.Uint32(buf) ||
+		!bytes.Equal(buf[4:8], diskHashMagic) || buf[10] != 0 {
+		return false, errDiskHashCorrupted
+	}
+	if buf[9] != 0 {
+		dh.applied = &data.LogRecordPos{
+			Fid:    binary.LittleEndian.Uint32(buf[12:]),
+			Offset: int64(binary.LittleEndian.Uint64(buf[16:])),
+			Size:   binary.LittleEndian.Uint32(buf[24:]),
+		}
+	}
+	dh.seqNo = binary.LittleEndian.Uint64(buf[28:])
+	return buf[8] != 0, nil
+}
+
+// 写入头部，sync 表示是否需要立即刷盘
+func (dh *DiskHashIndex) writeHeader(sync bool) error {
+	buf := make([]byte, diskHashHeaderSize)
+	copy(buf[4:8], diskHashMagic)
+	if dh.dirty {
+		buf[8] = 1
+	}
+	if dh.corrupted.Load() {
+		buf[10] = 1
+	}
+	if dh.applied != nil {
+		buf[9] = 1
+		binary.LittleEndian.PutUint32(buf[12:], dh.applied.Fid)
+		binary.LittleEndian.PutUint64(buf[16:], uint64(dh.applied.Offset))
+		binary.LittleEndian.PutUint32(buf[24:], dh.applied.Size)
+	}
+	binary.LittleEndian.PutUint64(buf[28:], dh.seqNo)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], diskHashCrcTable))
+	if _, err := dh.file.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if sync {
+		return dh.file.Sync()
+	}
+	return nil
+}
+
+// 第一次修改之前在头部标记，并且立即刷盘，保证崩溃之后不会使用过期的目录文件
+func (dh *DiskHashIndex) markDirty() error {
+	if dh.dirty {
+		return nil
+	}
+	dh.dirty = true
+	return dh.writeHeader(true)
+}
+
+// 目录文件的格式 crc + magic + globalDepth + 保留 + pageNum + size + [page]...
+func (dh *DiskHashIndex) loadDirectory() error {
+	buf, err := os.ReadFile(filepath.Join(dh.dirPath, diskHashDirFileName))
+	if err != nil {
+		return err
+	}
+	if len(buf) < 24 || crc32.Checksum(buf[4:], diskHashCrcTable) != binary.LittleEndian.Uint32(buf) ||
+		!bytes.Equal(buf[4:8], diskHashMagic) {
+		return errDiskHashCorrupted
+	}
+	globalDepth := buf[8]
+	if globalDepth > diskHashMaxDepth || binary.LittleEndian.Uint32(buf[12:]) != dh.pageNum ||
+		uint64(len(buf)-24) != 4<<globalDepth {
+		return errDiskHashCorrupted
+	}
+	directory := make([]uint32, 1<<globalDepth)
+	for i := range directory {
+		directory[i] = binary.LittleEndian.Uint32(buf[24+4*i:])
+	}
+	dh.directory, dh.globalDepth = directory, globalDepth
+	dh.size = int(binary.LittleEndian.Uint64(buf[16:]))
+	return nil
+}
+
+// 先写入临时文件，写完之后再重命名，保证目录文件总是完整的
+func (dh *DiskHashIndex) writeDirectory() error {
+	buf := make([]byte, 24+4*len(dh.directory))
+	copy(buf[4:8], diskHashMagic)
+	buf[8] = dh.globalDepth
+	binary.LittleEndian.PutUint32(buf[12:], dh.pageNum)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(dh.size))
+	for i, page := range dh.directory {
+		binary.LittleEndian.PutUint32(buf[24+4*i:], page)
+	}
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], diskHashCrcTable))
+
+	fileName := filepath.Join(dh.dirPath, diskHashDirFileName)
+	file, err := os.Create(fileName + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(fileName + ".tmp")
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// 扫描所有的桶页重建目录，每个目录项必须正好指向一个桶
+// 分裂到一半时崩溃会出现两个桶覆盖同一个目录项，此时返回错误，由调用方清空索引
+func (dh *DiskHashIndex) scan() error {
+	if err := dh.file.Truncate(int64(dh.pageNum) * diskHashPageSize); err != nil {
+		return err
+	}
+	var buckets []*diskHashBucket
+	var globalDepth uint8
+	size := 0
+	for page := uint32(1); page < dh.pageNum; page++ {
+		bucket, err := dh.readBucket(page)
+		if err != nil {
+			return err
+		}
+		if bucket.depth > globalDepth {
+			globalDepth = bucket.depth
+		}
+		size += len(bucket.entries)
+		// 只需要局部深度和 pattern
+		bucket.entries = nil
+		buckets = append(buckets, bucket)
+	}
+
+	directory := make([]uint32, 1<<globalDepth)
+	for _, bucket := range buckets {
+		for slot := uint64(bucket.pattern); slot < uint64(len(directory)); slot += 1 << bucket.depth {
+			if directory[slot] != 0 {
+				return errDiskHashCorrupted
+			}
+			directory[slot] = bucket.page
+		}
+	}
+	for _, page := range directory {
+		if page == 0 {
+			return errDiskHashCorrupted
+		}
+	}
+	dh.directory, dh.globalDepth, dh.size = directory, globalDepth, size
+	// 目录文件已经过期了，下次正常关闭之前都需要扫描
+	dh.dirty = false
+	return dh.markDirty()
+}
+
+// 清空索引，只保留一个空的桶，调用时需要持有锁
+func (dh *DiskHashIndex) reset() error {
+	if err := dh.file.Truncate(0); err != nil {
+		return err
+	}
+	dh.directory = []uint32{1}
+	dh.globalDepth = 0
+	dh.pageNum = 2
+	dh.size = 0
+	dh.applied = nil
+	dh.seqNo = 0
+	dh.dirty = true
+	dh.corrupted.Store(false)
+	if err := dh.writeBucket(&diskHashBucket{page: 1}); err != nil {
+		return err
+	}
+	return dh.writeHeader(true)
+}
+
+func diskHashKey(key []byte) uint64 {
+	var hash uint64 = 14695981039346656037
+	for _, b := range key {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// 根据 key 的哈希值找到桶所在的页
+func (dh *DiskHashIndex) bucketPage(key []byte) uint32 {
+	return dh.directory[diskHashKey(key)&(1<<dh.globalDepth-1)]
+}
+
+// 读取并校验一个页，返回的切片需要放回 diskHashPagePool
+func (dh *DiskHashIndex) readPage(page uint32) ([]byte, error) {
+	buf := diskHashPagePool.Get().([]byte)
+	if _, err := dh.file.ReadAt(buf, int64(page)*diskHashPageSize); err != nil {
+		diskHashPagePool.Put(buf)
+		return nil, err
+	}
+	if crc32.Checksum(buf[4:], diskHashCrcTable) != binary.LittleEndian.Uint32(buf) {
+		diskHashPagePool.Put(buf)
+		return nil, errDiskHashCorrupted
+	}
+	return buf, nil
+}
+
+// 依次解析页中的条目，fn 返回 false 时停止，key 指向页中的数据
+func forEachDiskHashEntry(buf []byte, fn func(key []byte, pos packedPos) bool) error {
+	count := int(binary.LittleEndian.Uint16(buf[6:]))
+	offset := diskHashBucketHeaderSize
+	for i := 0; i < count; i++ {
+		if offset+diskHashEntryHeaderSize > len(buf) {
+			return errDiskHashCorrupted
+		}
+		keySize := int(binary.LittleEndian.Uint16(buf[offset:]))
+		pos := packedPos{
+			fid:    binary.LittleEndian.Uint32(buf[offset+2:]),
+			size:   binary.LittleEndian.Uint32(buf[offset+6:]),
+			offset: int64(binary.LittleEndian.Uint64(buf[offset+10:])),
+		}
+		offset += diskHashEntryHeaderSize
+		if offset+keySize > len(buf) {
+			return errDiskHashCorrupted
+		}
+		if !fn(buf[offset:offset+keySize], pos) {
+			return nil
+		}
+		offset += keySize
+	}
+	return nil
+}
+
+// 读取一个桶，条目中的 key 指向桶自己的页缓冲区，不会被复用
+func (dh *DiskHashIndex) readBucket(page uint32) (*diskHashBucket, error) {
+	buf := make([]byte, diskHashPageSize)
+	if _, err := dh.file.ReadAt(buf, int64(page)*diskHashPageSize); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(buf[4:], diskHashCrcTable) != binary.LittleEndian.Uint32(buf) {
+		return nil, errDiskHashCorrupted
+	}
+	bucket := &diskHashBucket{
+		page:    page,
+		depth:   buf[4],
+		pattern: binary.LittleEndian.Uint32(buf[8:]),
+		entries: make([]diskHashEntry, 0, binary.LittleEndian.Uint16(buf[6:])),
+	}
+	if bucket.depth > diskHashMaxDepth || uint64(bucket.pattern) >= 1<<bucket.depth {
+		return nil, errDiskHashCorrupted
+	}
+	err := forEachDiskHashEntry(buf, func(key []byte, pos packedPos) bool {
+		bucket.entries = append(bucket.entries, diskHashEntry{key: key, pos: pos})
+		bucket.bytes += diskHashEntryHeaderSize + len(key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+func (dh *DiskHashIndex) writeBucket(bucket *diskHashBucket) error {
+	buf := diskHashPagePool.Get().([]byte)
+	defer diskHashPagePool.Put(buf)
+	for i := range buf {
+		buf[i] = 0
+	}
+	buf[4] = bucket.depth
+	binary.LittleEndian.PutUint16(buf[6:], uint16(len(bucket.entries)))
+	binary.LittleEndian.PutUint32(buf[8:], bucket.pattern)
+	offset := diskHashBucketHeaderSize
+	for _, entry := range bucket.entries {
+		binary.LittleEndian.PutUint16(buf[offset:], uint16(len(entry.key)))
+		binary.LittleEndian.PutUint32(buf[offset+2:], entry.pos.fid)
+		binary.LittleEndian.PutUint32(buf[offset+6:], entry.pos.size)
+		binary.LittleEndian.PutUint64(buf[offset+10:], uint64(entry.pos.offset))
+		offset += diskHashEntryHeaderSize
+		offset += copy(buf[offset:], entry.key)
+	}
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], diskHashCrcTable))
+	_, err := dh.file.WriteAt(buf, int64(bucket.page)*diskHashPageSize)
+	return err
+}
+
+// 更新或者插入一个条目，返回是否是新的 key
+func (b *diskHashBucket) put(key []byte, pos packedPos) bool {
+	for i := range b.entries {
+		if bytes.Equal(b.entries[i].key, key) {
+			b.entries[i].pos = pos
+			return false
+		}
+	}
+	b.entries = append(b.entries, diskHashEntry{key: key, pos: pos})
+	b.bytes += diskHashEntryHeaderSize + len(key)
+	return true
+}
+
+// 删除一个条目，返回 key 是否存在
+func (b *diskHashBucket) delete(key []byte) bool {
+	for i := range b.entries {
+		if bytes.Equal(b.entries[i].key, key) {
+			b.bytes -= diskHashEntryHeaderSize + len(key)
+			last := len(b.entries) - 1
+			b.entries[i] = b.entries[last]
+			b.entries = b.entries[:last]
+			return true
+		}
+	}
+	return false
+}
+
+func (b *diskHashBucket) fits() bool {
+	return diskHashBucketHeaderSize+b.bytes <= diskHashPageSize
+}
+
+// 把修改之后的桶写回，放不下时分裂，调用时需要持有锁
+// 先写入新的桶再写回原来的桶，分裂之后的两个桶仍然放不下时继续分裂
+func (dh *DiskHashIndex) storeBucket(bucket *diskHashBucket) error {
+	if bucket.fits() {
+		return dh.writeBucket(bucket)
+	}
+	if bucket.depth >= diskHashMaxDepth {
+		return errDiskHashFull
+	}
+	if bucket.depth == dh.globalDepth {
+		dh.directory = append(dh.directory, dh.directory...)
+		dh.globalDepth++
+	}
+
+	sibling := &diskHashBucket{
+		page:    dh.pageNum,
+		depth:   bucket.depth + 1,
+		pattern: bucket.pattern | 1<<bucket.depth,
+	}
+	dh.pageNum++
+	entries := bucket.entries
+	bucket.depth++
+	bucket.entries, bucket.bytes = nil, 0
+	for _, entry := range entries {
+		if uint32(diskHashKey(entry.key))&(1<<sibling.depth-1) == sibling.pattern {
+			sibling.put(entry.key, entry.pos)
+		} else {
+			bucket.put(entry.key, entry.pos)
+		}
+	}
+	for slot := uint64(sibling.pattern); slot < uint64(len(dh.directory)); slot += 1 << sibling.depth {
+		dh.directory[slot] = sibling.page
+	}
+
+	if err := dh.storeBucket(sibling); err != nil {
+		return err
+	}
+	return dh.storeBucket(bucket)
+}
+
+// 按照桶分组更新索引，每个桶只读写一次，调用时需要持有锁
+func (dh *DiskHashIndex) update(putKeys [][]byte, positions []*data.LogRecordPos, deleteKeys [][]byte) error {
+	if len(putKeys) == 0 && len(deleteKeys) == 0 {
+		return nil
+	}
+	for _, key := range putKeys {
+		if len(key) > DiskHashMaxKeySize {
+			return errDiskHashKeyTooBig
+		}
+	}
+	if err := dh.markDirty(); err != nil {
+		return err
+	}
+
+	type operation struct {
+		key []byte
+		pos *data.LogRecordPos
+	}
+	var pages []uint32
+	groups := make(map[uint32][]operation)
+	add := func(key []byte, pos *data.LogRecordPos) {
+		page := dh.bucketPage(key)
+		if _, ok := groups[page]; !ok {
+			pages = append(pages, page)
+		}
+		groups[page] = append(groups[page], operation{key: key, pos: pos})
+	}
+	for i, key := range putKeys {
+		add(key, positions[i])
+	}
+	for _, key := range deleteKeys {
+		add(key, nil)
+	}
+
+	for _, page := range pages {
+		bucket, err := dh.readBucket(page)
+		if err != nil {
+			dh.reportCorruption(page, err)
+			return err
+		}
+		changed := false
+		for _, op := range groups[page] {
+			switch {
+			case op.pos != nil:
+				if bucket.put(append([]byte(nil), op.key...), packPos(op.pos)) {
+					dh.size++
+				}
+				changed = true
+			case bucket.delete(op.key):
+				dh.size--
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := dh.storeBucket(bucket); err != nil {
+			return err
+		}
+	}
+	if dh.syncWrites {
+		return dh.file.Sync()
+	}
+	return nil
+}
+
+// Put 向索引中存储 key 对应的数据位置的信息
+func (dh *DiskHashIndex) Put(key []byte, pos *data.LogRecordPos) bool {
+	return dh.PutBatch([][]byte{key}, []*data.LogRecordPos{pos})
+}
+
+// Get 根据 key 值取出对应的索引信息，读取失败时返回空，需要区分时使用 GetChecked
+func (dh *DiskHashIndex) Get(key []byte) *data.LogRecordPos {
+	pos, _ := dh.GetChecked(key)
+	return pos
+}
+
+// GetChecked 根据 key 值取出对应的索引信息，桶页读取失败或者损坏时返回错误
+func (dh *DiskHashIndex) GetChecked(key []byte) (*data.LogRecordPos, error) {
+	dh.lock.RLock()
+	defer dh.lock.RUnlock()
+	page := dh.bucketPage(key)
+	buf, err := dh.readPage(page)
+	if err != nil {
+		dh.reportCorruption(page, err)
+		return nil, err
+	}
+	defer diskHashPagePool.Put(buf)
+	var pos *data.LogRecordPos
+	err = forEachDiskHashEntry(buf, func(k []byte, p packedPos) bool {
+		if bytes.Equal(k, key) {
+			pos = p.unpack()
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		dh.reportCorruption(page, err)
+		return nil, err
+	}
+	return pos, nil
+}
+
+// Delete 根据 key 值删除对应的索引
+func (dh *DiskHashIndex) Delete(key []byte) bool {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	size := dh.size
+	return dh.update(nil, nil, [][]byte{key}) == nil && dh.size < size
+}
+
+// PutBatch 批量存储 key 对应的数据位置的信息，同一个桶中的 key 只写一次
+func (dh *DiskHashIndex) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	return dh.update(keys, positions, nil) == nil
+}
+
+// DeleteBatch 批量删除 key 对应的索引
+func (dh *DiskHashIndex) DeleteBatch(keys [][]byte) bool {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	return dh.update(nil, nil, keys) == nil
+}
+
+// Apply 更新索引，之后再在头部记录已经应用到索引中的日志位置 applied 和事务序列号
+// 更新到一半崩溃时头部仍然是之前的位置，重放日志会再次更新这些 key，结果是一样的
+func (dh *DiskHashIndex) Apply(putKeys [][]byte, positions []*data.LogRecordPos, deleteKeys [][]byte,
+	applied *data.LogRecordPos, seqNo uint64) bool {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	if err := dh.update(putKeys, positions, deleteKeys); err != nil {
+		return false
+	}
+	if err := dh.markDirty(); err != nil {
+		return false
+	}
+	dh.applied, dh.seqNo = applied, seqNo
+	return dh.writeHeader(dh.syncWrites) == nil
+}
+
+// Applied 返回已经应用到索引中的日志位置和事务序列号，没有记录过时位置为 nil
+func (dh *DiskHashIndex) Applied() (*data.LogRecordPos, uint64) {
+	dh.lock.RLock()
+	defer dh.lock.RUnlock()
+	if dh.applied == nil {
+		return nil, dh.seqNo
+	}
+	applied := *dh.applied
+	return &applied, dh.seqNo
+}
+
+// ApplyMerge 把指向 merge 之前的数据文件（id 小于 fid）的索引替换为 hint 文件中记录的新位置
+// 条目的大小不变，不会分裂桶，中途崩溃之后重新执行的结果是一样的
+func (dh *DiskHashIndex) ApplyMerge(fid uint32, keys [][]byte, positions []*data.LogRecordPos) error {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	if err := dh.markDirty(); err != nil {
+		return err
+	}
+
+	var pages []uint32
+	groups := make(map[uint32][]int)
+	for i, key := range keys {
+		page := dh.bucketPage(key)
+		if _, ok := groups[page]; !ok {
+			pages = append(pages, page)
+		}
+		groups[page] = append(groups[page], i)
+	}
+	for _, page := range pages {
+		bucket, err := dh.readBucket(page)
+		if err != nil {
+			dh.reportCorruption(page, err)
+			return err
+		}
+		changed := false
+		for _, i := range groups[page] {
+			for j := range bucket.entries {
+				entry := &bucket.entries[j]
+				if entry.pos.fid < fid && bytes.Equal(entry.key, keys[i]) {
+					entry.pos = packPos(positions[i])
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := dh.writeBucket(bucket); err != nil {
+			return err
+		}
+	}
+
+	if dh.applied != nil && dh.applied.Fid < fid {
+		dh.applied = &data.LogRecordPos{Fid: fid}
+	}
+	return dh.writeHeader(true)
+}
+
+// Reset 清空索引和元数据，用于从数据文件中重建索引
+func (dh *DiskHashIndex) Reset() error {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	return dh.reset()
+}
+
+// Size 返回大小
+func (dh *DiskHashIndex) Size() int {
+	dh.lock.RLock()
+	defer dh.lock.RUnlock()
+	return dh.size
+}
+
+// Close 保存目录并清除头部的标记，下次打开时不需要扫描
+func (dh *DiskHashIndex) Close() error {
+	dh.lock.Lock()
+	defer dh.lock.Unlock()
+	if dh.dirty {
+		if err := dh.file.Sync(); err != nil {
+			return err
+		}
+		if err := dh.writeDirectory(); err != nil {
+			return err
+		}
+		dh.dirty = false
+		if err := dh.writeHeader(true); err != nil {
+			return err
+		}
+	}
+	return dh.file.Close()
+}
+
+// Iterator 返回有序的迭代器，需要扫描整个索引文件，并把所有的 key 读取到内存中排序
+// 内存占用和 key 的数量成正比，不需要顺序时应该使用 UnorderedIterator
+func (dh *DiskHashIndex) Iterator(reverse bool) Iterator {
+	return &hashIterator{items: dh.items(), reverse: reverse}
+}
+
+// UnorderedIterator 返回按照桶遍历的迭代器，每次只读取一个桶页，内存中只保存当前桶的条目
+// 调用 Seek 时会退化为读取所有 key 的有序遍历
+func (dh *DiskHashIndex) UnorderedIterator() Iterator {
+	dhi := &diskHashIterator{index: dh}
+	dhi.Rewind()
+	return dhi
+}
+
+// 依次读取所有的桶页，损坏的桶页会被报告并跳过，下次打开时重建索引
+func (dh *DiskHashIndex) items() []Item {
+	dh.lock.RLock()
+	defer dh.lock.RUnlock()
+	items := make([]Item, 0, dh.size)
+	for page := uint32(1); page < dh.pageNum; page++ {
+		buf, err := dh.readPage(page)
+		if err != nil {
+			dh.reportCorruption(page, err)
+			continue
+		}
+		err = forEachDiskHashEntry(buf, func(key []byte, pos packedPos) bool {
+			items = append(items, Item{key: append([]byte(nil), key...), pos: pos.unpack()})
+			return true
+		})
+		diskHashPagePool.Put(buf)
+		if err != nil {
+			dh.reportCorruption(page, err)
+		}
+	}
+	return items
+}
+
+// 按照桶遍历的磁盘哈希索引迭代器
+// 桶覆盖的哈希值的低位相同，把低 32 位按位反转之后每个桶对应一段连续的区间，分裂只会把区间一分为二，
+// 所以按照反转之后的哈希值从小到大依次读取桶，遍历期间发生分裂也不会重复或者遗漏已经存在的 key
+type diskHashIterator struct {
+	index *DiskHashIndex
+	// 下一个要读取的桶的起点，反转之后的哈希值，达到 1<<32 时遍历结束
+	cursor uint64
+	// 当前桶中的条目
+	items     []Item
+	currIndex int
+	// 调用 Seek 之后改为有序遍历
+	sorted *hashIterator
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (dhi *diskHashIterator) Rewind() {
+	if dhi.sorted != nil {
+		dhi.sorted.Rewind()
+		return
+	}
+	dhi.cursor = 0
+	dhi.items = dhi.items[:0]
+	dhi.currIndex = 0
+	dhi.loadBucket()
+}
+
+// Seek 没有顺序的遍历无法定位，读取所有的 key 排序之后再定位
+func (dhi *diskHashIterator) Seek(key []byte) {
+	if dhi.sorted == nil {
+		dhi.sorted = &hashIterator{items: dhi.index.items()}
+		dhi.items = nil
+	}
+	dhi.sorted.Seek(key)
+}
+
+// Next 跳转到下一个 key
+func (dhi *diskHashIterator) Next() {
+	if dhi.sorted != nil {
+		dhi.sorted.Next()
+		return
+	}
+	dhi.currIndex++
+	if dhi.currIndex >= len(dhi.items) {
+		dhi.loadBucket()
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (dhi *diskHashIterator) Valid() bool {
+	if dhi.sorted != nil {
+		return dhi.sorted.Valid()
+	}
+	return dhi.currIndex < len(dhi.items)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (dhi *diskHashIterator) Key() []byte {
+	if dhi.sorted != nil {
+		return dhi.sorted.Key()
+	}
+	return dhi.items[dhi.currIndex].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (dhi *diskHashIterator) Value() *data.LogRecordPos {
+	if dhi.sorted != nil {
+		return dhi.sorted.Value()
+	}
+	return dhi.items[dhi.currIndex].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (dhi *diskHashIterator) Close() {
+	dhi.items = nil
+	dhi.sorted = nil
+	dhi.cursor = 1 << diskHashMaxDepth
+}
+
+// 从 cursor 开始读取下一个不为空的桶，损坏的桶会被报告并跳过，下次打开时重建索引
+func (dhi *diskHashIterator) loadBucket() {
+	dh := dhi.index
+	dh.lock.RLock()
+	defer dh.lock.RUnlock()
+	dhi.items = dhi.items[:0]
+	dhi.currIndex = 0
+	for len(dhi.items) == 0 && dhi.cursor < 1<<diskHashMaxDepth {
+		start := dhi.cursor
+		hash := bits.Reverse32(uint32(start))
+		page := dh.directory[hash&(1<<dh.globalDepth-1)]
+		buf, err := dh.readPage(page)
+		if err != nil {
+			dh.reportCorruption(page, err)
+			// 跳过目录中这个槽位对应的区间
+			dhi.cursor = start&^(1<<(diskHashMaxDepth-dh.globalDepth)-1) + 1<<(diskHashMaxDepth-dh.globalDepth)
+			continue
+		}
+		depth, pattern := buf[4], binary.LittleEndian.Uint32(buf[8:])
+		if depth > diskHashMaxDepth || uint64(pattern) >= 1<<depth {
+			diskHashPagePool.Put(buf)
+			dh.reportCorruption(page, errDiskHashCorrupted)
+			dhi.cursor = start&^(1<<(diskHashMaxDepth-dh.globalDepth)-1) + 1<<(diskHashMaxDepth-dh.globalDepth)
+			continue
+		}
+		dhi.cursor = uint64(bits.Reverse32(pattern)) + 1<<(diskHashMaxDepth-depth)
+		err = forEachDiskHashEntry(buf, func(key []byte, pos packedPos) bool {
+			// 索引被重置之后桶的区间可能从 cursor 之前开始，跳过已经遍历过的部分
+			if uint64(bits.Reverse32(uint32(diskHashKey(key)))) >= start {
+				dhi.items = append(dhi.items, Item{key: append([]byte(nil), key...), pos: pos.unpack()})
+			}
+			return true
+		})
+		diskHashPagePool.Put(buf)
+		if err != nil {
+			dh.reportCorruption(page, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package index
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskHashIndex_PutGetDelete(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dh.Get([]byte("key0")))
+	assert.False(t, dh.Delete([]byte("key0")))
+
+	// 写入足够多的 key，桶会分裂很多次
+	for i := 0; i < 10000; i++ {
+		assert.True(t, dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 10}))
+	}
+	assert.Equal(t, 10000, dh.Size())
+	assert.Greater(t, dh.globalDepth, uint8(5))
+	for i := 0; i < 10000; i++ {
+		pos := dh.Get(utils.GetTestKey(i))
+		assert.NotNil(t, pos)
+		assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 10}, pos)
+	}
+
+	// 覆盖写入不会改变数量
+	assert.True(t, dh.Put(utils.GetTestKey(1), &data.LogRecordPos{Fid: 2, Offset: 1}))
+	assert.Equal(t, 10000, dh.Size())
+	assert.Equal(t, uint32(2), dh.Get(utils.GetTestKey(1)).Fid)
+
+	for i := 0; i < 5000; i++ {
+		assert.True(t, dh.Delete(utils.GetTestKey(i)))
+	}
+	assert.False(t, dh.Delete(utils.GetTestKey(0)))
+	assert.Equal(t, 5000, dh.Size())
+	assert.Nil(t, dh.Get(utils.GetTestKey(0)))
+	assert.NotNil(t, dh.Get(utils.GetTestKey(5000)))
+
+	// key 太大放不进一个桶页
+	assert.False(t, dh.Put(make([]byte, DiskHashMaxKeySize+1), &data.LogRecordPos{Fid: 1}))
+	assert.True(t, dh.Put(make([]byte, DiskHashMaxKeySize), &data.LogRecordPos{Fid: 1}))
+	assert.NotNil(t, dh.Get(make([]byte, DiskHashMaxKeySize)))
+	assert.Nil(t, dh.Close())
+}
+
+func TestDiskHashIndex_Reopen(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash-reopen")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.True(t, dh.Apply(nil, nil, nil, &data.LogRecordPos{Fid: 3, Offset: 100}, 7))
+	depth := dh.globalDepth
+	assert.Nil(t, dh.Close())
+
+	// 正常关闭之后直接加载目录文件
+	dh, err = NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	assert.False(t, dh.dirty)
+	assert.Equal(t, depth, dh.globalDepth)
+	assert.Equal(t, 2000, dh.Size())
+	applied, seqNo := dh.Applied()
+	assert.Equal(t, &data.LogRecordPos{Fid: 3, Offset: 100}, applied)
+	assert.Equal(t, uint64(7), seqNo)
+
+	// 没有正常关闭，扫描所有的桶页重建目录
+	for i := 2000; i < 4000; i++ {
+		dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	dh.Delete(utils.GetTestKey(0))
+	_ = dh.file.Close()
+
+	dh, err = NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3999, dh.Size())
+	assert.Nil(t, dh.Get(utils.GetTestKey(0)))
+	for i := 1; i < 4000; i++ {
+		assert.Equal(t, int64(i), dh.Get(utils.GetTestKey(i)).Offset)
+	}
+	applied, _ = dh.Applied()
+	assert.Equal(t, &data.LogRecordPos{Fid: 3, Offset: 100}, applied)
+	assert.Nil(t, dh.Close())
+}
+
+func TestDiskHashIndex_Corrupted(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash-corrupted")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.True(t, dh.Apply(nil, nil, nil, &data.LogRecordPos{Fid: 1, Offset: 100}, 1))
+	_ = dh.file.Close()
+
+	// 桶页损坏之后清空索引，已经应用的位置也被清空，由数据库重建
+	file, err := os.OpenFile(filepath.Join(path, diskHashFileName), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), diskHashPageSize+100)
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	dh, err = NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, dh.Size())
+	applied, _ := dh.Applied()
+	assert.Nil(t, applied)
+	dh.Put([]byte("key"), &data.LogRecordPos{Fid: 1})
+	assert.NotNil(t, dh.Get([]byte("key")))
+	assert.Nil(t, dh.Close())
+}
+
+func TestDiskHashIndex_ApplyMerge(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash-merge")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dh.Close()
+	}()
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	positions := []*data.LogRecordPos{{Fid: 0, Offset: 1}, {Fid: 1, Offset: 2}, {Fid: 3, Offset: 3}}
+	assert.True(t, dh.Apply(keys, positions, nil, &data.LogRecordPos{Fid: 1, Offset: 50}, 1))
+
+	merged := []*data.LogRecordPos{{Fid: 2, Offset: 10}, {Fid: 2, Offset: 20}, {Fid: 2, Offset: 30}}
+	assert.Nil(t, dh.ApplyMerge(2, keys, merged))
+	assert.Equal(t, int64(10), dh.Get([]byte("a")).Offset)
+	assert.Equal(t, int64(20), dh.Get([]byte("b")).Offset)
+	// merge 之后写入的 key 不会被替换
+	assert.Equal(t, uint32(3), dh.Get([]byte("c")).Fid)
+	applied, _ := dh.Applied()
+	assert.Equal(t, &data.LogRecordPos{Fid: 2}, applied)
+
+	assert.Nil(t, dh.Reset())
+	assert.Equal(t, 0, dh.Size())
+	assert.Nil(t, dh.Get([]byte("a")))
+	applied, _ = dh.Applied()
+	assert.Nil(t, applied)
+}
+
+func TestDiskHashIndex_Iterator(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash-iterator")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dh.Close()
+	}()
+	for i := 0; i < 1000; i++ {
+		dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	iterator := dh.Iterator(false)
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, utils.GetTestKey(count), iterator.Key())
+		assert.Equal(t, int64(count), iterator.Value().Offset)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	iterator = dh.Iterator(true)
+	iterator.Seek(utils.GetTestKey(500))
+	assert.Equal(t, utils.GetTestKey(500), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, utils.GetTestKey(499), iterator.Key())
+
+	seen := make(map[string]bool)
+	iterator = dh.UnorderedIterator()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		seen[string(iterator.Key())] = true
+	}
+	assert.Equal(t, 1000, len(seen))
+}
+
+func TestDiskHashIndex_UnorderedIterator(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash-unordered")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dh.Close()
+	}()
+	for i := 0; i < 1000; i++ {
+		dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 遍历期间继续写入，桶会不断分裂，已经存在的 key 只会被遍历一次
+	seen := make(map[string]int)
+	iterator := dh.UnorderedIterator()
+	n := 1000
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		// 内存中只保存当前桶的条目
+		assert.LessOrEqual(t, len(iterator.(*diskHashIterator).items), diskHashPageSize/diskHashEntryHeaderSize)
+		seen[string(iterator.Key())]++
+		for j := 0; j < 2; j++ {
+			dh.Put(utils.GetTestKey(n), &data.LogRecordPos{Fid: 1, Offset: int64(n)})
+			n++
+		}
+	}
+	iterator.Close()
+	assert.False(t, iterator.Valid())
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, 1, seen[string(utils.GetTestKey(i))])
+	}
+	for key, count := range seen {
+		assert.Equal(t, 1, count, key)
+	}
+
+	// Seek 之后改为有序遍历
+	iterator = dh.UnorderedIterator()
+	iterator.Seek(utils.GetTestKey(100))
+	assert.Equal(t, utils.GetTestKey(100), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, utils.GetTestKey(101), iterator.Key())
+	iterator.Close()
+
+	// 空的索引
+	assert.Nil(t, dh.Reset())
+	iterator = dh.UnorderedIterator()
+	assert.False(t, iterator.Valid())
+}
+
+func TestDiskHashIndex_CorruptedPage(t *testing.T) {
+	path, _ := os.MkdirTemp("", "disk-hash-corrupted-page")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	dh, err := NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	var offsets []int64
+	dh.SetCorruptionHandler(func(offset int64, err error) {
+		offsets = append(offsets, offset)
+	})
+	for i := 0; i < 1000; i++ {
+		dh.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.True(t, dh.Apply(nil, nil, nil, &data.LogRecordPos{Fid: 1, Offset: 100}, 1))
+	assert.Nil(t, dh.Close())
+	dh, err = NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	dh.SetCorruptionHandler(func(offset int64, err error) {
+		offsets = append(offsets, offset)
+	})
+
+	// 打开之后桶页损坏
+	page := dh.bucketPage(utils.GetTestKey(1))
+	file, err := os.OpenFile(filepath.Join(path, diskHashFileName), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), int64(page)*diskHashPageSize+100)
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	// 读取返回错误而不是 key 不存在，并且通知调用方
+	pos, err := dh.GetChecked(utils.GetTestKey(1))
+	assert.Nil(t, pos)
+	assert.Equal(t, errDiskHashCorrupted, err)
+	assert.Equal(t, []int64{int64(page) * diskHashPageSize}, offsets)
+
+	// 遍历时跳过损坏的桶页，同样通知调用方
+	for _, iterator := range []Iterator{dh.Iterator(false), dh.UnorderedIterator()} {
+		var count int
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			count++
+		}
+		assert.Less(t, count, 1000)
+		iterator.Close()
+	}
+	assert.Equal(t, 3, len(offsets))
+	assert.Nil(t, dh.Close())
+
+	// 下次打开时清空索引，由数据库从数据文件中重建
+	dh, err = NewDiskHashIndex(path, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, dh.Size())
+	applied, _ := dh.Applied()
+	assert.Nil(t, applied)
+	assert.False(t, dh.corrupted.Load())
+	assert.Nil(t, dh.Close())
+}
@@ -0,0 +1,291 @@
+package index
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"sort"
+	"sync"
+)
+
+// HashIndex 分片的哈希索引，Get、Put、Delete 都是 O(1) 的，适合只有单点查询的场景
+// 每个 key 只占用 map 中的一个条目，位置信息内联保存，不需要维护有序结构
+// 遍历时才把 key 读取出来，需要有序时再排序
+type HashIndex struct {
+	shards []*hashShard
+}
+
+type hashShard struct {
+	lock  sync.RWMutex
+	items map[string]packedPos
+}
+
+// NewHashIndex 初始化哈希索引
+func NewHashIndex(shardNum int) *HashIndex {
+	if shardNum <= 0 {
+		shardNum = DefaultShardNum
+	}
+	shards := make([]*hashShard, shardNum)
+	for i := range shards {
+		shards[i] = &hashShard{items: make(map[string]packedPos)}
+	}
+	return &HashIndex{shards: shards}
+}
+
+func (hi *HashIndex) shard(key []byte) *hashShard {
+	return hi.shards[keyHash(key)%uint32(len(hi.shards))]
+}
+
+// Put 向索引中存储 key 对应的数据位置的信息
+func (hi *HashIndex) Put(key []byte, pos *data.LogRecordPos) bool {
+	shard := hi.shard(key)
+	shard.lock.Lock()
+	shard.items[string(key)] = packPos(pos)
+	shard.lock.Unlock()
+	return true
+}
+
+// Get 根据 key 值取出对应的索引信息
+func (hi *HashIndex) Get(key []byte) *data.LogRecordPos {
+	shard := hi.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	pos, ok := shard.items[string(key)]
+	if !ok {
+		return nil
+	}
+	return pos.unpack()
+}
+
+// Delete 根据 key 值删除对应的索引
+func (hi *HashIndex) Delete(key []byte) bool {
+	shard := hi.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, ok := shard.items[string(key)]; !ok {
+		return false
+	}
+	delete(shard.items, string(key))
+	return true
+}
+
+// PutBatch 批量存储 key 对应的数据位置的信息
+func (hi *HashIndex) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	for i, key := range keys {
+		hi.Put(key, positions[i])
+	}
+	return true
+}
+
+// DeleteBatch 批量删除 key 对应的索引
+func (hi *HashIndex) DeleteBatch(keys [][]byte) bool {
+	for _, key := range keys {
+		hi.Delete(key)
+	}
+	return true
+}
+
+// Size 返回所有分片的大小之和
+func (hi *HashIndex) Size() int {
+	var size int
+	for _, shard := range hi.shards {
+		shard.lock.RLock()
+		size += len(shard.items)
+		shard.lock.RUnlock()
+	}
+	return size
+}
+
+// Close 关闭索引
+func (hi *HashIndex) Close() error {
+	return nil
+}
+
+// Iterator 返回有序的迭代器，第一次定位时才排序
+func (hi *HashIndex) Iterator(reverse bool) Iterator {
+	return &hashIterator{items: hi.items(), reverse: reverse}
+}
+
+// UnorderedIterator 返回按照分片遍历的迭代器，不需要排序，内存中只保存当前分片的条目
+// 调用 Seek 时会退化为读取所有 key 的有序遍历
+func (hi *HashIndex) UnorderedIterator() Iterator {
+	hsi := &hashShardIterator{index: hi}
+	hsi.Rewind()
+	return hsi
+}
+
+// 读取出所有分片中的数据，同时持有所有分片的读锁，得到的是同一时刻的快照
+func (hi *HashIndex) items() []Item {
+	for _, shard := range hi.shards {
+		shard.lock.RLock()
+	}
+	defer func() {
+		for _, shard := range hi.shards {
+			shard.lock.RUnlock()
+		}
+	}()
+	var size int
+	for _, shard := range hi.shards {
+		size += len(shard.items)
+	}
+	items := make([]Item, 0, size)
+	for _, shard := range hi.shards {
+		for key, pos := range shard.items {
+			items = append(items, Item{key: stringToBytes(key), pos: pos.unpack()})
+		}
+	}
+	return items
+}
+
+// 哈希索引迭代器，遍历的是创建时的数据，第一次访问数据之前排序
+type hashIterator struct {
+	items     []Item
+	reverse   bool
+	sorted    bool
+	currIndex int
+}
+
+// 按照遍历的方向排序，只会排序一次
+func (hti *hashIterator) sort() {
+	if hti.sorted {
+		return
+	}
+	sort.Slice(hti.items, func(i, j int) bool {
+		return (bytes.Compare(hti.items[i].key, hti.items[j].key) < 0) != hti.reverse
+	})
+	hti.sorted = true
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (hti *hashIterator) Rewind() {
+	hti.sort()
+	hti.currIndex = 0
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (hti *hashIterator) Seek(key []byte) {
+	hti.sort()
+	hti.currIndex = sort.Search(len(hti.items), func(i int) bool {
+		cmp := bytes.Compare(hti.items[i].key, key)
+		if hti.reverse {
+			return cmp <= 0
+		}
+		return cmp >= 0
+	})
+}
+
+// Next 跳转到下一个 key
+func (hti *hashIterator) Next() {
+	hti.currIndex++
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (hti *hashIterator) Valid() bool {
+	return hti.currIndex < len(hti.items)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (hti *hashIterator) Key() []byte {
+	hti.sort()
+	return hti.items[hti.currIndex].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (hti *hashIterator) Value() *data.LogRecordPos {
+	hti.sort()
+	return hti.items[hti.currIndex].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (hti *hashIterator) Close() {
+	hti.items = nil
+}
+
+// 哈希索引不保证顺序的迭代器，每次只拷贝一个分片中的条目
+// 分片之间不是同一时刻的数据，遍历期间的写入可能被看到也可能不会被看到
+type hashShardIterator struct {
+	index *HashIndex
+	// 下一个要读取的分片
+	shard int
+	// 当前分片中的条目
+	items     []Item
+	currIndex int
+	// 调用 Seek 之后改为有序遍历
+	sorted *hashIterator
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (hsi *hashShardIterator) Rewind() {
+	if hsi.sorted != nil {
+		hsi.sorted.Rewind()
+		return
+	}
+	hsi.shard = 0
+	hsi.loadShard()
+}
+
+// Seek 没有顺序的遍历无法定位，读取所有的 key 排序之后再定位
+func (hsi *hashShardIterator) Seek(key []byte) {
+	if hsi.sorted == nil {
+		hsi.sorted = &hashIterator{items: hsi.index.items()}
+		hsi.items = nil
+	}
+	hsi.sorted.Seek(key)
+}
+
+// Next 跳转到下一个 key
+func (hsi *hashShardIterator) Next() {
+	if hsi.sorted != nil {
+		hsi.sorted.Next()
+		return
+	}
+	hsi.currIndex++
+	if hsi.currIndex >= len(hsi.items) {
+		hsi.loadShard()
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (hsi *hashShardIterator) Valid() bool {
+	if hsi.sorted != nil {
+		return hsi.sorted.Valid()
+	}
+	return hsi.currIndex < len(hsi.items)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (hsi *hashShardIterator) Key() []byte {
+	if hsi.sorted != nil {
+		return hsi.sorted.Key()
+	}
+	return hsi.items[hsi.currIndex].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (hsi *hashShardIterator) Value() *data.LogRecordPos {
+	if hsi.sorted != nil {
+		return hsi.sorted.Value()
+	}
+	return hsi.items[hsi.currIndex].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (hsi *hashShardIterator) Close() {
+	hsi.items = nil
+	hsi.sorted = nil
+	hsi.shard = len(hsi.index.shards)
+}
+
+// 从 shard 开始拷贝下一个不为空的分片中的条目，复用上一个分片的切片
+func (hsi *hashShardIterator) loadShard() {
+	hsi.items = hsi.items[:0]
+	hsi.currIndex = 0
+	for len(hsi.items) == 0 && hsi.shard < len(hsi.index.shards) {
+		shard := hsi.index.shards[hsi.shard]
+		hsi.shard++
+		shard.lock.RLock()
+		for key, pos := range shard.items {
+			hsi.items = append(hsi.items, Item{key: stringToBytes(key), pos: pos.unpack()})
+		}
+		shard.lock.RUnlock()
+	}
+}
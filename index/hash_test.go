@@ -0,0 +1,108 @@
+package index
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashIndex(t *testing.T) {
+	hi := NewHashIndex(4)
+	assert.Nil(t, hi.Get([]byte("key")))
+	assert.False(t, hi.Delete([]byte("key")))
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, hi.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	assert.Equal(t, 100, hi.Size())
+	assert.Equal(t, int64(10), hi.Get(utils.GetTestKey(10)).Offset)
+
+	assert.True(t, hi.Delete(utils.GetTestKey(10)))
+	assert.False(t, hi.Delete(utils.GetTestKey(10)))
+	assert.Nil(t, hi.Get(utils.GetTestKey(10)))
+	assert.Equal(t, 99, hi.Size())
+
+	assert.True(t, hi.PutBatch([][]byte{[]byte("a"), []byte("b")}, []*data.LogRecordPos{{Fid: 2}, {Fid: 3}}))
+	assert.Equal(t, uint32(3), hi.Get([]byte("b")).Fid)
+	assert.True(t, hi.DeleteBatch([][]byte{[]byte("a"), []byte("b"), []byte("unknown")}))
+	assert.Equal(t, 99, hi.Size())
+
+	// 数据分散在不同的分片中
+	for _, shard := range hi.shards {
+		assert.Greater(t, len(shard.items), 0)
+	}
+}
+
+func TestHashIndex_Iterator(t *testing.T) {
+	hi := NewHashIndex(4)
+	iterator := hi.Iterator(false)
+	assert.False(t, iterator.Valid())
+
+	for i := 0; i < 100; i++ {
+		hi.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 创建之后就可以直接读取，第一次读取时排序
+	iterator = hi.Iterator(false)
+	assert.Equal(t, utils.GetTestKey(0), iterator.Key())
+	iterator = hi.Iterator(true)
+	assert.Equal(t, utils.GetTestKey(99), iterator.Key())
+
+	for _, reverse := range []bool{false, true} {
+		iterator := hi.Iterator(reverse)
+		var count int
+		var prev []byte
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			if prev != nil {
+				cmp := bytes.Compare(prev, iterator.Key())
+				assert.True(t, (cmp < 0) != reverse)
+			}
+			prev = iterator.Key()
+			assert.Equal(t, hi.Get(iterator.Key()), iterator.Value())
+			count++
+		}
+		assert.Equal(t, 100, count)
+		iterator.Close()
+	}
+
+	// 不要求顺序时不排序，每次只拷贝一个分片，每个 key 都只遍历一次
+	iterator = hi.UnorderedIterator()
+	seen := make(map[string]bool)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.False(t, seen[string(iterator.Key())])
+		seen[string(iterator.Key())] = true
+		assert.Less(t, len(iterator.(*hashShardIterator).items), 100)
+	}
+	assert.Equal(t, 100, len(seen))
+	assert.Nil(t, iterator.(*hashShardIterator).sorted)
+
+	// Seek 需要排序
+	iterator.Seek(utils.GetTestKey(50))
+	assert.Equal(t, utils.GetTestKey(50), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, utils.GetTestKey(51), iterator.Key())
+	iterator.Close()
+}
+
+func TestHashIndex_IteratorSeek(t *testing.T) {
+	hi := NewHashIndex(4)
+	for _, key := range []string{"aa", "bb", "cc", "dd"} {
+		hi.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	iterator := hi.Iterator(false)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.False(t, iterator.Valid())
+
+	iterator = hi.Iterator(true)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("aa"), iterator.Key())
+	iterator.Seek([]byte("a"))
+	assert.False(t, iterator.Valid())
+}
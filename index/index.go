@@ -1,8 +1,6 @@
 package index
 
 import (
-	"bytes"
-	"github.com/google/btree"
 	"github.com/lustresix/lxdb/data"
 )
 
@@ -16,6 +14,21 @@ const (
 	ART
 
 	BPtree
+
+	// ShardedBtree 按照 key 的哈希值分片的 BTree 索引
+	ShardedBtree
+
+	// ShardedART 按照 key 的哈希值分片的自适应基数树索引
+	ShardedART
+
+	// Skiplist 无锁的并发跳表，读取不会被写入阻塞
+	Skiplist
+
+	// Hash 分片的哈希索引，只适合单点查询，遍历时需要排序
+	Hash
+
+	// DiskHash 保存在磁盘上的可扩展哈希索引，内存中只有目录
+	DiskHash
 )
 
 // Indexer 内存设计，抽象索引接口，包括 PUT,GET,DELETE方法
@@ -30,7 +43,14 @@ type Indexer interface {
 	// Delete 根据 key 值删除对应的索引
 	Delete(key []byte) bool
 
-	// Iterator 返回迭代器
+	// PutBatch 批量存储 key 对应的数据位置的信息，keys 和 positions 一一对应
+	// 所有数据在一次加锁（B+ 树是一个事务）中更新，返回是否更新成功
+	PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool
+
+	// DeleteBatch 批量删除 key 对应的索引，不存在的 key 会被忽略，返回是否更新成功
+	DeleteBatch(keys [][]byte) bool
+
+	// Iterator 返回有序的迭代器，语义见 Iterator
 	Iterator(reverse bool) Iterator
 
 	// Close 关闭迭代器
@@ -39,14 +59,60 @@ type Indexer interface {
 	Size() int
 }
 
-func NewIndexer(indexType IndexerType, dir string, syncWrite bool) Indexer {
+// PersistentIndexer 保存在磁盘上的索引，记录已经应用到索引中的日志位置，打开时只需要重放之后的数据
+type PersistentIndexer interface {
+	Indexer
+
+	// Apply 更新索引，并记录已经应用到索引中的日志位置和事务序列号
+	Apply(putKeys [][]byte, positions []*data.LogRecordPos, deleteKeys [][]byte,
+		applied *data.LogRecordPos, seqNo uint64) bool
+
+	// Applied 返回已经应用到索引中的日志位置和事务序列号，没有记录过时位置为 nil
+	Applied() (*data.LogRecordPos, uint64)
+
+	// ApplyMerge 把指向 merge 之前的数据文件（id 小于 fid）的索引替换为 merge 之后的位置
+	ApplyMerge(fid uint32, keys [][]byte, positions []*data.LogRecordPos) error
+
+	// Reset 清空索引和元数据
+	Reset() error
+}
+
+// UnorderedIndexer 可以不按照 key 的顺序遍历的索引，省去排序的开销
+type UnorderedIndexer interface {
+	// UnorderedIterator 返回不保证顺序的迭代器
+	// 迭代器不保证是快照，遍历期间的写入可能被看到也可能不会被看到
+	UnorderedIterator() Iterator
+}
+
+// CheckedIndexer 读取时需要访问磁盘的索引，Get 读取失败时返回空，和 key 不存在无法区分
+type CheckedIndexer interface {
+	// GetChecked 根据 key 值取出对应的索引信息，读取失败时返回错误
+	GetChecked(key []byte) (*data.LogRecordPos, error)
+}
+
+// NewIndexer 创建索引，只有打开保存在磁盘上的索引时可能返回错误
+func NewIndexer(indexType IndexerType, dir string, syncWrite bool) (Indexer, error) {
 	switch indexType {
 	case Btree:
-		return NewBtree()
+		return NewBtree(), nil
 	case ART:
-		return NewArt()
+		return NewArt(), nil
 	case BPtree:
-		return NewBPTree(dir, syncWrite)
+		return NewBPTree(dir, syncWrite), nil
+	case ShardedBtree:
+		return NewShardedIndex(Btree, DefaultShardNum), nil
+	case ShardedART:
+		return NewShardedIndex(ART, DefaultShardNum), nil
+	case Skiplist:
+		return NewSkipList(), nil
+	case Hash:
+		return NewHashIndex(DefaultShardNum), nil
+	case DiskHash:
+		dh, err := NewDiskHashIndex(dir, syncWrite)
+		if err != nil {
+			return nil, err
+		}
+		return dh, nil
 	default:
 		panic("unsupported index type")
 	}
@@ -58,13 +124,11 @@ type Item struct {
 	pos *data.LogRecordPos
 }
 
-// Less tests whether the current item is less than the given argument.
-// If !a.Less(b) && !b.Less(a), we treat this to mean a == b
-func (it *Item) Less(bi btree.Item) bool {
-	return bytes.Compare(it.key, bi.(*Item).key) == -1
-}
-
 // Iterator 索引迭代器
+// Indexer.Iterator 返回的有序迭代器遍历的是创建时索引的快照，之后的写入和删除都不会被看到：
+// BTree 通过写时复制的 Clone、ART 通过写时复制的节点、跳表通过多版本的节点得到快照，分片索引在同一时刻创建所有分片的快照，
+// 哈希索引和磁盘哈希索引在创建时拷贝所有数据。
+// 唯一的例外是 B+ 树，每批数据在一个短暂的只读事务中读取，避免长时间持有事务阻塞写入，不同批次之间的写入可能被看到
 type Iterator interface {
 	// Rewind 重新回到迭代器的起点，即第一个数据
 	Rewind()
@@ -79,6 +143,8 @@ type Iterator interface {
 	Valid() bool
 
 	// Key 当前遍历位置的 Key 数据
+	// 返回的切片可能直接指向索引内部保存的 key，只能读取，不能修改；需要修改时先拷贝一份
+	// 索引之后的写入和整理不会修改已经返回的切片的内容
 	Key() []byte
 
 	// Value 当前遍历位置的 Value 数据
@@ -0,0 +1,254 @@
+package index
+
+import (
+	"bytes"
+	"container/heap"
+	"github.com/lustresix/lxdb/data"
+	"sync"
+)
+
+// DefaultShardNum 分片索引默认的分片数量
+const DefaultShardNum = 16
+
+// ShardedIndex 分片索引，根据 key 的哈希值把数据分散到多个子索引中
+// 每个子索引有自己的锁，不同分片上的读写不会互相阻塞
+type ShardedIndex struct {
+	shards []Indexer
+	// 写入时加读锁，创建迭代器时加写锁，保证所有分片的快照是同一时刻的
+	snapLock sync.RWMutex
+}
+
+// NewShardedIndex 初始化分片索引，shardType 是每个分片使用的内存索引类型
+func NewShardedIndex(shardType IndexerType, shardNum int) *ShardedIndex {
+	if shardNum <= 0 {
+		shardNum = DefaultShardNum
+	}
+	shards := make([]Indexer, shardNum)
+	for i := range shards {
+		switch shardType {
+		case Btree:
+			shards[i] = NewBtree()
+		case ART:
+			shards[i] = NewArt()
+		default:
+			panic("unsupported shard index type")
+		}
+	}
+	return &ShardedIndex{shards: shards}
+}
+
+// 根据 key 的 fnv-1a 哈希值选择分片
+func (si *ShardedIndex) shard(key []byte) Indexer {
+	return si.shards[si.shardIndex(key)]
+}
+
+func (si *ShardedIndex) shardIndex(key []byte) int {
+	return int(keyHash(key) % uint32(len(si.shards)))
+}
+
+// key 的 fnv-1a 哈希值
+func keyHash(key []byte) uint32 {
+	var hash uint32 = 2166136261
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return hash
+}
+
+// Put 向索引中存储 key 对应的数据位置的信息
+func (si *ShardedIndex) Put(key []byte, pos *data.LogRecordPos) bool {
+	si.snapLock.RLock()
+	defer si.snapLock.RUnlock()
+	return si.shard(key).Put(key, pos)
+}
+
+// Get 根据 key 值取出对应的索引信息
+func (si *ShardedIndex) Get(key []byte) *data.LogRecordPos {
+	return si.shard(key).Get(key)
+}
+
+// Delete 根据 key 值删除对应的索引
+func (si *ShardedIndex) Delete(key []byte) bool {
+	si.snapLock.RLock()
+	defer si.snapLock.RUnlock()
+	return si.shard(key).Delete(key)
+}
+
+// PutBatch 按分片把数据分组，每个分片只加一次锁
+func (si *ShardedIndex) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	si.snapLock.RLock()
+	defer si.snapLock.RUnlock()
+	shardKeys := make([][][]byte, len(si.shards))
+	shardPositions := make([][]*data.LogRecordPos, len(si.shards))
+	for i, key := range keys {
+		idx := si.shardIndex(key)
+		shardKeys[idx] = append(shardKeys[idx], key)
+		shardPositions[idx] = append(shardPositions[idx], positions[i])
+	}
+	ok := true
+	for i, shard := range si.shards {
+		if len(shardKeys[i]) > 0 && !shard.PutBatch(shardKeys[i], shardPositions[i]) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// DeleteBatch 按分片把数据分组，每个分片只加一次锁
+func (si *ShardedIndex) DeleteBatch(keys [][]byte) bool {
+	si.snapLock.RLock()
+	defer si.snapLock.RUnlock()
+	shardKeys := make([][][]byte, len(si.shards))
+	for _, key := range keys {
+		idx := si.shardIndex(key)
+		shardKeys[idx] = append(shardKeys[idx], key)
+	}
+	ok := true
+	for i, shard := range si.shards {
+		if len(shardKeys[i]) > 0 && !shard.DeleteBatch(shardKeys[i]) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Size 返回所有分片的大小之和
+func (si *ShardedIndex) Size() int {
+	var size int
+	for _, shard := range si.shards {
+		size += shard.Size()
+	}
+	return size
+}
+
+// Close 关闭所有分片
+func (si *ShardedIndex) Close() error {
+	for _, shard := range si.shards {
+		if err := shard.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Iterator 返回迭代器，多路归并所有分片的迭代器，保证 key 有序
+// 创建分片的迭代器期间阻塞写入，所有分片的迭代器遍历的是同一时刻的快照
+func (si *ShardedIndex) Iterator(reverse bool) Iterator {
+	iterators := make([]Iterator, len(si.shards))
+	si.snapLock.Lock()
+	for i, shard := range si.shards {
+		iterators[i] = shard.Iterator(reverse)
+	}
+	si.snapLock.Unlock()
+	return newMergeIterator(iterators, reverse)
+}
+
+// mergeIterator 多路归并多个有序的迭代器，堆顶是当前位置的迭代器
+type mergeIterator struct {
+	iterators []Iterator
+	heap      *iteratorHeap
+}
+
+func newMergeIterator(iterators []Iterator, reverse bool) *mergeIterator {
+	mi := &mergeIterator{
+		iterators: iterators,
+		heap:      &iteratorHeap{reverse: reverse},
+	}
+	mi.rebuild()
+	return mi
+}
+
+// 把所有有效的迭代器重新放入堆中
+func (mi *mergeIterator) rebuild() {
+	mi.heap.iterators = mi.heap.iterators[:0]
+	for _, iterator := range mi.iterators {
+		if iterator.Valid() {
+			mi.heap.iterators = append(mi.heap.iterators, iterator)
+		}
+	}
+	heap.Init(mi.heap)
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (mi *mergeIterator) Rewind() {
+	for _, iterator := range mi.iterators {
+		iterator.Rewind()
+	}
+	mi.rebuild()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (mi *mergeIterator) Seek(key []byte) {
+	for _, iterator := range mi.iterators {
+		iterator.Seek(key)
+	}
+	mi.rebuild()
+}
+
+// Next 跳转到下一个 key
+func (mi *mergeIterator) Next() {
+	top := mi.heap.iterators[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(mi.heap, 0)
+	} else {
+		heap.Pop(mi.heap)
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (mi *mergeIterator) Valid() bool {
+	return mi.heap.Len() > 0
+}
+
+// Key 当前遍历位置的 Key 数据
+func (mi *mergeIterator) Key() []byte {
+	return mi.heap.iterators[0].Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (mi *mergeIterator) Value() *data.LogRecordPos {
+	return mi.heap.iterators[0].Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (mi *mergeIterator) Close() {
+	for _, iterator := range mi.iterators {
+		iterator.Close()
+	}
+	mi.heap.iterators = nil
+}
+
+// iteratorHeap 按照迭代器当前的 key 排序的堆，反向遍历时 key 大的在堆顶
+type iteratorHeap struct {
+	iterators []Iterator
+	reverse   bool
+}
+
+func (h *iteratorHeap) Len() int {
+	return len(h.iterators)
+}
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.iterators[i].Key(), h.iterators[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) {
+	h.iterators[i], h.iterators[j] = h.iterators[j], h.iterators[i]
+}
+
+func (h *iteratorHeap) Push(x any) {
+	h.iterators = append(h.iterators, x.(Iterator))
+}
+
+func (h *iteratorHeap) Pop() any {
+	n := len(h.iterators)
+	x := h.iterators[n-1]
+	h.iterators = h.iterators[:n-1]
+	return x
+}
@@ -0,0 +1,124 @@
+package index
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShardedIndex(t *testing.T) {
+	si := NewShardedIndex(Btree, 4)
+	for i := 0; i < 100; i++ {
+		assert.True(t, si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	assert.Equal(t, 100, si.Size())
+
+	pos := si.Get(utils.GetTestKey(10))
+	assert.Equal(t, int64(10), pos.Offset)
+	assert.True(t, si.Delete(utils.GetTestKey(10)))
+	assert.False(t, si.Delete(utils.GetTestKey(10)))
+	assert.Nil(t, si.Get(utils.GetTestKey(10)))
+	assert.Equal(t, 99, si.Size())
+
+	// 数据分散在不同的分片中
+	for _, shard := range si.shards {
+		assert.Greater(t, shard.Size(), 0)
+	}
+}
+
+func TestShardedIndex_Iterator(t *testing.T) {
+	for _, shardType := range []IndexerType{Btree, ART} {
+		si := NewShardedIndex(shardType, 8)
+		for i := 0; i < 200; i++ {
+			si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+
+		iterator := si.Iterator(false)
+		var prev []byte
+		var count int
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			if prev != nil {
+				assert.True(t, bytes.Compare(prev, iterator.Key()) < 0)
+			}
+			assert.Equal(t, si.Get(iterator.Key()), iterator.Value())
+			prev = iterator.Key()
+			count++
+		}
+		assert.Equal(t, 200, count)
+
+		// 重新回到起点
+		iterator.Rewind()
+		assert.True(t, iterator.Valid())
+		iterator.Close()
+	}
+
+	si := NewShardedIndex(ART, 8)
+	for i := 0; i < 200; i++ {
+		si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iterator := si.Iterator(true)
+	var prev []byte
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if prev != nil {
+			assert.True(t, bytes.Compare(prev, iterator.Key()) > 0)
+		}
+		prev = iterator.Key()
+		count++
+	}
+	assert.Equal(t, 200, count)
+	iterator.Close()
+
+	// 空索引
+	iterator = NewShardedIndex(ART, 8).Iterator(false)
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+}
+
+func TestShardedIndex_PutBatch(t *testing.T) {
+	si := NewShardedIndex(ART, 4)
+	var keys [][]byte
+	var positions []*data.LogRecordPos
+	for i := 0; i < 100; i++ {
+		keys = append(keys, utils.GetTestKey(i))
+		positions = append(positions, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.True(t, si.PutBatch(keys, positions))
+	assert.Equal(t, 100, si.Size())
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, int64(i), si.Get(utils.GetTestKey(i)).Offset)
+	}
+
+	assert.True(t, si.DeleteBatch(keys[:50]))
+	assert.Equal(t, 50, si.Size())
+	assert.Nil(t, si.Get(utils.GetTestKey(0)))
+}
+
+func TestShardedIndex_IteratorSnapshot(t *testing.T) {
+	for _, shardType := range []IndexerType{Btree, ART} {
+		si := NewShardedIndex(shardType, 4)
+		for i := 0; i < 100; i++ {
+			si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		iterator := si.Iterator(false)
+		// 创建迭代器之后的写入和删除不会被看到
+		for i := 0; i < 100; i++ {
+			if i%2 == 0 {
+				si.Delete(utils.GetTestKey(i))
+			} else {
+				si.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+			}
+		}
+		si.Put(utils.GetTestKey(100), &data.LogRecordPos{Fid: 2, Offset: 100})
+
+		var count int
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			assert.Equal(t, uint32(1), iterator.Value().Fid)
+			count++
+		}
+		assert.Equal(t, 100, count)
+		iterator.Close()
+	}
+}
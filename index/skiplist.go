@@ -0,0 +1,553 @@
+package index
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// 跳表的最大层数，每一层的节点数是下一层的 1/4，足够索引千万级别的 key
+	skipListMaxLevel = 18
+
+	// 节点出现在上一层的概率
+	skipListP = 4
+
+	// 为快照保留的旧版本和已删除节点超过有效 key 数量的 1/skipListGarbageRatio 时，关闭迭代器时清理一次
+	skipListGarbageRatio = 16
+)
+
+// SkipList 无锁的并发跳表
+// 读取只会原子地读取指针，不会被写入阻塞；插入通过 CAS 把新节点链接到每一层
+// 每次写入和删除都会给节点压入一个带序号的新版本，迭代器创建时记下当前的序号作为快照，只读取不晚于这个序号的版本，
+// 旧的版本和已删除的节点只在还有快照需要时保留，没有快照需要时删除的节点会通过 CAS 标记每一层的后继指针并从跳表中摘除
+type SkipList struct {
+	head *skipNode
+	// 当前的最大层数
+	height atomic.Int32
+	// 有效的 key 的数量
+	size atomic.Int64
+	// 每次写入和删除加一，作为新版本的序号
+	clock atomic.Uint64
+
+	// 正在使用的快照的序号及其数量，snapCount 为 0 时写入不需要加锁
+	snapLock  sync.Mutex
+	snapshots map[uint64]int
+	snapCount atomic.Int32
+	// 为快照保留下来的旧版本和已删除节点的大致数量
+	garbage atomic.Int64
+}
+
+type skipNode struct {
+	key []byte
+	// 最新的版本，更早的版本通过 prev 链接
+	version atomic.Pointer[skipVersion]
+	next    []atomic.Pointer[skipRef]
+}
+
+// 节点的一个版本，除了 prev 之外创建之后不会再修改
+type skipVersion struct {
+	// 为空表示 key 在这个版本被删除
+	pos *data.LogRecordPos
+	seq uint64
+	// 为 true 表示节点已经从跳表中删除，不能再压入新的版本
+	removed bool
+	// 更早的版本，没有快照需要时会被截断
+	prev atomic.Pointer[skipVersion]
+}
+
+// 节点某一层的后继指针，创建之后不会再修改，通过替换整个对象来修改后继节点或者打上删除标记
+type skipRef struct {
+	node *skipNode
+	// 为 true 表示持有这个指针的节点已经被删除，后继指针不能再被修改
+	marked bool
+}
+
+// NewSkipList 初始化跳表索引
+func NewSkipList() *SkipList {
+	sl := &SkipList{head: newSkipNode(nil, skipListMaxLevel), snapshots: make(map[uint64]int)}
+	sl.height.Store(1)
+	return sl
+}
+
+func newSkipNode(key []byte, level int) *skipNode {
+	node := &skipNode{key: key, next: make([]atomic.Pointer[skipRef], level)}
+	for i := range node.next {
+		node.next[i].Store(&skipRef{})
+	}
+	return node
+}
+
+// 节点在第 level 层的后继节点
+func (n *skipNode) nextNode(level int) *skipNode {
+	return n.next[level].Load().node
+}
+
+// 节点是否已经被摘除，以最底层的标记为准
+func (n *skipNode) deleted() bool {
+	return n.next[0].Load().marked
+}
+
+// 序号为 seq 的快照能看到的位置信息，不存在或者已经删除时返回空
+func (n *skipNode) visible(seq uint64) *data.LogRecordPos {
+	v := n.version.Load()
+	for v != nil && v.seq > seq {
+		v = v.prev.Load()
+	}
+	if v == nil {
+		return nil
+	}
+	return v.pos
+}
+
+// Put 向索引中存储 key 对应的数据位置的信息
+func (sl *SkipList) Put(key []byte, pos *data.LogRecordPos) bool {
+	var preds, succs [skipListMaxLevel]*skipNode
+	var node *skipNode
+	for {
+		if found := sl.findSplice(key, &preds, &succs); found != nil {
+			old := found.version.Load()
+			if old.removed {
+				// 节点正在被删除，帮忙把它摘除之后插入新的节点
+				sl.unlink(found, &preds, &succs)
+				continue
+			}
+			if !found.version.CompareAndSwap(old, sl.newVersion(pos, old)) {
+				continue
+			}
+			if old.pos == nil {
+				sl.size.Add(1)
+			}
+			return true
+		}
+
+		if node == nil {
+			// 拷贝 key，避免调用方之后修改传入的切片
+			node = newSkipNode(append(make([]byte, 0, len(key)), key...), sl.randomLevel())
+		}
+		// 每次尝试都使用新的序号，保证链接时的版本不早于已经存在的快照
+		node.version.Store(sl.newVersion(pos, nil))
+		for i := range node.next {
+			node.next[i].Store(&skipRef{node: succs[i]})
+		}
+		// 链接到最底层之后这个 key 就可见了，失败说明前一个节点的后继发生了变化，重新查找
+		if !casNext(preds[0], 0, succs[0], node) {
+			continue
+		}
+		sl.size.Add(1)
+		sl.linkUpper(node, &preds, &succs)
+		return true
+	}
+}
+
+// 创建一个新的版本，old 只在还有快照可能需要时保留
+func (sl *SkipList) newVersion(pos *data.LogRecordPos, old *skipVersion) *skipVersion {
+	v := &skipVersion{pos: pos, seq: sl.clock.Add(1)}
+	if old == nil {
+		return v
+	}
+	oldest, ok := sl.oldestSnapshot()
+	if !ok {
+		return v
+	}
+	// 最老的快照能看到的版本之前的版本已经没有快照需要
+	trimVersions(old, oldest)
+	// old 早于所有快照并且是删除的版本时，快照读到它和读不到版本的结果一样，也不需要保留
+	if old.seq > oldest || old.pos != nil {
+		v.prev.Store(old)
+		sl.garbage.Add(1)
+	}
+	return v
+}
+
+// 截断序号为 oldest 的快照能看到的版本之前的所有版本
+func trimVersions(v *skipVersion, oldest uint64) {
+	for v != nil && v.seq > oldest {
+		v = v.prev.Load()
+	}
+	if v != nil && v.prev.Load() != nil {
+		v.prev.Store(nil)
+	}
+}
+
+// 依次把节点链接到上面的层，失败时重新查找这一层的前后节点，节点被删除之后就不再继续链接
+func (sl *SkipList) linkUpper(node *skipNode, preds, succs *[skipListMaxLevel]*skipNode) {
+	for i := 1; i < len(node.next); i++ {
+		for {
+			ref := node.next[i].Load()
+			if ref.marked {
+				return
+			}
+			if ref.node != succs[i] && !node.next[i].CompareAndSwap(ref, &skipRef{node: succs[i]}) {
+				continue
+			}
+			if casNext(preds[i], i, succs[i], node) {
+				// 链接的同时节点被删除了，删除时的查找可能已经错过这一层，重新查找一次把它摘除
+				if node.deleted() {
+					sl.findSplice(node.key, preds, succs)
+					return
+				}
+				break
+			}
+			if sl.findSplice(node.key, preds, succs) != node {
+				// 节点已经被删除并摘除
+				return
+			}
+		}
+	}
+}
+
+// 在前一个节点没有被删除并且后继仍然是 expected 时，把后继修改为 node
+func casNext(pred *skipNode, level int, expected, node *skipNode) bool {
+	ref := pred.next[level].Load()
+	if ref.marked || ref.node != expected {
+		return false
+	}
+	return pred.next[level].CompareAndSwap(ref, &skipRef{node: node})
+}
+
+// Get 根据 key 值取出对应的索引信息
+func (sl *SkipList) Get(key []byte) *data.LogRecordPos {
+	node := sl.findGreaterOrEqual(key)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return nil
+	}
+	return node.version.Load().pos
+}
+
+// Delete 根据 key 值删除对应的索引
+func (sl *SkipList) Delete(key []byte) bool {
+	var preds, succs [skipListMaxLevel]*skipNode
+	for {
+		node := sl.findSplice(key, &preds, &succs)
+		if node == nil {
+			return false
+		}
+		old := node.version.Load()
+		if old.removed {
+			sl.unlink(node, &preds, &succs)
+			continue
+		}
+		if old.pos == nil {
+			// 已经删除，节点只是为了快照保留下来
+			return false
+		}
+		tombstone := sl.newVersion(nil, old)
+		if !node.version.CompareAndSwap(old, tombstone) {
+			continue
+		}
+		sl.size.Add(-1)
+		sl.remove(node, tombstone, &preds, &succs)
+		return true
+	}
+}
+
+// 没有快照能看到 tombstone 之前的版本时，把节点从跳表中摘除，返回是否摘除
+func (sl *SkipList) remove(node *skipNode, tombstone *skipVersion, preds, succs *[skipListMaxLevel]*skipNode) bool {
+	if oldest, ok := sl.oldestSnapshot(); ok && oldest < tombstone.seq {
+		sl.garbage.Add(1)
+		return false
+	}
+	// 替换为删除标记之后就不能再压入新的版本，同时写入的协程会重新插入新的节点
+	if !node.version.CompareAndSwap(tombstone, &skipVersion{seq: tombstone.seq, removed: true}) {
+		return false
+	}
+	sl.unlink(node, preds, succs)
+	return true
+}
+
+// 从上往下标记节点每一层的后继指针，再重新查找一次把节点从每一层摘除
+func (sl *SkipList) unlink(node *skipNode, preds, succs *[skipListMaxLevel]*skipNode) {
+	for i := len(node.next) - 1; i >= 0; i-- {
+		for {
+			ref := node.next[i].Load()
+			if ref.marked || node.next[i].CompareAndSwap(ref, &skipRef{node: ref.node, marked: true}) {
+				break
+			}
+		}
+	}
+	sl.findSplice(node.key, preds, succs)
+}
+
+// PutBatch 批量存储 key 对应的数据位置的信息
+func (sl *SkipList) PutBatch(keys [][]byte, positions []*data.LogRecordPos) bool {
+	for i, key := range keys {
+		sl.Put(key, positions[i])
+	}
+	return true
+}
+
+// DeleteBatch 批量删除 key 对应的索引
+func (sl *SkipList) DeleteBatch(keys [][]byte) bool {
+	for _, key := range keys {
+		sl.Delete(key)
+	}
+	return true
+}
+
+// Size 返回有效的 key 的数量
+func (sl *SkipList) Size() int {
+	return int(sl.size.Load())
+}
+
+// Close 关闭索引
+func (sl *SkipList) Close() error {
+	return nil
+}
+
+// Iterator 返回迭代器，迭代器只能看到创建时的数据，遍历期间的写入不会被看到
+func (sl *SkipList) Iterator(reverse bool) Iterator {
+	sli := &skipListIterator{list: sl, reverse: reverse, seq: sl.acquireSnapshot()}
+	// 迭代器没有被关闭就被回收时释放快照，避免旧版本一直被保留
+	runtime.SetFinalizer(sli, (*skipListIterator).Close)
+	sli.Rewind()
+	return sli
+}
+
+// 注册一个快照，返回快照的序号
+// 先增加计数再读取序号，同时写入的协程要么看到计数并等待注册完成，要么它的序号不晚于快照的序号
+func (sl *SkipList) acquireSnapshot() uint64 {
+	sl.snapLock.Lock()
+	defer sl.snapLock.Unlock()
+	sl.snapCount.Add(1)
+	seq := sl.clock.Load()
+	sl.snapshots[seq]++
+	return seq
+}
+
+// 释放快照，保留的旧数据足够多时清理一次
+func (sl *SkipList) releaseSnapshot(seq uint64) {
+	sl.snapLock.Lock()
+	if sl.snapshots[seq]--; sl.snapshots[seq] == 0 {
+		delete(sl.snapshots, seq)
+	}
+	sl.snapCount.Add(-1)
+	sl.snapLock.Unlock()
+
+	if garbage := sl.garbage.Load(); garbage > 0 && garbage*skipListGarbageRatio >= sl.size.Load() {
+		sl.collect()
+	}
+}
+
+// 最老的快照的序号，没有快照时返回 false
+func (sl *SkipList) oldestSnapshot() (uint64, bool) {
+	if sl.snapCount.Load() == 0 {
+		return 0, false
+	}
+	sl.snapLock.Lock()
+	defer sl.snapLock.Unlock()
+	var oldest uint64
+	found := false
+	for seq := range sl.snapshots {
+		if !found || seq < oldest {
+			oldest, found = seq, true
+		}
+	}
+	return oldest, found
+}
+
+// 截断不再有快照需要的旧版本，摘除没有快照能看到的已删除节点
+func (sl *SkipList) collect() {
+	sl.garbage.Store(0)
+	var preds, succs [skipListMaxLevel]*skipNode
+	var retained int64
+	for node := sl.head.nextNode(0); node != nil; node = node.nextNode(0) {
+		v := node.version.Load()
+		if v.removed {
+			continue
+		}
+		// 读取版本之后才读取快照，之后注册的快照的序号不会早于这个版本
+		oldest, ok := sl.oldestSnapshot()
+		if !ok {
+			oldest = math.MaxUint64
+		}
+		trimVersions(v, oldest)
+		if v.prev.Load() != nil {
+			retained++
+		}
+		if v.pos == nil {
+			sl.remove(node, v, &preds, &succs)
+		}
+	}
+	sl.garbage.Add(retained)
+}
+
+// 查找 key 在每一层的前后节点，key 已经存在并且没有被摘除时返回对应的节点
+// 查找过程中会把遇到的已经被摘除的节点从这一层摘除，摘除失败说明前一个节点也发生了变化，从头重新查找
+func (sl *SkipList) findSplice(key []byte, preds, succs *[skipListMaxLevel]*skipNode) *skipNode {
+retry:
+	prev := sl.head
+	for i := skipListMaxLevel - 1; i >= 0; i-- {
+		prevRef := prev.next[i].Load()
+		next := prevRef.node
+		for next != nil {
+			nextRef := next.next[i].Load()
+			if nextRef.marked {
+				ref := &skipRef{node: nextRef.node}
+				if prevRef.marked || !prev.next[i].CompareAndSwap(prevRef, ref) {
+					goto retry
+				}
+				prevRef, next = ref, ref.node
+				continue
+			}
+			if bytes.Compare(next.key, key) >= 0 {
+				break
+			}
+			prev, prevRef, next = next, nextRef, nextRef.node
+		}
+		preds[i], succs[i] = prev, next
+	}
+	if next := succs[0]; next != nil && bytes.Equal(next.key, key) {
+		return next
+	}
+	return nil
+}
+
+// 查找第一个大于等于 key 并且没有被删除的节点，只读取不修改跳表
+func (sl *SkipList) findGreaterOrEqual(key []byte) *skipNode {
+	prev := sl.head
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
+		next := prev.nextNode(i)
+		for next != nil && bytes.Compare(next.key, key) < 0 {
+			prev = next
+			next = prev.nextNode(i)
+		}
+		if i == 0 {
+			for next != nil && next.deleted() {
+				next = next.nextNode(0)
+			}
+			return next
+		}
+	}
+	return nil
+}
+
+// 查找最后一个小于 key 的节点，key 为空时查找最后一个节点，不存在时返回空
+// 返回的节点可能已经被删除，由调用方继续向前查找
+func (sl *SkipList) findLessThan(key []byte) *skipNode {
+	prev := sl.head
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
+		next := prev.nextNode(i)
+		for next != nil && (key == nil || bytes.Compare(next.key, key) < 0) {
+			prev = next
+			next = prev.nextNode(i)
+		}
+	}
+	if prev == sl.head {
+		return nil
+	}
+	return prev
+}
+
+// 随机生成新节点的层数，并在需要时提高跳表的层数
+func (sl *SkipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Intn(skipListP) == 0 {
+		level++
+	}
+	for {
+		height := sl.height.Load()
+		if int(height) >= level || sl.height.CompareAndSwap(height, int32(level)) {
+			return level
+		}
+	}
+}
+
+// 跳表索引迭代器，直接在跳表上移动，不需要拷贝数据，只读取快照序号之前的版本
+// 反向遍历时每一步都从上层重新查找前一个节点
+type skipListIterator struct {
+	list    *SkipList
+	reverse bool
+	seq     uint64
+	closed  bool
+	curr    *skipNode
+	// 移动到当前节点时读取的位置信息
+	pos *data.LogRecordPos
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (sli *skipListIterator) Rewind() {
+	if sli.reverse {
+		sli.moveBackward(sli.list.findLessThan(nil))
+	} else {
+		sli.moveForward(sli.list.head.nextNode(0))
+	}
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (sli *skipListIterator) Seek(key []byte) {
+	node := sli.list.findGreaterOrEqual(key)
+	if !sli.reverse {
+		sli.moveForward(node)
+		return
+	}
+	if node == nil || !bytes.Equal(node.key, key) {
+		node = sli.list.findLessThan(key)
+	}
+	sli.moveBackward(node)
+}
+
+// Next 跳转到下一个 key
+func (sli *skipListIterator) Next() {
+	if sli.curr == nil {
+		return
+	}
+	if sli.reverse {
+		sli.moveBackward(sli.list.findLessThan(sli.curr.key))
+	} else {
+		// 被摘除的节点的后继指针保持不变，仍然可以沿着它继续遍历
+		sli.moveForward(sli.curr.nextNode(0))
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (sli *skipListIterator) Valid() bool {
+	return sli.curr != nil
+}
+
+// Key 当前遍历位置的 Key 数据
+func (sli *skipListIterator) Key() []byte {
+	return sli.curr.key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (sli *skipListIterator) Value() *data.LogRecordPos {
+	return sli.pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (sli *skipListIterator) Close() {
+	sli.curr = nil
+	sli.pos = nil
+	if !sli.closed {
+		sli.closed = true
+		runtime.SetFinalizer(sli, nil)
+		sli.list.releaseSnapshot(sli.seq)
+	}
+}
+
+// 从 node 开始向后找到第一个在快照中存在的节点
+func (sli *skipListIterator) moveForward(node *skipNode) {
+	for ; node != nil; node = node.nextNode(0) {
+		if pos := node.visible(sli.seq); pos != nil {
+			sli.curr, sli.pos = node, pos
+			return
+		}
+	}
+	sli.curr, sli.pos = nil, nil
+}
+
+// 从 node 开始向前找到第一个在快照中存在的节点
+func (sli *skipListIterator) moveBackward(node *skipNode) {
+	for ; node != nil; node = sli.list.findLessThan(node.key) {
+		if pos := node.visible(sli.seq); pos != nil {
+			sli.curr, sli.pos = node, pos
+			return
+		}
+	}
+	sli.curr, sli.pos = nil, nil
+}
@@ -0,0 +1,266 @@
+package index
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	sl := NewSkipList()
+	assert.Nil(t, sl.Get([]byte("key")))
+	assert.False(t, sl.Delete([]byte("key")))
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, sl.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	assert.Equal(t, 1000, sl.Size())
+	assert.Equal(t, int64(10), sl.Get(utils.GetTestKey(10)).Offset)
+
+	// 覆盖写入不会改变数量
+	assert.True(t, sl.Put(utils.GetTestKey(10), &data.LogRecordPos{Fid: 2, Offset: 1}))
+	assert.Equal(t, uint32(2), sl.Get(utils.GetTestKey(10)).Fid)
+	assert.Equal(t, 1000, sl.Size())
+
+	assert.True(t, sl.Delete(utils.GetTestKey(10)))
+	assert.False(t, sl.Delete(utils.GetTestKey(10)))
+	assert.Nil(t, sl.Get(utils.GetTestKey(10)))
+	assert.Equal(t, 999, sl.Size())
+
+	// 删除之后重新写入
+	assert.True(t, sl.Put(utils.GetTestKey(10), &data.LogRecordPos{Fid: 3, Offset: 1}))
+	assert.Equal(t, uint32(3), sl.Get(utils.GetTestKey(10)).Fid)
+	assert.Equal(t, 1000, sl.Size())
+
+	assert.True(t, sl.DeleteBatch([][]byte{utils.GetTestKey(0), utils.GetTestKey(1), []byte("unknown")}))
+	assert.Equal(t, 998, sl.Size())
+}
+
+func TestSkipList_Iterator(t *testing.T) {
+	sl := NewSkipList()
+	iterator := sl.Iterator(false)
+	assert.False(t, iterator.Valid())
+	iterator = sl.Iterator(true)
+	assert.False(t, iterator.Valid())
+
+	for i := 0; i < 100; i++ {
+		sl.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	// 被删除的 key 不会被遍历到
+	sl.Delete(utils.GetTestKey(0))
+	sl.Delete(utils.GetTestKey(50))
+	sl.Delete(utils.GetTestKey(99))
+
+	for _, reverse := range []bool{false, true} {
+		iterator := sl.Iterator(reverse)
+		var count int
+		var prev []byte
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			if prev != nil {
+				cmp := bytes.Compare(prev, iterator.Key())
+				assert.True(t, (cmp < 0) != reverse)
+			}
+			prev = iterator.Key()
+			assert.Equal(t, sl.Get(iterator.Key()), iterator.Value())
+			count++
+		}
+		assert.Equal(t, 97, count)
+		iterator.Close()
+	}
+}
+
+func TestSkipList_IteratorSeek(t *testing.T) {
+	sl := NewSkipList()
+	for _, key := range []string{"aa", "bb", "cc", "dd"} {
+		sl.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	iterator := sl.Iterator(false)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("bb"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+
+	// 反向遍历时找到第一个小于等于的 key
+	iterator = sl.Iterator(true)
+	iterator.Seek([]byte("bc"))
+	assert.Equal(t, []byte("bb"), iterator.Key())
+	iterator.Next()
+	assert.Equal(t, []byte("aa"), iterator.Key())
+	iterator.Seek([]byte("cc"))
+	assert.Equal(t, []byte("cc"), iterator.Key())
+	iterator.Seek([]byte("zz"))
+	assert.Equal(t, []byte("dd"), iterator.Key())
+	iterator.Seek([]byte("a"))
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+}
+
+func TestSkipList_Concurrent(t *testing.T) {
+	sl := NewSkipList()
+	var wg sync.WaitGroup
+	// 多个协程同时写入相互交错的 key，同时有协程在读取和遍历
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 4000; i += 4 {
+				sl.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+				if i%3 == 0 {
+					sl.Delete(utils.GetTestKey(i))
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			iterator := sl.Iterator(n%2 == 0)
+			var prev []byte
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				if prev != nil {
+					assert.NotEqual(t, 0, bytes.Compare(prev, iterator.Key()))
+				}
+				prev = iterator.Key()
+			}
+			sl.Get(utils.GetTestKey(n))
+		}
+	}()
+	wg.Wait()
+
+	var count int
+	for i := 0; i < 4000; i++ {
+		pos := sl.Get(utils.GetTestKey(i))
+		if i%3 == 0 {
+			assert.Nil(t, pos)
+		} else {
+			assert.Equal(t, int64(i), pos.Offset)
+			count++
+		}
+	}
+	assert.Equal(t, count, sl.Size())
+
+	iterator := sl.Iterator(false)
+	var keys int
+	var prev []byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if prev != nil {
+			assert.True(t, bytes.Compare(prev, iterator.Key()) < 0)
+		}
+		prev = iterator.Key()
+		keys++
+	}
+	assert.Equal(t, count, keys)
+
+	// 每一层都是有序的
+	for i := 0; i < skipListMaxLevel; i++ {
+		for node := sl.head.nextNode(i); node != nil; node = node.nextNode(i) {
+			// 删除完成之后节点已经从每一层摘除
+			assert.False(t, node.deleted())
+			if next := node.nextNode(i); next != nil {
+				assert.True(t, bytes.Compare(node.key, next.key) < 0)
+			}
+		}
+	}
+}
+
+func TestSkipList_DeleteUnlink(t *testing.T) {
+	sl := NewSkipList()
+	for n := 0; n < 10; n++ {
+		for i := 0; i < 1000; i++ {
+			sl.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		for i := 0; i < 1000; i++ {
+			if i%10 != 0 {
+				assert.True(t, sl.Delete(utils.GetTestKey(i)))
+			}
+		}
+	}
+	assert.Equal(t, 100, sl.Size())
+
+	// 被删除的节点不会留在任何一层中
+	for i := 0; i < skipListMaxLevel; i++ {
+		for node := sl.head.nextNode(i); node != nil; node = node.nextNode(i) {
+			assert.False(t, node.deleted())
+		}
+	}
+	var nodes int
+	for node := sl.head.nextNode(0); node != nil; node = node.nextNode(0) {
+		nodes++
+	}
+	assert.Equal(t, 100, nodes)
+}
+
+func TestSkipList_PutCopyKey(t *testing.T) {
+	sl := NewSkipList()
+	key := []byte("key-a")
+	sl.Put(key, &data.LogRecordPos{Fid: 1, Offset: 1})
+	// 修改调用方的切片不会影响跳表中的 key
+	key[4] = 'z'
+	assert.NotNil(t, sl.Get([]byte("key-a")))
+	assert.Nil(t, sl.Get(key))
+
+	iterator := sl.Iterator(false)
+	assert.Equal(t, []byte("key-a"), iterator.Key())
+	iterator.Close()
+}
+
+func TestSkipList_Snapshot(t *testing.T) {
+	sl := NewSkipList()
+	rnd := rand.New(rand.NewSource(2))
+	expected := make(map[string]int64)
+	type snapshot struct {
+		iterator Iterator
+		want     map[string]int64
+	}
+	var snapshots []snapshot
+	for i := 0; i < 5000; i++ {
+		key := []byte{byte('a' + rnd.Intn(4)), byte('a' + rnd.Intn(4))}
+		key = key[:1+rnd.Intn(2)]
+		if rnd.Intn(3) == 0 {
+			sl.Delete(key)
+			delete(expected, string(key))
+		} else {
+			sl.Put(key, &data.LogRecordPos{Offset: int64(i)})
+			expected[string(key)] = int64(i)
+		}
+		if i%500 == 0 {
+			want := make(map[string]int64, len(expected))
+			for k, v := range expected {
+				want[k] = v
+			}
+			snapshots = append(snapshots, snapshot{iterator: sl.Iterator(i%1000 == 0), want: want})
+		}
+	}
+	for _, snap := range snapshots {
+		got := make(map[string]int64)
+		for snap.iterator.Rewind(); snap.iterator.Valid(); snap.iterator.Next() {
+			got[string(snap.iterator.Key())] = snap.iterator.Value().Offset
+		}
+		assert.Equal(t, snap.want, got)
+		snap.iterator.Close()
+	}
+	assert.Equal(t, len(expected), sl.Size())
+	for k, v := range expected {
+		assert.Equal(t, v, sl.Get([]byte(k)).Offset)
+	}
+
+	// 所有快照关闭之后，旧版本和已删除的节点都会被清理
+	var nodes int
+	for node := sl.head.nextNode(0); node != nil; node = node.nextNode(0) {
+		assert.Nil(t, node.version.Load().prev.Load())
+		assert.NotNil(t, node.version.Load().pos)
+		nodes++
+	}
+	assert.Equal(t, len(expected), nodes)
+}
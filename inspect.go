@@ -0,0 +1,191 @@
+package LustreDB
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// InspectFileKind 被查看的文件的类型
+type InspectFileKind int8
+
+const (
+	// InspectDataFile 数据文件 000000001.lx
+	InspectDataFile InspectFileKind = iota + 1
+
+	// InspectHintFile merge 生成的 hint 文件，数据部分是记录的位置
+	InspectHintFile
+
+	// InspectMergeFile merge 完成的标识文件，数据部分是没有参与 merge 的文件 id
+	InspectMergeFile
+
+	// InspectSeqNoFile 保存事务序列号的文件
+	InspectSeqNoFile
+)
+
+func (k InspectFileKind) String() string {
+	switch k {
+	case InspectDataFile:
+		return "data"
+	case InspectHintFile:
+		return "hint"
+	case InspectMergeFile:
+		return "merge"
+	case InspectSeqNoFile:
+		return "seq-no"
+	default:
+		return "unknown"
+	}
+}
+
+// InspectOptions 查看文件时的过滤条件
+type InspectOptions struct {
+	// 只输出 key 等于此值的记录，为空表示不过滤
+	Key []byte
+
+	// 只输出这些类型的记录，为空表示不过滤
+	Types []data.LogRecordType
+}
+
+// InspectedFile 被查看的文件的信息
+type InspectedFile struct {
+	Kind InspectFileKind
+
+	// 数据文件的格式版本，其他文件都是 FileFormatV0
+	Version uint16
+
+	// 数据文件使用的 crc 算法
+	Checksum data.ChecksumType
+}
+
+// InspectedRecord 文件中的一条原始记录
+type InspectedRecord struct {
+	// 记录在文件中的偏移
+	Offset int64
+
+	// 记录编码之后的长度，头部损坏时为 0
+	Size int64
+
+	Type data.LogRecordType
+
+	// 事务序列号，不在事务中的记录为 0
+	Seq uint64
+
+	// 去掉事务序列号之后的 key
+	Key []byte
+
+	// value 的长度
+	ValueSize int
+
+	// hint 文件中记录指向的位置
+	Pos *data.LogRecordPos
+
+	// merge 和 seq-no 文件中保存的值
+	Value []byte
+
+	// 读取记录的错误，为空表示 crc 校验通过
+	Err error
+}
+
+// InspectFile 依次读取文件中的每一条记录，交给 fn 处理，fn 返回 false 时停止读取
+// 支持数据文件以及 hint、merge 和 seq-no 文件，根据文件名判断文件的类型
+// 遇到损坏的记录时会继续读取之后的记录，头部损坏或者记录不完整时停止
+func InspectFile(path string, opts InspectOptions, fn func(record *InspectedRecord) bool) (*InspectedFile, error) {
+	dirPath, name := filepath.Split(path)
+	info := &InspectedFile{Version: data.FileFormatV0, Checksum: data.ChecksumIEEE}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file *data.DataFile
+	switch {
+	case strings.HasSuffix(name, data.DataFileNameSuffix):
+		info.Kind = InspectDataFile
+		fid, err := strconv.ParseUint(strings.TrimSuffix(name, data.DataFileNameSuffix), 10, 32)
+		if err != nil {
+			return nil, utils.ErrUnsupportedFileFormat
+		}
+		// 以只读方式打开，不会修改文件，也不会创建不存在的文件
+		file, err = data.OpenDataFileReadOnly(dirPath, uint32(fid))
+		if err != nil {
+			return nil, err
+		}
+		info.Version = file.Version
+		info.Checksum = file.Checksum
+	case name == data.HintFileName:
+		info.Kind = InspectHintFile
+		file, err = data.OpenFileReadOnly(path, 0)
+	case name == data.MergeFileName:
+		info.Kind = InspectMergeFile
+		file, err = data.OpenFileReadOnly(path, 0)
+	case name == data.SeqNoName:
+		info.Kind = InspectSeqNoFile
+		file, err = data.OpenFileReadOnly(path, 0)
+	default:
+		return nil, utils.ErrUnsupportedFileFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	offset := file.DataOffset()
+	for offset < stat.Size() {
+		record, size, err := file.Read(offset)
+		inspected := &InspectedRecord{Offset: offset, Size: size, Err: err}
+		if err == io.EOF {
+			// 还没有到文件末尾就读不出完整的记录
+			inspected.Err = io.ErrUnexpectedEOF
+		}
+		if record != nil {
+			inspected.Type = record.Type
+			inspected.ValueSize = len(record.Value)
+			inspected.Key = record.Key
+			switch info.Kind {
+			case InspectDataFile:
+				inspected.Key, inspected.Seq = parseLogRecord(record.Key)
+			case InspectHintFile:
+				inspected.Pos = data.DecodeLogRecordPos(record.Value)
+			default:
+				inspected.Value = record.Value
+			}
+		}
+
+		if opts.match(inspected) && !fn(inspected) {
+			break
+		}
+		if size == 0 {
+			break
+		}
+		offset += size
+	}
+	return info, nil
+}
+
+// 记录是否满足过滤条件，头部损坏或者不完整的记录没有 key 和类型，总是满足条件
+func (opts InspectOptions) match(record *InspectedRecord) bool {
+	if record.Size == 0 {
+		return true
+	}
+	if opts.Key != nil && !bytes.Equal(opts.Key, record.Key) {
+		return false
+	}
+	if len(opts.Types) == 0 {
+		return true
+	}
+	for _, typ := range opts.Types {
+		if typ == record.Type {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package LustreDB
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-inspect")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2), []byte("value"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	var records []*InspectedRecord
+	collect := func(record *InspectedRecord) bool {
+		records = append(records, record)
+		return true
+	}
+	info, err := InspectFile(data.GetDataFileName(dir, 0), InspectOptions{}, collect)
+	assert.Nil(t, err)
+	assert.Equal(t, InspectDataFile, info.Kind)
+	assert.Equal(t, data.CurrentFileFormat, info.Version)
+	assert.Equal(t, data.ChecksumCRC32C, info.Checksum)
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, int64(data.FileHeaderSize), records[0].Offset)
+	assert.Equal(t, data.LogRecordNormal, records[0].Type)
+	assert.Equal(t, utils.GetTestKey(1), records[0].Key)
+	assert.Equal(t, data.LogRecordDelete, records[1].Type)
+	assert.Equal(t, records[0].Offset+records[0].Size, records[1].Offset)
+	assert.Equal(t, uint64(1), records[2].Seq)
+	assert.Equal(t, 5, records[2].ValueSize)
+	assert.Equal(t, data.LogRecordFinish, records[3].Type)
+	assert.Equal(t, txnFinKey, records[3].Key)
+	for _, record := range records {
+		assert.Nil(t, record.Err)
+	}
+
+	// 按照 key 和类型过滤
+	records = nil
+	_, err = InspectFile(data.GetDataFileName(dir, 0), InspectOptions{
+		Key:   utils.GetTestKey(1),
+		Types: []data.LogRecordType{data.LogRecordDelete},
+	}, collect)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, data.LogRecordDelete, records[0].Type)
+
+	records = nil
+	info, err = InspectFile(filepath.Join(dir, data.SeqNoName), InspectOptions{}, collect)
+	assert.Nil(t, err)
+	assert.Equal(t, InspectSeqNoFile, info.Kind)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, []byte("1"), records[0].Value)
+
+	// 改坏第一条记录，后面的记录还能读取
+	name := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	buf[data.FileHeaderSize+10] ^= 0xff
+	err = os.WriteFile(name, buf, 0644)
+	assert.Nil(t, err)
+	records = nil
+	_, err = InspectFile(name, InspectOptions{}, collect)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, utils.ErrorIncorrectCrc, records[0].Err)
+	assert.Nil(t, records[1].Err)
+
+	_, err = InspectFile(filepath.Join(dir, "unknown"), InspectOptions{}, collect)
+	assert.NotNil(t, err)
+}
+
+func TestInspectFile_Hint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-inspect-hint")
+	opts.DirPath = dir
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+
+	var records []*InspectedRecord
+	info, err := InspectFile(filepath.Join(dir, data.HintFileName), InspectOptions{}, func(record *InspectedRecord) bool {
+		records = append(records, record)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, InspectHintFile, info.Kind)
+	assert.Equal(t, 10, len(records))
+	for _, record := range records {
+		assert.NotNil(t, record.Pos)
+		assert.Equal(t, db.index.Get(record.Key), record.Pos)
+	}
+}
+
+func TestInspectFile_ReadOnly(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-inspect-read-only")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 不存在的文件返回错误，不会被创建
+	for _, name := range []string{data.GetDataFileName(dir, 1), filepath.Join(dir, data.HintFileName)} {
+		_, err := InspectFile(name, InspectOptions{}, func(record *InspectedRecord) bool {
+			return true
+		})
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(name)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// 空文件不会被写入头部
+	name := data.GetDataFileName(dir, 2)
+	assert.Nil(t, os.WriteFile(name, nil, 0644))
+	_, err := InspectFile(name, InspectOptions{}, func(record *InspectedRecord) bool {
+		return true
+	})
+	assert.Nil(t, err)
+	stat, err := os.Stat(name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+}
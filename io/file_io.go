@@ -22,6 +22,16 @@ func NewFileIOManager(fileName string) (*FileIO, error) {
 	return &FileIO{fo: file}, nil
 }
 
+// NewReadOnlyFileIOManager 以只读方式打开已经存在的文件，文件不存在时返回错误，写入会失败
+func NewReadOnlyFileIOManager(fileName string) (*FileIO, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileIO{fo: file}, nil
+}
+
 // 封装系统 io 方便后续调用不同的 io 类型
 // 如接入 mmap 等
 
@@ -48,3 +58,7 @@ func (f *FileIO) Size() (int64, error) {
 	}
 	return stat.Size(), nil
 }
+
+func (f *FileIO) Truncate(size int64) error {
+	return f.fo.Truncate(size)
+}
@@ -19,8 +19,16 @@ type IOManager interface {
 
 	// Size 获取文件的大小
 	Size() (int64, error)
+
+	// Truncate 把文件截断到给定的大小，用于回滚写入失败时留下的部分数据
+	Truncate(int64) error
 }
 
 func NewIOManager(fileName string) (IOManager, error) {
 	return NewFileIOManager(fileName)
 }
+
+// NewReadOnlyIOManager 只读的 IO 管理器，用于检查和查看文件的工具
+func NewReadOnlyIOManager(fileName string) (IOManager, error) {
+	return NewReadOnlyFileIOManager(fileName)
+}
@@ -10,14 +10,27 @@ type Iterator struct {
 
 	db *DB
 
+	// 创建时持有引用的数据文件，merge 替换数据文件之后仍然可以读取快照中的位置，Close 时释放
+	files *fileView
+
 	options IteratorOptions
 }
 
+// NewIterator 创建迭代器，有序遍历时看到的是创建时的数据（B+ 树索引除外），语义见 index.Iterator
+// 迭代器使用完之后需要调用 Close，在这之前 merge 替换掉的数据文件不会被关闭
 func (db *DB) NewIterator(opt IteratorOptions) *Iterator {
-	iterator := db.index.Iterator(opt.Reverse)
+	// 先持有所有文件的引用再创建索引的快照，快照中的位置一定在这些文件或者之后 merge 生成的文件中
+	files := db.pinFiles()
+	var iterator index.Iterator
+	if unordered, ok := db.index.(index.UnorderedIndexer); ok && opt.Unordered {
+		iterator = unordered.UnorderedIterator()
+	} else {
+		iterator = db.index.Iterator(opt.Reverse)
+	}
 	return &Iterator{
 		indexIter: iterator,
 		db:        db,
+		files:     files,
 		options:   opt,
 	}
 }
@@ -25,6 +38,10 @@ func (db *DB) NewIterator(opt IteratorOptions) *Iterator {
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (bti *Iterator) Rewind() {
 	bti.indexIter.Rewind()
+	// 正向遍历时直接定位到前缀的位置，不需要从头开始查找
+	if len(bti.options.Prefix) > 0 && !bti.options.Reverse && !bti.options.Unordered {
+		bti.indexIter.Seek(bti.options.Prefix)
+	}
 	bti.skipToNext()
 }
 
@@ -45,7 +62,7 @@ func (bti *Iterator) Valid() bool {
 	return bti.indexIter.Valid()
 }
 
-// Key 当前遍历位置的 Key 数据
+// Key 当前遍历位置的 Key 数据，返回的切片只能读取，不能修改
 func (bti *Iterator) Key() []byte {
 	return bti.indexIter.Key()
 }
@@ -55,26 +72,43 @@ func (bti *Iterator) Value() ([]byte, error) {
 	value := bti.indexIter.Value()
 	bti.db.lo.RLock()
 	defer bti.db.lo.RUnlock()
-	return bti.db.getValue(value)
+	return bti.db.getValue(bti.files, value)
 }
 
 // Close 关闭迭代器，释放相应资源
 func (bti *Iterator) Close() {
 	bti.indexIter.Close()
+	if bti.files != nil {
+		bti.files.unpin()
+		bti.files = nil
+	}
 }
 
+// 跳过二级索引的内部 key 和不符合前缀的 key
 func (bti *Iterator) skipToNext() {
 	i := len(bti.options.Prefix)
-
-	// 如果i的长度为0那么用户就没有设置prefix
-	if i == 0 {
-		return
-	}
-
-	for ; bti.indexIter.Valid(); bti.indexIter.Next() {
+	for bti.indexIter.Valid() {
 		key := bti.indexIter.Key()
-		if i <= len(key) && bytes.Compare(bti.options.Prefix, key[:i]) == 0 {
+		if isInternalKey(key) {
+			bti.skipInternalKeys()
+			continue
+		}
+		// 如果i的长度为0那么用户就没有设置prefix
+		if i == 0 || (i <= len(key) && bytes.Compare(bti.options.Prefix, key[:i]) == 0) {
 			break
 		}
+		bti.indexIter.Next()
+	}
+}
+
+// 内部 key 是连续的，有序遍历时直接定位到内部 key 之外
+func (bti *Iterator) skipInternalKeys() {
+	switch {
+	case bti.options.Unordered:
+		bti.indexIter.Next()
+	case bti.options.Reverse:
+		bti.indexIter.Seek(secondaryIndexPrefix)
+	default:
+		bti.indexIter.Seek(secondaryIndexPrefixEnd)
 	}
 }
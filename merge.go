@@ -2,6 +2,7 @@ package LustreDB
 
 import (
 	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
 	"github.com/lustresix/lxdb/utils"
 	"io"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"time"
 )
 
 const (
@@ -16,15 +18,27 @@ const (
 	mergeFinish = "-merge_finish"
 )
 
-// Merge 清理无效数据，生成hint文件
+// Merge 清理无效数据，生成hint文件，旧格式的数据文件会被重写为当前的格式
+// merge 完成之后直接用新的数据文件替换旧的数据文件，不需要重新打开数据库
 func (db *DB) Merge() error {
 	// 活跃文件为空，那么直接返回
-	if db.activeFiles == nil {
+	if db.activeFile() == nil {
 		return nil
 	}
 
+	// 等待正在进行的流式写入完成，之后的流式写入都会写到新的活跃文件中
+	db.streamLock.Lock()
 	db.lo.Lock()
 	if db.merged {
+		db.lo.Unlock()
+		db.streamLock.Unlock()
+		return utils.ErrorMergeIsProgress
+	}
+
+	// 上一次 merge 的结果替换时出错，merge 目录需要保留到下次打开时继续替换
+	if _, err := os.Stat(filepath.Join(db.getMergePath(), data.MergeFileName)); err == nil {
+		db.lo.Unlock()
+		db.streamLock.Unlock()
 		return utils.ErrorMergeIsProgress
 	}
 
@@ -33,41 +47,184 @@ func (db *DB) Merge() error {
 		db.merged = false
 	}()
 
-	// 持久化当前活跃文件
-	err := db.activeFiles.Sync()
+	// merge 生成的数据文件使用新的 id，预留在当前活跃文件和新的活跃文件之间
+	// 替换数据文件时新旧文件的 id 不会重复，正在读取旧位置的请求不会读到新文件的数据
+	olderSize, err := db.dataFilesSize()
 	if err != nil {
 		db.lo.Unlock()
+		db.streamLock.Unlock()
 		return err
 	}
-	// 将现在的活跃文件变为旧文件，然后在开一个新的活跃文件
-	db.olderFiles[db.activeFiles.FileId] = db.activeFiles
-	err = db.setActiveData()
+	mergeFid := db.activeFile().FileId + 1
+	noMergedFile := mergeFid + mergeFileIdRange(olderSize, db.options.DataFileSize)
+
+	// 持久化当前活跃文件，将现在的活跃文件变为旧文件，然后在开一个新的活跃文件
+	err = db.rotateActiveFileTo(noMergedFile)
 	if err != nil {
 		db.lo.Unlock()
+		db.streamLock.Unlock()
 		return err
 	}
 
-	noMergedFile := db.activeFiles.FileId
+	// merge 的数据在替换旧文件之前和原来的数据同时存在
+	quota, err := db.mergeDiskQuota(olderSize)
+	if err != nil {
+		db.lo.Unlock()
+		db.streamLock.Unlock()
+		return err
+	}
 
 	// 取出所以需要的 merge 文件
 	var mergeFile []*data.DataFile
-	for _, file := range db.olderFiles {
+	for _, file := range db.olderFiles() {
 		mergeFile = append(mergeFile, file)
 	}
 	db.lo.Unlock()
+	db.streamLock.Unlock()
+
+	db.options.EventListener.OnMergeBegin()
+	start := time.Now()
+	stats := &MergeStats{FileNum: len(mergeFile)}
+	err = db.mergeFiles(mergeFile, mergeFid, noMergedFile, quota, stats)
+	if err != nil {
+		// 没有完成的 merge 目录不会被使用，直接删除，释放占用的空间
+		_ = os.RemoveAll(db.getMergePath())
+	} else {
+		err = db.installMergeFiles()
+	}
+	stats.Duration = time.Since(start)
+	stats.Err = err
+	db.options.EventListener.OnMergeEnd(stats)
+	if err != nil {
+		db.lo.Lock()
+		_ = db.refreshDiskUsage()
+		db.lo.Unlock()
+		return err
+	}
+
+	return db.resumeWrites()
+}
+
+// merge 最多需要的数据文件 id 的数量，size 是旧数据文件的总大小
+// 有效数据不会比旧数据更多，除了最后一个文件，每个文件加上下一条数据都超过了 DataFileSize，所以文件数不超过 2*size/DataFileSize+1
+func mergeFileIdRange(size, dataFileSize int64) uint32 {
+	return uint32(2*size/dataFileSize + 2)
+}
+
+// 所有数据文件的总大小，调用时需要持有锁
+func (db *DB) dataFilesSize() (int64, error) {
+	var total int64
+	for _, file := range db.files.Load().files() {
+		size, err := file.IOManager.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// 在运行中用 merge 目录中的文件替换旧的数据文件
+// 先把新的数据文件加入视图并更新索引，再替换磁盘上的文件，最后从视图中去掉旧的数据文件
+// 旧的数据文件在正在进行的读取和迭代器释放引用之后才会关闭，它们占用的磁盘空间也在那时才真正释放
+func (db *DB) installMergeFiles() error {
+	db.lo.Lock()
+	defer db.lo.Unlock()
+	view := db.files.Load()
+	if view == nil {
+		// 数据库已经关闭了，下次打开时再替换
+		return nil
+	}
+
+	mergePath := db.getMergePath()
+	fid, err := db.NoMergeFinishedFid(mergePath)
+	if err != nil {
+		return err
+	}
+	keys, positions, err := db.readHintFile(mergePath)
+	if err != nil {
+		return err
+	}
+	fileIds, err := getDataFileIds(mergePath)
+	if err != nil {
+		return err
+	}
+	merged := make(map[uint32]*data.DataFile, len(fileIds))
+	for _, fileId := range fileIds {
+		// 文件移动到数据目录之后打开的文件描述符仍然有效
+		file, err := data.OpenDataFile(mergePath, uint32(fileId))
+		if err != nil {
+			for _, f := range merged {
+				_ = f.Close()
+			}
+			return err
+		}
+		merged[uint32(fileId)] = file
+	}
+
+	// 更新索引之前新的数据文件必须已经可以读取
+	db.files.Store(view.replace(merged, nil))
+	// 索引更新失败时新旧文件都留在视图中，读取不受影响，下次打开时会重新替换
+	err = db.applyMergePositions(fid, keys, positions)
+	if err != nil {
+		return err
+	}
+
+	db.mergeEpoch.Add(1)
+	err = db.replaceDataFiles(mergePath, fid)
+	if err == nil {
+		err = os.RemoveAll(mergePath)
+	}
+
+	// 索引中已经没有指向旧文件的位置了，从视图中去掉之后关闭，正在读取的请求释放引用之后才会真正关闭
+	retired := make(map[uint32]*data.DataFile)
+	for fileId, file := range view.older {
+		if fileId < fid {
+			retired[fileId] = file
+		}
+	}
+	db.files.Store(db.files.Load().replace(nil, retired))
+	for fileId, file := range retired {
+		_ = file.Close()
+		if db.cache != nil {
+			db.cache.RemoveFile(fileId)
+		}
+	}
+	return err
+}
+
+// 把索引中仍然指向旧数据文件（id 小于 fid）的 key 更新为 merge 之后的位置，调用时需要持有锁
+// merge 期间被覆盖或删除的 key 已经不指向旧文件了，不会被更新
+func (db *DB) applyMergePositions(fid uint32, keys [][]byte, positions []*data.LogRecordPos) error {
+	if pi, ok := db.index.(index.PersistentIndexer); ok {
+		return pi.ApplyMerge(fid, keys, positions)
+	}
+	var putKeys [][]byte
+	var putPositions []*data.LogRecordPos
+	for i, key := range keys {
+		if pos := db.index.Get(key); pos != nil && pos.Fid < fid {
+			putKeys = append(putKeys, key)
+			putPositions = append(putPositions, positions[i])
+		}
+	}
+	if len(putKeys) > 0 && !db.index.PutBatch(putKeys, putPositions) {
+		return utils.ErrIndexUpdateFailed
+	}
+	return nil
+}
 
+// 将旧的数据文件中的有效数据重写到 merge 目录中，并生成 hint 文件
+// 重写的数据文件的 id 从 mergeFid 开始，不能达到 noMergedFile
+func (db *DB) mergeFiles(mergeFile []*data.DataFile, mergeFid, noMergedFile uint32, quota int64, stats *MergeStats) error {
 	// 从小到大依次进行merge
 	sort.Slice(mergeFile, func(i, j int) bool {
 		return mergeFile[i].FileId < mergeFile[j].FileId
 	})
 	mergePath := db.getMergePath()
-	// 如果目录存在，说明已经merge过了，应该把这个目录删掉
-	_, err = os.Stat(mergePath)
-	if os.IsNotExist(err) {
-		err := os.RemoveAll(mergePath)
-		if err != nil {
-			return err
-		}
+	// 如果目录存在，说明已经merge过了，还没有替换的结果会被这次 merge 覆盖，应该把这个目录删掉
+	err := os.RemoveAll(mergePath)
+	if err != nil {
+		return err
 	}
 
 	// 新建应该对应的目录
@@ -76,45 +233,92 @@ func (db *DB) Merge() error {
 		return err
 	}
 
+	// 先建好第一个数据文件，临时的实例从这个文件开始写入
+	first, err := data.OpenDataFileWithChecksum(mergePath, mergeFid, db.options.Checksum)
+	if err != nil {
+		return err
+	}
+	_ = first.Close()
+
 	// 打开一个临时的实例
 	mergeOption := db.options
 	mergeOption.DirPath = mergePath
 	mergeOption.SyncWrites = false
+	mergeOption.EventListener = nil
+	mergeOption.CacheSize = 0
+	mergeOption.IndexSnapshot = false
+	mergeOption.IndexCheckpointInterval = 0
+	// merge 目录也计算在数据目录的空间限制之内
+	mergeOption.MaxDiskUsage = quota
+	// merge 的实例不需要索引，保存在磁盘上的索引在 merge 完成后替换数据文件时直接更新
+	if isPersistentIndex(mergeOption.IndexType) {
+		mergeOption.IndexType = BTree
+	}
 	mergeDB, err := Open(mergeOption)
 	if err != nil {
 		return err
 	}
+	// 数据在最后持久化，关闭时只释放文件描述符
+	defer func() {
+		_ = mergeDB.Close()
+	}()
 
 	file, err := data.OpenHintFile(mergePath)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	mergeFiles := make(map[uint32]*data.DataFile, len(mergeFile))
+	for _, dataFile := range mergeFile {
+		mergeFiles[dataFile.FileId] = dataFile
+	}
 
 	// 遍历处理每个数据文件
 	for _, dataFile := range mergeFile {
-		var offset int64 = 0
+		// 旧格式的文件也会在这里被重写为当前的格式
+		var offset = dataFile.DataOffset()
 		for {
 			read, i, err := dataFile.Read(offset)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
+				db.notifyCorruption(dataFile.FileId, offset, err)
 				return err
 			}
 			record, _ := parseLogRecord(read.Key)
-			get := db.index.Get(record)
+			get, err := db.lookup(record)
+			if err != nil {
+				return err
+			}
 
 			// 和索引内存中的进行比较
 			if get != nil && get.Fid == dataFile.FileId && get.Offset == offset {
 				read.Key = logRecordKeyWithSeq(record, nonTransactionSeq)
+				// 流式写入的数据需要把分块也一起重写
+				if read.Type == data.LogRecordStream {
+					err := mergeStreamChunks(read, mergeFiles, mergeDB)
+					if err != nil {
+						return err
+					}
+				}
 				pos, err := mergeDB.appendLogRecord(read)
 				if err != nil {
 					return err
 				}
+				if mergeDB.activeFile().FileId >= noMergedFile {
+					return utils.ErrMergeFileIdExhausted
+				}
 				err = file.WriteHintRecord(record, pos)
 				if err != nil {
 					return err
 				}
+				stats.ValidRecords++
+			} else {
+				stats.DiscardedRecords++
 			}
 			offset += i
 		}
@@ -125,7 +329,7 @@ func (db *DB) Merge() error {
 	if err != nil {
 		return err
 	}
-	err = mergeDB.activeFiles.Sync()
+	err = mergeDB.activeFile().Sync()
 	if err != nil {
 		return err
 	}
@@ -134,6 +338,9 @@ func (db *DB) Merge() error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = openMergeFile.Close()
+	}()
 	mergeFinRecord := &data.LogRecord{
 		Key:   []byte(mergeFinish),
 		Value: []byte(strconv.Itoa(int(noMergedFile))),
@@ -152,6 +359,32 @@ func (db *DB) Merge() error {
 	return nil
 }
 
+// 将流式写入的数据的分块重写到 merge 的实例中，并更新分块的位置信息
+func mergeStreamChunks(record *data.LogRecord, mergeFiles map[uint32]*data.DataFile, mergeDB *DB) error {
+	manifest, err := data.DecodeStreamManifest(record.Value)
+	if err != nil {
+		return err
+	}
+	for i, chunkPos := range manifest.Chunks {
+		dataFile, ok := mergeFiles[chunkPos.Fid]
+		if !ok {
+			return utils.ErrDataFileNotFound
+		}
+		chunk, err := dataFile.ReadRecord(chunkPos)
+		if err != nil {
+			return err
+		}
+		chunk.Key = record.Key
+		pos, err := mergeDB.appendLogRecord(chunk)
+		if err != nil {
+			return err
+		}
+		manifest.Chunks[i] = pos
+	}
+	record.Value = data.EncodeStreamManifest(manifest)
+	return nil
+}
+
 // 得到merge的路径
 func (db *DB) getMergePath() string {
 	dir := path.Dir(path.Clean(db.options.DirPath))
@@ -166,9 +399,6 @@ func (db *DB) loadMergeFiles() error {
 	if os.IsNotExist(err) {
 		return nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
 
 	dir, err := os.ReadDir(mergePath)
 	if err != nil {
@@ -177,50 +407,92 @@ func (db *DB) loadMergeFiles() error {
 
 	// 查找表示看一下是否完成，找标识的数据文件
 	var mergeFinished bool
-	var mergeFileName []string
 	for _, i := range dir {
 		if i.Name() == data.MergeFileName {
 			mergeFinished = true
 		}
-		if i.Name() == data.SeqNoName {
-			continue
-		}
-		mergeFileName = append(mergeFileName, i.Name())
 	}
 
+	// 没有完成的 merge 直接删除
 	if !mergeFinished {
-		return nil
+		return os.RemoveAll(mergePath)
 	}
 
 	// 看看merge是否完成没有完成直接返回
 	fid, err := db.NoMergeFinishedFid(mergePath)
 	if err != nil {
-		return nil
+		return os.RemoveAll(mergePath)
 	}
 
-	// 删除旧的数据文件，就是id小于没有merge的
-	var fileId uint32 = 0
-	for fileId < fid {
-		name := data.GetDataFileName(db.options.DirPath, fileId)
-		_, err := os.Stat(name)
-		if err == nil {
-			err = os.Remove(name)
-			if err != nil {
+	// 保存在磁盘上的索引需要在替换数据文件之前更新为 merge 之后的位置
+	// 中途崩溃的话下次打开时会重新执行，重复更新的结果是一样的
+	if pi, ok := db.index.(index.PersistentIndexer); ok {
+		keys, positions, err := db.readHintFile(mergePath)
+		if err != nil {
+			return err
+		}
+		err = pi.ApplyMerge(fid, keys, positions)
+		if err != nil {
+			return err
+		}
+	}
+	// 替换失败时保留 merge 目录，下次打开时继续替换
+	err = db.replaceDataFiles(mergePath, fid)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// 用 merge 目录中的文件替换数据目录中 id 小于 fid 的旧数据文件
+// 先删除旧的数据文件，再从大到小移动新的数据文件，最后移动 hint 文件和表示 merge 完成的文件
+// 中途崩溃的话下次打开时会重新执行：已经移动的数据文件的 id 比还没有移动的更大，不会被当作旧文件删除
+func (db *DB) replaceDataFiles(mergePath string, fid uint32) error {
+	// 索引快照中的位置指向的是 merge 之前的数据文件，已经失效了
+	db.snapshotLock.Lock()
+	err := os.Remove(filepath.Join(db.options.DirPath, data.IndexSnapshotName))
+	db.snapshotLock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	mergeFileIds, err := getDataFileIds(mergePath)
+	if err != nil {
+		return err
+	}
+	if len(mergeFileIds) > 0 {
+		minFid, maxFid := mergeFileIds[0], mergeFileIds[len(mergeFileIds)-1]
+		fileIds, err := getDataFileIds(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		for _, fileId := range fileIds {
+			// 之前的版本生成的数据文件 id 从 0 开始，会直接覆盖同名的旧文件，只需要删除多出来的旧文件
+			old := fileId < minFid || (minFid == 0 && fileId > maxFid && fileId < int(fid))
+			if !old {
+				continue
+			}
+			err = os.Remove(data.GetDataFileName(db.options.DirPath, uint32(fileId)))
+			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
 		}
-
-		fileId++
 	}
+
 	// 新的数据文件移动到数据目录中
-	for _, fileName := range mergeFileName {
-		srcPath := filepath.Join(mergePath, fileName)
-		desPath := filepath.Join(db.options.DirPath, fileName)
-		err := os.Rename(srcPath, desPath)
+	for i := len(mergeFileIds) - 1; i >= 0; i-- {
+		fileId := uint32(mergeFileIds[i])
+		err := os.Rename(data.GetDataFileName(mergePath, fileId), data.GetDataFileName(db.options.DirPath, fileId))
 		if err != nil {
 			return err
 		}
 	}
+	for _, fileName := range []string{data.HintFileName, data.MergeFileName} {
+		err := os.Rename(filepath.Join(mergePath, fileName), filepath.Join(db.options.DirPath, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -241,17 +513,34 @@ func (db *DB) NoMergeFinishedFid(pathDir string) (uint32, error) {
 }
 
 func (db *DB) loadIndexFromHintFile() error {
-	join := filepath.Join(db.options.DirPath, data.HintFileName)
+	keys, positions, err := db.readHintFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 && !db.index.PutBatch(keys, positions) {
+		return utils.ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// 读出目录中 hint 文件记录的所有 key 和位置，hint 文件中的 key 不会重复
+func (db *DB) readHintFile(dirPath string) ([][]byte, []*data.LogRecordPos, error) {
+	join := filepath.Join(dirPath, data.HintFileName)
 	_, err := os.Stat(join)
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil, nil
 	}
 
-	file, err := data.OpenHintFile(db.options.DirPath)
+	file, err := data.OpenHintFile(dirPath)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer func() {
+		_ = file.Close()
+	}()
 
+	var keys [][]byte
+	var positions []*data.LogRecordPos
 	var offset int64 = 0
 	for {
 		read, i, err := file.Read(offset)
@@ -259,12 +548,13 @@ func (db *DB) loadIndexFromHintFile() error {
 			if err == io.EOF {
 				break
 			}
-			return err
+			db.notifyCorruption(file.FileId, offset, err)
+			return nil, nil, err
 		}
 		offset += i
 
-		pos := data.DecodeLogRecordPos(read.Value)
-		db.index.Put(read.Key, pos)
+		keys = append(keys, read.Key)
+		positions = append(positions, data.DecodeLogRecordPos(read.Value))
 	}
-	return nil
+	return keys, positions, nil
 }
@@ -0,0 +1,183 @@
+package LustreDB
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// 旧格式的数据文件可以正常读取，merge 之后被重写为当前的格式
+func TestDB_MergeUpgradeFileFormat(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade")
+	var legacy []byte
+	for i := 0; i < 10; i++ {
+		record, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(utils.GetTestKey(i), nonTransactionSeq),
+			Value: []byte("legacy"),
+		})
+		legacy = append(legacy, record...)
+	}
+	err := os.WriteFile(data.GetDataFileName(dir, 0), legacy, 0644)
+	assert.Nil(t, err)
+
+	opts := DefaultOptions
+	opts.DirPath = dir
+	opts.Checksum = CRC32C
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, data.FileFormatV0, db.activeFile().Version)
+
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("legacy"), value)
+
+	// 新数据写入新格式的文件
+	err = db.Put(utils.GetTestKey(10), []byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), db.activeFile().FileId)
+	assert.Equal(t, data.CurrentFileFormat, db.activeFile().Version)
+	assert.Equal(t, data.ChecksumCRC32C, db.activeFile().Checksum)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for _, file := range db.olderFiles() {
+		assert.Equal(t, data.CurrentFileFormat, file.Version)
+	}
+	assert.Equal(t, data.CurrentFileFormat, db.activeFile().Version)
+	for i := 0; i < 10; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("legacy"), value)
+	}
+	value, err = db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), value)
+}
+
+func TestDB_MergeBPtree(t *testing.T) {
+	testMergePersistentIndex(t, BPtree)
+}
+
+func TestDB_MergeDiskHash(t *testing.T) {
+	testMergePersistentIndex(t, DiskHash)
+}
+
+// merge 之后保存在磁盘上的索引更新为新的位置
+func testMergePersistentIndex(t *testing.T, indexType index.IndexerType) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-persistent-index")
+	opts := DefaultOptions
+	opts.DirPath = dir
+	opts.IndexType = indexType
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		value := utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), value)
+		assert.Nil(t, err)
+		values[string(utils.GetTestKey(i))] = value
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	for i := 100; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new"))
+		assert.Nil(t, err)
+		values[string(utils.GetTestKey(i))] = []byte("new")
+	}
+
+	check := func(db *DB) {
+		assert.Equal(t, len(values), len(db.ListKeys()))
+		for i := 0; i < 1000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			if expected, ok := values[string(utils.GetTestKey(i))]; ok {
+				assert.Nil(t, err)
+				assert.Equal(t, expected, value)
+			} else {
+				assert.Equal(t, utils.ErrKeyNotFound, err)
+			}
+		}
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	// merge 之后写入的数据不会被 merge 的结果覆盖
+	err = db.Put(utils.GetTestKey(200), []byte("after"))
+	assert.Nil(t, err)
+	values[string(utils.GetTestKey(200))] = []byte("after")
+	err = db.Delete(utils.GetTestKey(300))
+	assert.Nil(t, err)
+	delete(values, string(utils.GetTestKey(300)))
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+
+	// 再次 merge 之后不关闭数据库，模拟崩溃之后重启
+	for i := 400; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	_ = db.index.Close()
+	_ = db.closeDataFiles()
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+	DestroyDB(db)
+}
+
+// merge 的临时实例和 hint 文件在 merge 结束后关闭，不会泄漏文件描述符
+func TestDB_MergeCloseFiles(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("can not count open files")
+	}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-close")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		assert.Nil(t, err)
+		return len(entries)
+	}
+	assert.Nil(t, db.Merge())
+	before := openFiles()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+		assert.Nil(t, db.Merge())
+	}
+	// 每次 merge 会切换一个新的活跃文件
+	assert.LessOrEqual(t, openFiles(), before+5)
+}
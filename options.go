@@ -1,8 +1,11 @@
 package LustreDB
 
 import (
+	"github.com/lustresix/lxdb/data"
 	"github.com/lustresix/lxdb/index"
 	"os"
+	"runtime"
+	"time"
 )
 
 // Options 用户可选的配置项
@@ -18,6 +21,38 @@ type Options struct {
 
 	// 索引类型
 	IndexType index.IndexerType
+
+	// 生命周期事件监听器，为空则不监听
+	EventListener EventListener
+
+	// 读缓存的容量，单位字节，为 0 表示不开启缓存
+	CacheSize int64
+
+	// key 的最大长度，为 0 表示只受数据格式的限制
+	MaxKeySize int64
+
+	// value 的最大长度，为 0 表示只受数据格式的限制，流式写入的 value 不受数据格式的限制
+	// 普通写入时 key、value 和记录头部加起来不能超过 4GB，超过这个范围的限制只对流式写入生效
+	MaxValueSize int64
+
+	// 新建数据文件使用的 crc 算法，为 0 表示 CRC32IEEE
+	Checksum data.ChecksumType
+
+	// 关闭时是否保存索引快照，下次打开时只需要重放快照之后写入的数据，保存在磁盘上的索引不需要
+	IndexSnapshot bool
+
+	// 定时保存索引快照的间隔，为 0 表示只在关闭时保存
+	IndexCheckpointInterval time.Duration
+
+	// 分片索引的分片数量，为 0 表示使用默认的数量
+	IndexShards int
+
+	// 启动时并发读取数据文件重建索引的协程数量，小于等于 1 表示只用一个协程
+	IndexLoadWorkers int
+
+	// 数据目录最多占用的磁盘空间，单位字节，超过之后写入返回 ErrDiskQuotaExceeded，为 0 表示不限制
+	// 正在进行的 merge 的目录也计算在内，merge 可以暂时超过限制，完成之后释放旧文件的空间
+	MaxDiskUsage int64
 }
 
 type IteratorOptions struct {
@@ -26,6 +61,10 @@ type IteratorOptions struct {
 
 	// 是否反向遍历，false为正常遍历
 	Reverse bool
+
+	// 不要求按照 key 的顺序遍历，哈希索引可以省去排序，此时 Reverse 不生效
+	// 其他的索引仍然按顺序遍历；不按顺序遍历时不是快照，遍历期间的写入可能被看到
+	Unordered bool
 }
 
 // WriteBatchOptions 批量写配置项
@@ -36,12 +75,51 @@ type WriteBatchOptions struct {
 	SyncWrite bool
 }
 
+// VerifyOptions 数据校验的配置项
+type VerifyOptions struct {
+	// 是否检查 hint 文件中的数据都指向有效的记录
+	CheckHint bool
+
+	// 是否检查索引中的数据都指向有效的记录
+	CheckIndex bool
+
+	// 最多记录多少个问题，达到之后停止校验，为 0 表示不限制
+	MaxProblems int
+}
+
 const (
+	// CRC32IEEE crc32 IEEE 多项式，旧格式的数据文件只支持这种算法
+	CRC32IEEE = data.ChecksumIEEE
+
+	// CRC32C crc32 Castagnoli 多项式
+	CRC32C = data.ChecksumCRC32C
+)
+
+const (
+	// BTree 索引，key 连续存放在内存池中，位置信息内联保存
 	BTree index.IndexerType = iota + 1
 
+	// ART 自适应基数树索引，位置信息内联保存，key 单独分配，不会整理
 	ART
 
 	BPtree
+
+	// ShardedBTree 分片的 BTree 索引，分片数量由 IndexShards 决定
+	ShardedBTree
+
+	// ShardedART 分片的自适应基数树索引，分片数量由 IndexShards 决定
+	ShardedART
+
+	// SkipList 无锁的并发跳表索引，读取不会被写入阻塞
+	SkipList
+
+	// Hash 分片的哈希索引，单点查询是 O(1) 的，内存占用更少，遍历时才排序，分片数量由 IndexShards 决定
+	Hash
+
+	// DiskHash 保存在磁盘上的可扩展哈希索引，内存中只有目录，适合 key 的数量超过内存的场景
+	// key 的长度不能超过 index.DiskHashMaxKeySize，遍历时需要扫描整个索引文件
+	// 有序遍历需要把所有的 key 读取到内存中排序，设置 IteratorOptions.Unordered 时每次只读取一个桶
+	DiskHash
 )
 
 var DefaultOptions = Options{
@@ -50,6 +128,15 @@ var DefaultOptions = Options{
 	DataFileSize: 256 * 1024 * 1024,
 	SyncWrites:   false,
 	IndexType:    ART,
+	CacheSize:    0,
+	// 64KB
+	MaxKeySize: 64 * 1024,
+	// 约 4GB，和最大长度的 key 一起也能放进一条记录中
+	MaxValueSize:            maxValueSize(64 * 1024),
+	Checksum:                CRC32C,
+	IndexSnapshot:           true,
+	IndexCheckpointInterval: 0,
+	IndexLoadWorkers:        runtime.NumCPU(),
 }
 
 var DefaultIteratorOption = IteratorOptions{
@@ -61,3 +148,9 @@ var DefaultWriteBatchOptions = WriteBatchOptions{
 	MaxBatchNum: 10000,
 	SyncWrite:   true,
 }
+
+var DefaultVerifyOptions = VerifyOptions{
+	CheckHint:   true,
+	CheckIndex:  true,
+	MaxProblems: 0,
+}
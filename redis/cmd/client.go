@@ -52,6 +52,8 @@ func handler(conn redcon.Conn, cmd redcon.Command) {
 		if err != nil {
 			if errors.Is(err, utils.ErrKeyNotFound) {
 				conn.WriteNull()
+			} else if errors.Is(err, utils.ErrKeyTooLarge) || errors.Is(err, utils.ErrValueTooLarge) {
+				conn.WriteError("ERR " + err.Error())
 			} else {
 				conn.WriteError(err.Error())
 			}
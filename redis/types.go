@@ -149,9 +149,13 @@ func (rds *RedisDataStructure) HSet(key, field, value []byte) (bool, error) {
 	//不存在则更新
 	if !exist {
 		meta.size++
-		_ = wb.Put(key, meta.encode())
+		if err := wb.Put(key, meta.encode()); err != nil {
+			return false, err
+		}
+	}
+	if err := wb.Put(encKey, value); err != nil {
+		return false, err
 	}
-	_ = wb.Put(encKey, value)
 	err = wb.Commit()
 	if err != nil {
 		return false, err
@@ -201,8 +205,12 @@ func (rds *RedisDataStructure) HDel(key, field []byte) (bool, error) {
 	if exist {
 		wb := rds.db.NewWriteBatch(LustreDB.DefaultWriteBatchOptions)
 		meta.size--
-		_ = wb.Put(key, meta.encode())
-		_ = wb.Delete(encode)
+		if err := wb.Put(key, meta.encode()); err != nil {
+			return false, err
+		}
+		if err := wb.Delete(encode); err != nil {
+			return false, err
+		}
 		err := wb.Commit()
 		if err != nil {
 			return false, err
@@ -247,8 +255,12 @@ func (rds *RedisDataStructure) pushInner(key, element []byte, isLeft bool) (uint
 	} else {
 		meta.tail++
 	}
-	_ = wb.Put(key, meta.encode())
-	_ = wb.Put(lk.encode(), nil)
+	if err := wb.Put(key, meta.encode()); err != nil {
+		return 0, err
+	}
+	if err := wb.Put(lk.encode(), nil); err != nil {
+		return 0, err
+	}
 	err = wb.Commit()
 	if err != nil {
 		return 0, err
@@ -321,8 +333,12 @@ func (rds *RedisDataStructure) SAdd(key, member []byte) (bool, error) {
 	if errors.Is(err, utils.ErrKeyNotFound) {
 		wb := rds.db.NewWriteBatch(LustreDB.DefaultWriteBatchOptions)
 		meta.size++
-		_ = wb.Put(key, meta.encode())
-		_ = wb.Put(sk.encode(), nil)
+		if err := wb.Put(key, meta.encode()); err != nil {
+			return false, err
+		}
+		if err := wb.Put(sk.encode(), nil); err != nil {
+			return false, err
+		}
 		err := wb.Commit()
 		if err != nil {
 			return false, err
@@ -376,8 +392,12 @@ func (rds *RedisDataStructure) SRem(key, member []byte) (bool, error) {
 	}
 	wb := rds.db.NewWriteBatch(LustreDB.DefaultWriteBatchOptions)
 	meta.size--
-	_ = wb.Put(key, meta.encode())
-	_ = wb.Delete(sk.encode())
+	if err := wb.Put(key, meta.encode()); err != nil {
+		return false, err
+	}
+	if err := wb.Delete(sk.encode()); err != nil {
+		return false, err
+	}
 	err = wb.Commit()
 	if err != nil {
 		return false, err
@@ -423,7 +443,9 @@ func (rds *RedisDataStructure) ZAdd(key []byte, score float64, member []byte) (b
 	wb := rds.db.NewWriteBatch(LustreDB.DefaultWriteBatchOptions)
 	if !exist {
 		meta.size++
-		_ = wb.Put(key, meta.encode())
+		if err := wb.Put(key, meta.encode()); err != nil {
+			return false, err
+		}
 	} else {
 		oldKey := &zsetInternalKey{
 			key:     key,
@@ -431,10 +453,16 @@ func (rds *RedisDataStructure) ZAdd(key []byte, score float64, member []byte) (b
 			member:  member,
 			score:   BtoF(val),
 		}
-		_ = wb.Delete(oldKey.encodeWithScore())
+		if err := wb.Delete(oldKey.encodeWithScore()); err != nil {
+			return false, err
+		}
+	}
+	if err := wb.Put(zk.encodeWithMember(), FtoB(score)); err != nil {
+		return false, err
+	}
+	if err := wb.Put(zk.encodeWithScore(), nil); err != nil {
+		return false, err
 	}
-	_ = wb.Put(zk.encodeWithMember(), FtoB(score))
-	_ = wb.Put(zk.encodeWithScore(), nil)
 	err = wb.Commit()
 	if err != nil {
 		return false, err
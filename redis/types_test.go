@@ -56,3 +56,22 @@ func TestRedisDataStructure_HGet(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, get)
 }
+
+func TestRedisDataStructure_HSetTooLarge(t *testing.T) {
+	opts := LustreDB.DefaultOptions
+	temp, _ := os.MkdirTemp("", "bitcask-go-redis")
+	opts.DirPath = temp
+	opts.MaxValueSize = 128
+
+	redis, err := NewRedisDataStructure(opts)
+	assert.Nil(t, err)
+
+	defer LustreDB.DestroyDB(redis.db)
+
+	_, err = redis.HSet(utils.GetTestKey(1), []byte("field1"), make([]byte, 256))
+	assert.Equal(t, utils.ErrValueTooLarge, err)
+
+	// 元数据也不能被更新
+	_, err = redis.db.Get(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+}
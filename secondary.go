@@ -0,0 +1,283 @@
+package LustreDB
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"sort"
+)
+
+// 二级索引
+// 索引中的每一条数据保存为一个 value 为空的内部 key，和普通的 key 一样写入数据文件，由主索引管理
+// 内部 key 的格式 secondaryIndexPrefix + 'e' + nameSize + name + valueSize + value + 主键
+// 索引数据的数量保存在内部 key secondaryIndexCountKey 中，统计 key 的数量时需要排除这些内部 key
+// 索引数据的变化和主键的写入在同一个事务中提交，崩溃之后不会出现不一致
+// 用户的 key 不能以 secondaryIndexPrefix 开头
+
+var (
+	secondaryIndexPrefix = []byte("\x00lxdb-index\x00")
+
+	// 所有内部 key 都小于这个 key，正向遍历时用于跳过内部 key
+	secondaryIndexPrefixEnd = []byte("\x00lxdb-index\x01")
+
+	secondaryIndexCountKey = append(append([]byte(nil), secondaryIndexPrefix...), 'n')
+)
+
+// SecondaryIndexExtractor 从一条数据中提取出二级索引的值，一条数据可以对应多个值，返回空表示不建立索引
+type SecondaryIndexExtractor func(key, value []byte) [][]byte
+
+type secondaryIndex struct {
+	name      string
+	extractor SecondaryIndexExtractor
+}
+
+// 判断 key 是否是内部 key
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, secondaryIndexPrefix)
+}
+
+// 检查用户写入的 key，不能为空，也不能使用内部 key 的前缀
+func checkUserKey(key []byte) error {
+	if len(key) == 0 {
+		return utils.ErrKeyIsEmpty
+	}
+	if isInternalKey(key) {
+		return utils.ErrKeyIsReserved
+	}
+	return nil
+}
+
+// 索引名对应的所有索引数据的前缀，value 为空时是整个索引的前缀
+func secondaryEntryPrefix(name string, value []byte, withValue bool) []byte {
+	buf := make([]byte, 0, len(secondaryIndexPrefix)+1+2*binary.MaxVarintLen64+len(name)+len(value))
+	buf = append(buf, secondaryIndexPrefix...)
+	buf = append(buf, 'e')
+	buf = binary.AppendUvarint(buf, uint64(len(name)))
+	buf = append(buf, name...)
+	if withValue {
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// 一条数据在索引中对应的所有内部 key，重复的值只保留一个
+func (si *secondaryIndex) entries(key, value []byte, entries map[string]struct{}) {
+	for _, indexValue := range si.extractor(key, value) {
+		entry := append(secondaryEntryPrefix(si.name, indexValue, true), key...)
+		entries[string(entry)] = struct{}{}
+	}
+}
+
+// CreateSecondaryIndex 创建二级索引，并根据已有的数据建立索引
+// extractor 不会被持久化，重新打开数据库之后需要再次创建，创建时会删除之前保存的索引数据重新建立
+// 建立索引期间会阻塞写入，流式写入的 value 不会建立索引
+func (db *DB) CreateSecondaryIndex(name string, extractor SecondaryIndexExtractor) error {
+	db.lo.Lock()
+	defer db.lo.Unlock()
+	if _, ok := db.secondaryIndexes[name]; ok {
+		return utils.ErrSecondaryIndexExists
+	}
+
+	si := &secondaryIndex{name: name, extractor: extractor}
+	entries := make(map[string]struct{})
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if isInternalKey(iterator.Key()) {
+			continue
+		}
+		record, err := db.readLogRecord(iterator.Value())
+		if err != nil {
+			iterator.Close()
+			return err
+		}
+		if record.Type == data.LogRecordNormal {
+			si.entries(iterator.Key(), record.Value, entries)
+		}
+	}
+	iterator.Close()
+
+	if err := db.rebuildSecondaryIndex(name, entries); err != nil {
+		return err
+	}
+	if db.secondaryIndexes == nil {
+		db.secondaryIndexes = make(map[string]*secondaryIndex)
+	}
+	db.secondaryIndexes[name] = si
+	return nil
+}
+
+// DropSecondaryIndex 删除二级索引和保存的所有索引数据，也可以用于清理重新打开之后没有再创建的索引的数据
+func (db *DB) DropSecondaryIndex(name string) error {
+	db.lo.Lock()
+	defer db.lo.Unlock()
+	if err := db.rebuildSecondaryIndex(name, nil); err != nil {
+		return err
+	}
+	delete(db.secondaryIndexes, name)
+	return nil
+}
+
+// QueryIndex 返回二级索引中值为 value 的所有主键，按照主键的顺序排列
+// 哈希索引需要排序所有的 key 才能按前缀查找，查询的开销和 key 的数量有关
+func (db *DB) QueryIndex(name string, value []byte) ([][]byte, error) {
+	db.lo.RLock()
+	defer db.lo.RUnlock()
+	if _, ok := db.secondaryIndexes[name]; !ok {
+		return nil, utils.ErrSecondaryIndexNotFound
+	}
+
+	prefix := secondaryEntryPrefix(name, value, true)
+	var keys [][]byte
+	for _, entry := range db.scanInternalKeys(prefix) {
+		keys = append(keys, entry[len(prefix):])
+	}
+	return keys, nil
+}
+
+// 读取以 prefix 开头的所有内部 key
+func (db *DB) scanInternalKeys(prefix []byte) [][]byte {
+	var keys [][]byte
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	return keys
+}
+
+// 把索引 name 的数据替换为 entries，在一个事务中删除多余的数据并写入缺少的数据，调用时需要持有数据库的锁
+func (db *DB) rebuildSecondaryIndex(name string, entries map[string]struct{}) error {
+	var records []*data.LogRecord
+	existing := make(map[string]struct{})
+	for _, entry := range db.scanInternalKeys(secondaryEntryPrefix(name, nil, false)) {
+		existing[string(entry)] = struct{}{}
+		if _, ok := entries[string(entry)]; !ok {
+			records = append(records, &data.LogRecord{Key: entry, Type: data.LogRecordDelete})
+		}
+	}
+	for entry := range entries {
+		if _, ok := existing[entry]; !ok {
+			if int64(len(entry)) > db.maxKeySize() {
+				return utils.ErrKeyTooLarge
+			}
+			records = append(records, &data.LogRecord{Key: []byte(entry)})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	entryNum := db.secondaryEntryNum - len(existing) + len(entries)
+	records = append(records, db.secondaryCountRecord(entryNum))
+	if err := db.commitRecords(records, false); err != nil {
+		return err
+	}
+	db.secondaryEntryNum = entryNum
+	return nil
+}
+
+// 计算写入 records 之后所有二级索引需要的变化，返回需要一起写入的内部 key 和之后索引数据的数量
+// 调用时需要持有数据库的锁，保证读取到的旧数据不会被其他写入修改
+func (db *DB) secondaryIndexRecords(records []*data.LogRecord) ([]*data.LogRecord, int, error) {
+	if len(db.secondaryIndexes) == 0 {
+		return nil, db.secondaryEntryNum, nil
+	}
+	names := make([]string, 0, len(db.secondaryIndexes))
+	for name := range db.secondaryIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var indexRecords []*data.LogRecord
+	entryNum := db.secondaryEntryNum
+	for _, record := range records {
+		if isInternalKey(record.Key) {
+			continue
+		}
+		oldEntries := make(map[string]struct{})
+		newEntries := make(map[string]struct{})
+		pos, err := db.lookup(record.Key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if pos != nil {
+			old, err := db.readLogRecord(pos)
+			if err != nil {
+				return nil, 0, err
+			}
+			if old.Type == data.LogRecordNormal {
+				for _, name := range names {
+					db.secondaryIndexes[name].entries(record.Key, old.Value, oldEntries)
+				}
+			}
+		}
+		if record.Type == data.LogRecordNormal {
+			for _, name := range names {
+				db.secondaryIndexes[name].entries(record.Key, record.Value, newEntries)
+			}
+		}
+
+		// 值没有变化的索引数据不需要重写
+		for entry := range oldEntries {
+			if _, ok := newEntries[entry]; !ok {
+				indexRecords = append(indexRecords, &data.LogRecord{Key: []byte(entry), Type: data.LogRecordDelete})
+				entryNum--
+			}
+		}
+		for entry := range newEntries {
+			if _, ok := oldEntries[entry]; !ok {
+				// 内部 key 比主键更长，需要单独检查，避免写入之后才更新索引失败
+				if int64(len(entry)) > db.maxKeySize() {
+					return nil, 0, utils.ErrKeyTooLarge
+				}
+				indexRecords = append(indexRecords, &data.LogRecord{Key: []byte(entry)})
+				entryNum++
+			}
+		}
+	}
+	if entryNum != db.secondaryEntryNum {
+		indexRecords = append(indexRecords, db.secondaryCountRecord(entryNum))
+	}
+	return indexRecords, entryNum, nil
+}
+
+// 保存索引数据数量的记录，没有索引数据时删除
+func (db *DB) secondaryCountRecord(entryNum int) *data.LogRecord {
+	if entryNum == 0 {
+		return &data.LogRecord{Key: secondaryIndexCountKey, Type: data.LogRecordDelete}
+	}
+	return &data.LogRecord{Key: secondaryIndexCountKey, Value: binary.AppendUvarint(nil, uint64(entryNum))}
+}
+
+// 打开数据库时读取索引数据的数量
+func (db *DB) loadSecondaryEntryNum() error {
+	pos, err := db.lookup(secondaryIndexCountKey)
+	if err != nil || pos == nil {
+		return err
+	}
+	value, err := db.getValue(nil, pos)
+	if err != nil {
+		return err
+	}
+	entryNum, n := binary.Uvarint(value)
+	if n <= 0 {
+		return utils.ErrDataDirectoryCorrupted
+	}
+	db.secondaryEntryNum = int(entryNum)
+	return nil
+}
+
+// 用户可见的 key 的数量，不包括二级索引的内部 key
+func (db *DB) keyNum() int {
+	size := db.index.Size() - db.secondaryEntryNum
+	if db.secondaryEntryNum > 0 {
+		// 保存数量的内部 key
+		size--
+	}
+	return size
+}
@@ -0,0 +1,237 @@
+package LustreDB
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lustresix/lxdb/index"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+type secondaryTestUser struct {
+	City string   `json:"city"`
+	Tags []string `json:"tags"`
+}
+
+func putSecondaryTestUser(t *testing.T, db *DB, key, city string, tags ...string) {
+	value, _ := json.Marshal(&secondaryTestUser{City: city, Tags: tags})
+	err := db.Put([]byte(key), value)
+	assert.Nil(t, err)
+}
+
+func cityExtractor(key, value []byte) [][]byte {
+	var user secondaryTestUser
+	if json.Unmarshal(value, &user) != nil || user.City == "" {
+		return nil
+	}
+	return [][]byte{[]byte(user.City)}
+}
+
+func tagsExtractor(key, value []byte) [][]byte {
+	var user secondaryTestUser
+	if json.Unmarshal(value, &user) != nil {
+		return nil
+	}
+	var tags [][]byte
+	for _, tag := range user.Tags {
+		tags = append(tags, []byte(tag))
+	}
+	return tags
+}
+
+func queryIndex(t *testing.T, db *DB, name, value string) []string {
+	keys, err := db.QueryIndex(name, []byte(value))
+	assert.Nil(t, err)
+	var result []string
+	for _, key := range keys {
+		result = append(result, string(key))
+	}
+	return result
+}
+
+func TestDB_SecondaryIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+
+	// 创建索引时根据已有的数据建立索引
+	putSecondaryTestUser(t, db, "user-1", "beijing", "a", "b")
+	putSecondaryTestUser(t, db, "user-2", "shanghai", "b")
+	err = db.Put([]byte("not-json"), []byte("value"))
+	assert.Nil(t, err)
+	err = db.CreateSecondaryIndex("city", cityExtractor)
+	assert.Nil(t, err)
+	err = db.CreateSecondaryIndex("tags", tagsExtractor)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.ErrSecondaryIndexExists, db.CreateSecondaryIndex("city", cityExtractor))
+	assert.Equal(t, []string{"user-1"}, queryIndex(t, db, "city", "beijing"))
+	assert.Equal(t, []string{"user-1", "user-2"}, queryIndex(t, db, "tags", "b"))
+	_, err = db.QueryIndex("unknown", []byte("beijing"))
+	assert.Equal(t, utils.ErrSecondaryIndexNotFound, err)
+
+	// 写入时更新索引，value 变化时删除旧的索引数据
+	putSecondaryTestUser(t, db, "user-3", "beijing")
+	putSecondaryTestUser(t, db, "user-1", "shenzhen", "b")
+	assert.Equal(t, []string{"user-3"}, queryIndex(t, db, "city", "beijing"))
+	assert.Equal(t, []string{"user-1"}, queryIndex(t, db, "city", "shenzhen"))
+	assert.Nil(t, queryIndex(t, db, "tags", "a"))
+	// 值是另一个值的前缀时不会被查询到
+	assert.Nil(t, queryIndex(t, db, "city", "shen"))
+
+	err = db.Delete([]byte("user-2"))
+	assert.Nil(t, err)
+	assert.Nil(t, queryIndex(t, db, "city", "shanghai"))
+	assert.Equal(t, []string{"user-1"}, queryIndex(t, db, "tags", "b"))
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	value, _ := json.Marshal(&secondaryTestUser{City: "shanghai"})
+	assert.Nil(t, wb.Put([]byte("user-4"), value))
+	assert.Nil(t, wb.Delete([]byte("user-3")))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, []string{"user-4"}, queryIndex(t, db, "city", "shanghai"))
+	assert.Nil(t, queryIndex(t, db, "city", "beijing"))
+
+	// 流式写入的 value 不建立索引，旧的索引数据被删除
+	err = db.PutReader([]byte("user-4"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Nil(t, queryIndex(t, db, "city", "shanghai"))
+
+	// 内部 key 对用户不可见
+	expected := [][]byte{[]byte("not-json"), []byte("user-1"), []byte("user-4")}
+	assert.Equal(t, expected, db.ListKeys())
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(3), stat.KeyNum)
+	var count int
+	err = db.Fold(func(key, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	for _, opt := range []IteratorOptions{{}, {Reverse: true}, {Prefix: []byte("\x00")}, {Unordered: true}} {
+		var keys [][]byte
+		iterator := db.NewIterator(opt)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			assert.False(t, isInternalKey(iterator.Key()))
+			keys = append(keys, iterator.Key())
+		}
+		iterator.Close()
+		if len(opt.Prefix) == 0 {
+			assert.Equal(t, 3, len(keys))
+		} else {
+			assert.Equal(t, 0, len(keys))
+		}
+	}
+	_, err = db.Get(secondaryIndexCountKey)
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	assert.Equal(t, utils.ErrKeyIsReserved, db.Put(secondaryIndexCountKey, []byte("value")))
+	assert.Equal(t, utils.ErrKeyIsReserved, db.Delete(secondaryIndexCountKey))
+}
+
+func TestDB_SecondaryIndexReopen(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-reopen")
+	opts.DirPath = dir
+	opts.IndexType = Hash
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	err = db.CreateSecondaryIndex("city", cityExtractor)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		city := "beijing"
+		if i%2 == 0 {
+			city = "shanghai"
+		}
+		putSecondaryTestUser(t, db, string(utils.GetTestKey(i)), city)
+	}
+	assert.Equal(t, 50, len(queryIndex(t, db, "city", "beijing")))
+
+	// 索引数据和数量都保存在数据文件中
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(100), stat.KeyNum)
+	assert.Equal(t, 100, len(db.ListKeys()))
+
+	// 重新打开之后需要再次创建，之前没有维护的数据会被重建
+	_, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Equal(t, utils.ErrSecondaryIndexNotFound, err)
+	putSecondaryTestUser(t, db, string(utils.GetTestKey(0)), "beijing")
+	err = db.CreateSecondaryIndex("city", cityExtractor)
+	assert.Nil(t, err)
+	assert.Equal(t, 51, len(queryIndex(t, db, "city", "beijing")))
+	assert.Equal(t, 49, len(queryIndex(t, db, "city", "shanghai")))
+	assert.Equal(t, 100, db.secondaryEntryNum)
+
+	// 删除索引之后只剩下用户的 key
+	err = db.DropSecondaryIndex("city")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db.secondaryEntryNum)
+	assert.Equal(t, 100, db.index.Size())
+	_, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Equal(t, utils.ErrSecondaryIndexNotFound, err)
+	putSecondaryTestUser(t, db, string(utils.GetTestKey(1)), "beijing")
+	assert.Equal(t, 100, db.index.Size())
+}
+
+func TestDB_SecondaryIndexKeyTooLarge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-key-too-large")
+	opts.DirPath = dir
+	opts.IndexType = DiskHash
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	err = db.CreateSecondaryIndex("city", cityExtractor)
+	assert.Nil(t, err)
+	putSecondaryTestUser(t, db, "small", "beijing")
+
+	// 主键本身没有超过限制，但是加上索引前缀之后超过了磁盘哈希索引的限制
+	key := bytes.Repeat([]byte("k"), index.DiskHashMaxKeySize-10)
+	value, _ := json.Marshal(&secondaryTestUser{City: "beijing"})
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	err = db.Put(key, value)
+	assert.Equal(t, utils.ErrKeyTooLarge, err)
+	after, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.DiskSize, after.DiskSize)
+	_, err = db.Get(key)
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+
+	// 没有索引数据的值可以正常写入
+	err = db.Put(key, []byte("no index"))
+	assert.Nil(t, err)
+	err = db.Delete(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"small"}, queryIndex(t, db, "city", "beijing"))
+
+	// 已有的数据生成的内部 key 太长时不能创建索引
+	err = db.Put(key, []byte("no index"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	err = db.Put(key, value)
+	assert.Nil(t, err)
+	err = db.CreateSecondaryIndex("city", cityExtractor)
+	assert.Equal(t, utils.ErrKeyTooLarge, err)
+	_, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Equal(t, utils.ErrSecondaryIndexNotFound, err)
+	got, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+}
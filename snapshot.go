@@ -0,0 +1,247 @@
+package LustreDB
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 索引快照文件的魔数 "LXIS"
+const indexSnapshotMagic uint32 = 0x5349584c
+
+// 快照头部 magic = 4  fid = 4  offset = 8  seqNo = 8  count = 8  total = 32
+const indexSnapshotHeaderSize = 32
+
+// Checkpoint 将内存索引保存为索引快照，下次打开时只需要重放快照之后写入的数据
+// 只在创建索引迭代器时持有读锁，序列化和写入文件期间不会阻塞写入
+func (db *DB) Checkpoint() error {
+	db.lo.RLock()
+	snapshot := db.takeIndexSnapshot()
+	db.lo.RUnlock()
+	if snapshot == nil {
+		return nil
+	}
+	return db.writeIndexSnapshot(snapshot)
+}
+
+// 索引快照的内容，在持有锁时创建，之后的写入不会影响它
+type indexSnapshot struct {
+	// 快照覆盖到的活跃文件的位置，文件持有一个引用，写入快照之前需要持久化
+	activeFile *data.DataFile
+	offset     int64
+	seqNo      uint64
+	count      int
+	// 创建时 merge 替换数据文件的次数
+	epoch uint64
+	// 索引迭代器遍历的是创建时的快照
+	iterator index.Iterator
+}
+
+// 记录活跃文件当前写入的位置并创建索引迭代器，不需要保存快照时返回空
+// 在访问此方法必须要持有锁
+func (db *DB) takeIndexSnapshot() *indexSnapshot {
+	if !db.options.IndexSnapshot || isPersistentIndex(db.options.IndexType) || db.activeFile() == nil {
+		return nil
+	}
+	activeFile := db.activeFile()
+	if !activeFile.Acquire() {
+		return nil
+	}
+	return &indexSnapshot{
+		activeFile: activeFile,
+		offset:     activeFile.WriteOff,
+		seqNo:      db.seqNo,
+		count:      db.index.Size(),
+		epoch:      db.mergeEpoch.Load(),
+		iterator:   db.index.Iterator(false),
+	}
+}
+
+// 将索引快照写入快照文件
+// 先写入临时文件，写完之后再重命名，保证快照文件总是完整的
+// 快照文件的格式 header + [keySize + key + posSize + pos]... + crc
+func (db *DB) writeIndexSnapshot(snapshot *indexSnapshot) error {
+	defer func() {
+		snapshot.iterator.Close()
+		_ = snapshot.activeFile.Release()
+	}()
+	db.snapshotLock.Lock()
+	defer db.snapshotLock.Unlock()
+
+	// 创建快照之后 merge 替换了数据文件，快照中的位置指向的旧文件已经被删除了
+	// merge 在增加 epoch 之后才会持有 snapshotLock 删除快照文件，所以这里检查之后写入的快照会被它删除
+	if snapshot.epoch != db.mergeEpoch.Load() {
+		return nil
+	}
+
+	// 快照中的位置必须已经持久化，之后追加的数据一起被持久化也不影响
+	err := snapshot.activeFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(db.options.DirPath, data.IndexSnapshotName)
+	tmpName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(tmpName)
+	}()
+
+	hash := crc32.New(data.ChecksumTable(data.ChecksumCRC32C))
+	bw := bufio.NewWriter(io.MultiWriter(file, hash))
+
+	header := make([]byte, indexSnapshotHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], indexSnapshotMagic)
+	binary.LittleEndian.PutUint32(header[4:8], snapshot.activeFile.FileId)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(snapshot.offset))
+	binary.LittleEndian.PutUint64(header[16:24], snapshot.seqNo)
+	binary.LittleEndian.PutUint64(header[24:32], uint64(snapshot.count))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	iterator := snapshot.iterator
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		for _, field := range [][]byte{iterator.Key(), data.EncodeLogRecordPos(iterator.Value())} {
+			n := binary.PutUvarint(lenBuf, uint64(len(field)))
+			if _, err := bw.Write(lenBuf[:n]); err != nil {
+				return err
+			}
+			if _, err := bw.Write(field); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	crc := make([]byte, crc32.Size)
+	binary.LittleEndian.PutUint32(crc, hash.Sum32())
+	if _, err := file.Write(crc); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// 从索引快照中加载索引，返回快照覆盖到的位置
+// 快照不存在、损坏或者和数据文件对不上时返回空，需要完整地重建索引
+func (db *DB) loadIndexFromSnapshot() *data.LogRecordPos {
+	if !db.options.IndexSnapshot {
+		return nil
+	}
+	buf, err := os.ReadFile(filepath.Join(db.options.DirPath, data.IndexSnapshotName))
+	if err != nil || len(buf) < indexSnapshotHeaderSize+crc32.Size {
+		return nil
+	}
+
+	body := buf[:len(buf)-crc32.Size]
+	crc := binary.LittleEndian.Uint32(buf[len(buf)-crc32.Size:])
+	if crc32.Checksum(body, data.ChecksumTable(data.ChecksumCRC32C)) != crc ||
+		binary.LittleEndian.Uint32(body[0:4]) != indexSnapshotMagic {
+		return nil
+	}
+
+	start := &data.LogRecordPos{
+		Fid:    binary.LittleEndian.Uint32(body[4:8]),
+		Offset: int64(binary.LittleEndian.Uint64(body[8:16])),
+	}
+	seqNo := binary.LittleEndian.Uint64(body[16:24])
+	count := binary.LittleEndian.Uint64(body[24:32])
+
+	// 快照覆盖到的数据必须都还在
+	dataFile := db.olderFiles()[start.Fid]
+	if db.activeFile() != nil && db.activeFile().FileId == start.Fid {
+		dataFile = db.activeFile()
+	}
+	if dataFile == nil || start.Offset < dataFile.DataOffset() {
+		return nil
+	}
+	size, err := dataFile.IOManager.Size()
+	if err != nil || size < start.Offset {
+		return nil
+	}
+
+	var entries uint64
+	body = body[indexSnapshotHeaderSize:]
+	for len(body) > 0 {
+		key, n := readSnapshotField(body)
+		if n <= 0 {
+			break
+		}
+		body = body[n:]
+		pos, n := readSnapshotField(body)
+		if n <= 0 {
+			break
+		}
+		body = body[n:]
+		db.index.Put(key, data.DecodeLogRecordPos(pos))
+		entries++
+	}
+	if len(body) != 0 || entries != count {
+		// 已经加载了一部分，需要换一个新的索引重建，内存中的索引创建时不会出错
+		db.index, _ = newIndexer(db.options)
+		return nil
+	}
+
+	db.seqNo = seqNo
+	return start
+}
+
+// 读取一个长度前缀的字段，返回字段和读取的字节数，数据不完整时返回的字节数小于等于 0
+func readSnapshotField(buf []byte) ([]byte, int) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, 0
+	}
+	field := make([]byte, size)
+	copy(field, buf[n:n+int(size)])
+	return field, n + int(size)
+}
+
+// 启动定时保存索引快照的协程
+func (db *DB) startCheckpoint() {
+	db.checkpointDone = make(chan struct{})
+	db.checkpointWg.Add(1)
+	go func() {
+		defer db.checkpointWg.Done()
+		ticker := time.NewTicker(db.options.IndexCheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// 保存失败时等待下一次，关闭时还会再保存一次
+				_ = db.Checkpoint()
+			case <-db.checkpointDone:
+				return
+			}
+		}
+	}()
+}
+
+// 停止定时保存索引快照的协程
+func (db *DB) stopCheckpoint() {
+	if db.checkpointDone == nil {
+		return
+	}
+	close(db.checkpointDone)
+	db.checkpointWg.Wait()
+	db.checkpointDone = nil
+}
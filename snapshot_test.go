@@ -0,0 +1,213 @@
+package LustreDB
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IndexType = BTree
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, listener.opens[1].FromSnapshot)
+	assert.Equal(t, 1000, listener.opens[1].KeyNum)
+
+	// 快照之后写入的数据需要重放
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2000), utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// 不关闭数据库，模拟崩溃之后重启
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, listener.opens[2].FromSnapshot)
+	assert.Equal(t, 901, db2.index.Size())
+	assert.Equal(t, uint64(1), db2.seqNo)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	value, err := db2.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2000), value)
+	_ = db2.closeDataFiles()
+	DestroyDB(db)
+}
+
+func TestDB_IndexSnapshotCorrupted(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-corrupted")
+	opts.DirPath = dir
+	opts.IndexType = ART
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	name := filepath.Join(dir, data.IndexSnapshotName)
+	buf, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	err = os.WriteFile(name, buf, 0644)
+	assert.Nil(t, err)
+
+	// 快照损坏时完整地重建索引
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.False(t, listener.opens[1].FromSnapshot)
+	assert.Equal(t, 100, db.index.Size())
+	value, err := db.Get(utils.GetTestKey(50))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(50), value)
+	DestroyDB(db)
+}
+
+func TestDB_IndexSnapshotAfterMerge(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IndexType = BTree
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	snapshotName := filepath.Join(dir, data.IndexSnapshotName)
+	_, err = os.Stat(snapshotName)
+	assert.Nil(t, err)
+
+	// merge 之前创建的快照在 merge 之后不会再被写入，之前保存的快照文件也被删除了
+	db.lo.RLock()
+	snapshot := db.takeIndexSnapshot()
+	db.lo.RUnlock()
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.writeIndexSnapshot(snapshot)
+	assert.Nil(t, err)
+	_, err = os.Stat(snapshotName)
+	assert.True(t, os.IsNotExist(err))
+
+	// 没有正常关闭时从 hint 文件中重建
+	_ = db.closeDataFiles()
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.False(t, listener.opens[1].FromSnapshot)
+	assert.Equal(t, 500, db.index.Size())
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, listener.opens[2].FromSnapshot)
+	assert.Equal(t, 500, db.index.Size())
+	report, err := db.Verify(DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	DestroyDB(db)
+}
+
+func TestDB_IndexCheckpointInterval(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.IndexType = BTree
+	opts.IndexCheckpointInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	name := filepath.Join(dir, data.IndexSnapshotName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDB_CheckpointConcurrentWrites(t *testing.T) {
+	listener := &testEventListener{}
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-writes")
+	opts.DirPath = dir
+	opts.IndexType = SkipList
+	opts.EventListener = listener
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer DestroyDB(db)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 创建快照之后释放锁，写入快照文件期间的写入不会被阻塞，也不会出现在快照中
+	db.lo.RLock()
+	snapshot := db.takeIndexSnapshot()
+	db.lo.RUnlock()
+	for i := 0; i < 50; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put(utils.GetTestKey(1000), utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	err = db.writeIndexSnapshot(snapshot)
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// 不关闭数据库，模拟崩溃之后重启，快照之后的写入会被重放
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, listener.opens[1].FromSnapshot)
+	assert.Equal(t, 51, db2.index.Size())
+	_, err = db2.Get(utils.GetTestKey(10))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	value, err := db2.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1000), value)
+	_ = db2.closeDataFiles()
+}
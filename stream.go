@@ -0,0 +1,235 @@
+package LustreDB
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"hash/crc32"
+	"io"
+)
+
+// 流式写入时每个分块的最大长度
+const maxStreamChunkSize = 4 * 1024 * 1024
+
+// PutReader 从 reader 中流式读取 size 长度的 value 写入，适合内存放不下的大 value
+// value 被切分成多个分块依次写入数据文件，全部写完后再写入一条记录分块位置的数据，这条数据写入成功才算写入完成
+func (db *DB) PutReader(key []byte, reader io.Reader, size int64) error {
+	err := db.checkKeySize(key)
+	if err != nil {
+		return err
+	}
+	err = db.checkValueSize(key, size, true)
+	if err != nil {
+		return err
+	}
+	// 提前检查磁盘空间，避免写入一部分分块之后才失败
+	err = db.checkWritable(size)
+	if err != nil {
+		return err
+	}
+
+	// 写入期间不允许 merge 开始，防止还没有被索引引用的分块被 merge 清理掉
+	db.streamLock.RLock()
+	defer db.streamLock.RUnlock()
+
+	chunkSize := db.streamChunkSize()
+	if size < chunkSize {
+		chunkSize = size
+	}
+	buf := make([]byte, chunkSize)
+	manifest := &data.StreamManifest{Size: size}
+	chunkKey := logRecordKeyWithSeq(key, nonTransactionSeq)
+
+	var written int64
+	for written < size {
+		n := chunkSize
+		if size-written < n {
+			n = size - written
+		}
+		_, err := io.ReadFull(reader, buf[:n])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		manifest.Crc = crc32.Update(manifest.Crc, crc32.IEEETable, buf[:n])
+
+		pos, err := db.appendLogRecordWithLock(&data.LogRecord{
+			Key:   chunkKey,
+			Value: buf[:n],
+			Type:  data.LogRecordChunk,
+		})
+		if err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, pos)
+		written += n
+	}
+
+	db.lo.Lock()
+	defer db.lo.Unlock()
+
+	// 流式写入的 value 不会建立二级索引，但是需要在同一个事务中删除旧的 value 的索引数据
+	if len(db.secondaryIndexes) > 0 {
+		return db.commitRecords([]*data.LogRecord{{
+			Key:   key,
+			Value: data.EncodeStreamManifest(manifest),
+			Type:  data.LogRecordStream,
+		}}, false)
+	}
+
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:   chunkKey,
+		Value: data.EncodeStreamManifest(manifest),
+		Type:  data.LogRecordStream,
+	})
+	if err != nil {
+		return err
+	}
+
+	// 保存在磁盘上的索引需要同时记录已经应用的位置
+	if !db.applyIndex([][]byte{key}, []*data.LogRecordPos{pos}, nil) {
+		return utils.ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// GetReader 获取 key 对应 value 的 reader，流式写入的 value 会按分块依次读取，不会一次性读入内存
+// 读取结束之后需要调用 Close，在这之前 merge 替换掉的数据文件不会被关闭
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, utils.ErrKeyIsEmpty
+	}
+	if isInternalKey(key) {
+		return nil, utils.ErrKeyNotFound
+	}
+
+	// 先持有所有文件的引用再查找，merge 之后分块所在的旧文件也能继续读取
+	// merge 先加入新文件并更新索引，再去掉旧文件，所以查找到的位置一定在持有引用的文件中
+	files := db.pinFiles()
+	if files == nil {
+		return nil, utils.ErrDataFileNotFound
+	}
+	get, err := db.lookup(key)
+	if err != nil {
+		files.unpin()
+		return nil, err
+	}
+	if get == nil {
+		files.unpin()
+		return nil, utils.ErrKeyNotFound
+	}
+	record, err := db.readLogRecordIn(files, get)
+	if err != nil {
+		files.unpin()
+		return nil, err
+	}
+
+	switch record.Type {
+	case data.LogRecordDelete:
+		files.unpin()
+		return nil, utils.ErrDataFileNotFound
+	case data.LogRecordStream:
+		manifest, err := data.DecodeStreamManifest(record.Value)
+		if err != nil {
+			files.unpin()
+			return nil, err
+		}
+		return &streamReader{db: db, files: files, manifest: manifest}, nil
+	default:
+		files.unpin()
+		return io.NopCloser(bytes.NewReader(record.Value)), nil
+	}
+}
+
+// 每个分块的大小，保证一个分块可以放进一个数据文件中
+func (db *DB) streamChunkSize() int64 {
+	chunkSize := int64(maxStreamChunkSize)
+	if db.options.DataFileSize/2 < chunkSize {
+		chunkSize = db.options.DataFileSize / 2
+	}
+	if chunkSize <= 0 {
+		chunkSize = 1
+	}
+	return chunkSize
+}
+
+// 读取流式写入的 value 的所有分块，拼接成完整的 value
+func (db *DB) readStream(files *fileView, manifest *data.StreamManifest) ([]byte, error) {
+	value := make([]byte, 0, manifest.Size)
+	for _, pos := range manifest.Chunks {
+		chunk, err := db.readStreamChunk(files, pos)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk...)
+	}
+	if int64(len(value)) != manifest.Size || crc32.ChecksumIEEE(value) != manifest.Crc {
+		return nil, utils.ErrorIncorrectCrc
+	}
+	return value, nil
+}
+
+// 读取一个分块
+func (db *DB) readStreamChunk(files *fileView, pos *data.LogRecordPos) ([]byte, error) {
+	record, err := db.readLogRecordIn(files, pos)
+	if err != nil {
+		return nil, err
+	}
+	if record.Type != data.LogRecordChunk {
+		return nil, utils.ErrDataDirectoryCorrupted
+	}
+	return record.Value, nil
+}
+
+// streamReader 按分块依次读取流式写入的 value，读完之后校验整个 value 的 crc
+type streamReader struct {
+	db *DB
+	// 创建时持有引用的数据文件，Close 时释放
+	files    *fileView
+	manifest *data.StreamManifest
+	// 下一个要读取的分块
+	next int
+	// 当前分块中还没有被读取的数据
+	buf    []byte
+	crc    uint32
+	read   int64
+	closed bool
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if sr.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for len(sr.buf) == 0 {
+		if sr.next == len(sr.manifest.Chunks) {
+			if sr.read != sr.manifest.Size || sr.crc != sr.manifest.Crc {
+				return 0, utils.ErrorIncorrectCrc
+			}
+			return 0, io.EOF
+		}
+
+		chunk, err := sr.db.readStreamChunk(sr.files, sr.manifest.Chunks[sr.next])
+		if err != nil {
+			return 0, err
+		}
+		sr.next++
+		sr.crc = crc32.Update(sr.crc, crc32.IEEETable, chunk)
+		sr.read += int64(len(chunk))
+		sr.buf = chunk
+	}
+
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+func (sr *streamReader) Close() error {
+	if !sr.closed {
+		sr.files.unpin()
+	}
+	sr.closed = true
+	sr.buf = nil
+	return nil
+}
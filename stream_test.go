@@ -0,0 +1,134 @@
+package LustreDB
+
+import (
+	"bytes"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDB_PutReader(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	// value 比数据文件还要大
+	value := make([]byte, 1024*1024+123)
+	rand.Read(value)
+	err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("small"))
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		reader, err := db.GetReader(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		got, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, value, got)
+
+		got, err = db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+
+		size, err := db.ValueSize(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(value)), size)
+
+		reader, err = db.GetReader(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		got, err = io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("small"), got)
+
+		assert.Equal(t, 2, len(db.ListKeys()))
+	}
+	check(db)
+
+	// 重启
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+
+	// merge 之后重启
+	err = db.Put(utils.GetTestKey(3), []byte("will be deleted"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	check(db)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_PutReaderShortRead(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-short")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer DestroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(make([]byte, 100*1024)), 200*1024)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 没有写完的数据不可见
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	_, err = db.GetReader(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestDB_PutReaderPersistentIndex(t *testing.T) {
+	for _, indexType := range []index.IndexerType{BPtree, DiskHash} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-stream-persistent")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		value := make([]byte, 100*1024)
+		rand.Read(value)
+		err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+		assert.Nil(t, err)
+
+		// 流式写入也会记录已经应用到索引中的位置
+		applied, _ := db.index.(index.PersistentIndexer).Applied()
+		assert.Equal(t, &data.LogRecordPos{Fid: db.activeFile().FileId, Offset: db.activeFile().WriteOff}, applied)
+
+		// 不正常关闭，重启之后不需要重放
+		_ = db.index.Close()
+		_ = db.closeDataFiles()
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		got, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+		DestroyDB(db)
+	}
+}
@@ -1,8 +1,10 @@
 package LustreDB
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
 	"github.com/lustresix/lxdb/utils"
 	"io"
 	"os"
@@ -16,49 +18,65 @@ import (
 // 在访问此方法必须要持有互斥锁
 func (db *DB) setActiveData() error {
 	var initialFileId uint32 = 0
-	if db.activeFiles != nil {
+	if db.activeFile() != nil {
 		// 如果当前活跃文件id不为空，那么新的文件的id就是原来的+1
-		initialFileId = db.activeFiles.FileId + 1
+		initialFileId = db.activeFile().FileId + 1
 	}
+	return db.openActiveFile(initialFileId)
+}
 
+// 以 fileId 打开新的活跃文件，原来的活跃文件转为旧文件
+// 在访问此方法必须要持有互斥锁
+func (db *DB) openActiveFile(fileId uint32) error {
 	// 打开新的数据文件
-	file, err := data.OpenDataFile(db.options.DirPath, initialFileId)
+	file, err := data.OpenDataFileWithChecksum(db.options.DirPath, fileId, db.options.Checksum)
 	if err != nil {
 		return err
 	}
 
-	db.activeFiles = file
+	// 原来的活跃文件转为旧文件，整体替换视图
+	db.files.Store(db.files.Load().rotate(file))
 	return nil
 }
 
-// 从磁盘中加载数据文件
-func (db *DB) loadDataFiles() error {
-	dir, err := os.ReadDir(db.options.DirPath)
+// 将当前活跃文件持久化后转为旧文件，并打开新的活跃文件
+// 在访问此方法必须要持有互斥锁
+func (db *DB) rotateActiveFile() error {
+	return db.rotateActiveFileTo(db.activeFile().FileId + 1)
+}
+
+// 同 rotateActiveFile，新的活跃文件使用指定的 id，merge 时用来给 merge 生成的数据文件预留 id
+// 在访问此方法必须要持有互斥锁
+func (db *DB) rotateActiveFileTo(fileId uint32) error {
+	// 先将数据持久化
+	err := db.syncActiveFile()
 	if err != nil {
 		return err
 	}
-	var fileIds []int
-	// 遍历目录中的文件，找到所有以 .data 结尾的文件
-	for _, entry := range dir {
-		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
-			// 自动生成的数据是比如说 0001.lx
-			// 切割后取 0001 为自动生成的文件名
-			// 如果这个已经不是数字了，那么就判定为文件被损坏
-			split := strings.Split(entry.Name(), ".")
-			atoi, err := strconv.Atoi(split[0])
-			if err != nil {
-				return utils.ErrDataDirectoryCorrupted
-			}
-			fileIds = append(fileIds, atoi)
-		}
+	oldFid := db.activeFile().FileId
+
+	// 打开新的数据文件，将活跃文件转化为旧文件
+	err = db.openActiveFile(fileId)
+	if err != nil {
+		return err
 	}
+	db.options.EventListener.OnFileRotated(oldFid, db.activeFile().FileId)
 
-	// 对文件 id 进行排序，从小到大依次加载
-	sort.Ints(fileIds)
+	// 其他文件（hint、索引快照等）的大小变化只在这里重新统计
+	return db.refreshDiskUsage()
+}
+
+// 从磁盘中加载数据文件
+func (db *DB) loadDataFiles() error {
+	fileIds, err := getDataFileIds(db.options.DirPath)
+	if err != nil {
+		return err
+	}
 	// 啊啊啊为什么
 	db.fileIds = fileIds
 
 	// 遍历每个文件 id， 打开对应的数据文件
+	view := &fileView{older: make(map[uint32]*data.DataFile)}
 	for i, fid := range fileIds {
 		file, err := data.OpenDataFile(db.options.DirPath, uint32(fid))
 		if err != nil {
@@ -66,11 +84,12 @@ func (db *DB) loadDataFiles() error {
 		}
 		// 如果这是最后一个文件，代表他是活跃的文件
 		if i == len(fileIds)-1 {
-			db.activeFiles = file
+			view.active = file
 		} else {
-			db.olderFiles[uint32(fid)] = file
+			view.older[uint32(fid)] = file
 		}
 	}
+	db.files.Store(view)
 
 	return nil
 
@@ -78,34 +97,24 @@ func (db *DB) loadDataFiles() error {
 
 // 从数据文件中加载索引
 // 遍历文件中的记录，并更新到内部索引
-func (db *DB) loadIndexFromDataFiles() error {
+// start 不为空时从这个位置开始加载，之前的数据已经从索引快照中加载了
+func (db *DB) loadIndexFromDataFiles(start *data.LogRecordPos) error {
 	// 如果是空的数据库就返回
 	if len(db.fileIds) == 0 {
 		return nil
 	}
 
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var ok bool
-		// 如果是删除的类型就从索引当中删除
-		if typ == data.LogRecordDelete {
-			ok = db.index.Delete(key)
-		} else {
-			ok = db.index.Put(key, pos)
-		}
-
-		if !ok {
-			panic("fail to update at start")
-		}
-	}
+	// 每个数据文件的索引更新先合并在一起，读完一个文件后批量写入索引
+	updates := newIndexUpdates()
 
 	// 暂存事务的数据
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo = nonTransactionSeq
+	var currentSeqNo = db.seqNo
 	hasMerged, mergeID := false, 0
 	join := filepath.Join(db.options.DirPath, data.MergeFileName)
 	_, err := os.Stat(join)
 	if err == nil {
-		fid, err := db.NoMergeFinishedFid(join)
+		fid, err := db.NoMergeFinishedFid(db.options.DirPath)
 		if err != nil {
 			return err
 		}
@@ -113,68 +122,79 @@ func (db *DB) loadIndexFromDataFiles() error {
 		mergeID = int(fid)
 	}
 
-	// 遍历所有文件id，处理文件中的记录
-	for i, fileId := range db.fileIds {
+	// 找到需要加载的数据文件
+	var loadFiles []*data.DataFile
+	var startOffsets []int64
+	for _, fileId := range db.fileIds {
 		var id = uint32(fileId)
-		// 如果比merge的id更小说明还没有在hint文件中
-		if hasMerged && mergeID < fileId {
+		// 如果比merge的id更小说明已经在hint文件中了
+		if hasMerged && fileId < mergeID {
+			continue
+		}
+		// 索引快照中已经包含了
+		if start != nil && id < start.Fid {
 			continue
 		}
 		var dataFile *data.DataFile
-		if id == db.activeFiles.FileId {
-			dataFile = db.activeFiles
+		if id == db.activeFile().FileId {
+			dataFile = db.activeFile()
 		} else {
-			dataFile = db.olderFiles[id]
+			dataFile = db.olderFiles()[id]
 		}
 
-		var offset int64 = 0
-		for {
-			read, size, err := dataFile.Read(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-
-			// 构建索引并保存
-			pos := &data.LogRecordPos{Fid: id, Offset: offset}
+		var offset = dataFile.DataOffset()
+		if start != nil && id == start.Fid {
+			offset = start.Offset
+		}
+		loadFiles = append(loadFiles, dataFile)
+		startOffsets = append(startOffsets, offset)
+	}
 
-			// 解析 key，拿到事务
-			record, u := parseLogRecord(read.Key)
+	// 多个协程同时读取数据文件，再按照文件 id 的顺序依次更新索引，保证后写入的数据覆盖先写入的
+	results := db.readIndexRecordsParallel(loadFiles, startOffsets)
+	defer results.stop()
+	for i, dataFile := range loadFiles {
+		result := results.wait(i)
+		id := dataFile.FileId
 
-			if u == nonTransactionSeq {
+		for _, read := range result.records {
+			if read.seq == nonTransactionSeq {
 				// 非事务操作，直接更新
-				updateIndex(record, read.Type, pos)
+				updates.add(read.key, read.typ, read.pos)
 			} else {
-				// 事务中如果读取到完成，再更新到索引
-				if read.Type == data.LogRecordFinish {
-					for _, txnRecord := range transactionRecords[u] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, pos)
+				// 事务中如果读取到完成，再更新到索引，事务的数据可能跨越多个文件
+				if read.typ == data.LogRecordFinish {
+					for _, txnRecord := range transactionRecords[read.seq] {
+						updates.add(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
 					}
-					delete(transactionRecords, u)
+					delete(transactionRecords, read.seq)
 				} else {
 					// 如果读取先暂存在transactionRecord里面
-					read.Key = record
-					transactionRecords[u] = append(transactionRecords[u], &data.TransactionRecord{
-						Record: read,
-						Pos:    pos,
+					transactionRecords[read.seq] = append(transactionRecords[read.seq], &data.TransactionRecord{
+						Record: &data.LogRecord{Key: read.key, Type: read.typ},
+						Pos:    read.pos,
 					})
 				}
 			}
 
 			// 更新序列号
-			if u > currentSeqNo {
-				currentSeqNo = u
+			if read.seq > currentSeqNo {
+				currentSeqNo = read.seq
 			}
+		}
 
-			// 读取之后偏移数据量的长度
-			offset += size
+		if !updates.flush(db.index) {
+			panic("fail to update at start")
+		}
+
+		if result.err != nil {
+			db.notifyCorruption(id, result.offset, result.err)
+			return result.err
 		}
 
 		// 如果是当前活跃文件，更新这个文件的 offset
-		if i == len(db.fileIds)-1 {
-			db.activeFiles.WriteOff = offset
+		if id == db.activeFile().FileId {
+			db.activeFile().WriteOff = result.offset
 		}
 	}
 
@@ -184,6 +204,254 @@ func (db *DB) loadIndexFromDataFiles() error {
 	return nil
 }
 
+// 把数据的位置更新到索引中，调用时需要持有数据库的锁
+// 保存在磁盘上的索引会同时记录当前活跃文件写入的位置，崩溃之后从这个位置开始恢复
+func (db *DB) applyIndex(putKeys [][]byte, positions []*data.LogRecordPos, deleteKeys [][]byte) bool {
+	if pi, ok := db.index.(index.PersistentIndexer); ok {
+		var applied = &data.LogRecordPos{}
+		if active := db.activeFile(); active != nil {
+			applied.Fid, applied.Offset = active.FileId, active.WriteOff
+		}
+		return pi.Apply(putKeys, positions, deleteKeys, applied, db.seqNo)
+	}
+
+	ok := true
+	if len(putKeys) > 0 {
+		ok = db.index.PutBatch(putKeys, positions)
+	}
+	if len(deleteKeys) > 0 && !db.index.DeleteBatch(deleteKeys) {
+		ok = false
+	}
+	return ok
+}
+
+// 恢复保存在磁盘上的索引，从最后一次应用到索引中的位置开始重放数据文件
+// 索引中没有记录这个位置，或者位置超出了数据文件（数据没有刷盘就崩溃了），都需要重建整个索引
+func (db *DB) recoverPersistentIndex() error {
+	pi := db.index.(index.PersistentIndexer)
+	applied, seqNo := pi.Applied()
+	if seqNo > db.seqNo {
+		db.seqNo = seqNo
+	}
+
+	if applied != nil && !db.validAppliedPos(applied) {
+		applied = nil
+	}
+	if applied == nil && (len(db.fileIds) > 0 || pi.Size() > 0) {
+		if err := pi.Reset(); err != nil {
+			return err
+		}
+		if err := db.loadIndexFromHintFile(); err != nil {
+			return err
+		}
+	}
+	if err := db.loadIndexFromDataFiles(applied); err != nil {
+		return err
+	}
+
+	if db.activeFile() == nil {
+		return nil
+	}
+	// 记录恢复之后的位置，下次打开时不需要再重放
+	if !db.applyIndex(nil, nil, nil) {
+		return utils.ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// 判断索引中记录的位置是否还在数据文件中
+func (db *DB) validAppliedPos(applied *data.LogRecordPos) bool {
+	var dataFile *data.DataFile
+	if active := db.activeFile(); active != nil && active.FileId == applied.Fid {
+		dataFile = active
+	} else {
+		dataFile = db.olderFiles()[applied.Fid]
+	}
+	if dataFile == nil {
+		return false
+	}
+	// merge 之后会从文件的开头开始重放
+	if applied.Offset < dataFile.DataOffset() {
+		applied.Offset = dataFile.DataOffset()
+	}
+	size, err := dataFile.IOManager.Size()
+	return err == nil && applied.Offset <= size
+}
+
+// 索引是否保存在磁盘上，打开时只需要重放最后一次更新索引之后写入的数据
+func isPersistentIndex(indexType index.IndexerType) bool {
+	return indexType == BPtree || indexType == DiskHash
+}
+
+// 暂存的索引更新，同一个 key 只保留最后一次的更新
+type indexUpdates struct {
+	positions map[string]*data.LogRecordPos
+}
+
+func newIndexUpdates() *indexUpdates {
+	return &indexUpdates{positions: make(map[string]*data.LogRecordPos)}
+}
+
+// 记录一次更新，删除类型的记录位置为 nil
+func (u *indexUpdates) add(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	if typ == data.LogRecordDelete {
+		pos = nil
+	}
+	u.positions[string(key)] = pos
+}
+
+// 把暂存的更新批量写入索引并清空
+func (u *indexUpdates) flush(indexer index.Indexer) bool {
+	if len(u.positions) == 0 {
+		return true
+	}
+	var putKeys, deleteKeys [][]byte
+	var positions []*data.LogRecordPos
+	for key, pos := range u.positions {
+		if pos == nil {
+			deleteKeys = append(deleteKeys, []byte(key))
+		} else {
+			putKeys = append(putKeys, []byte(key))
+			positions = append(positions, pos)
+		}
+	}
+	u.positions = make(map[string]*data.LogRecordPos)
+
+	ok := true
+	if len(putKeys) > 0 {
+		ok = indexer.PutBatch(putKeys, positions)
+	}
+	if len(deleteKeys) > 0 && !indexer.DeleteBatch(deleteKeys) {
+		ok = false
+	}
+	return ok
+}
+
+// 从数据文件中读取出的用于构建索引的一条记录
+type indexRecord struct {
+	// 去掉事务序列号之后的 key
+	key []byte
+	seq uint64
+	typ data.LogRecordType
+	pos *data.LogRecordPos
+}
+
+// 读取一个数据文件的结果
+type indexRecordsResult struct {
+	records []*indexRecord
+	// 读取结束的位置，出错时是出错的记录的位置
+	offset int64
+	err    error
+}
+
+// 从 offset 开始读取数据文件中的所有记录，不包括流式写入的分块
+func readIndexRecords(dataFile *data.DataFile, offset int64) *indexRecordsResult {
+	result := &indexRecordsResult{}
+	for {
+		read, size, err := dataFile.Read(offset)
+		if err != nil {
+			if err != io.EOF {
+				result.err = err
+			}
+			break
+		}
+
+		// 分块由流式写入的数据引用，不直接出现在索引中
+		if read.Type != data.LogRecordChunk {
+			// 解析 key，拿到事务
+			key, seq := parseLogRecord(read.Key)
+			result.records = append(result.records, &indexRecord{
+				key: key,
+				seq: seq,
+				typ: read.Type,
+				pos: &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size)},
+			})
+		}
+
+		// 读取之后偏移数据量的长度
+		offset += size
+	}
+	result.offset = offset
+	return result
+}
+
+// 并发读取数据文件的结果，按照文件的顺序获取
+type indexRecordsResults struct {
+	results []chan *indexRecordsResult
+	// 限制同时读取和等待处理的文件数量，避免占用过多的内存
+	slots chan struct{}
+	done  chan struct{}
+}
+
+// 使用 Options.IndexLoadWorkers 个协程并发读取数据文件
+func (db *DB) readIndexRecordsParallel(files []*data.DataFile, offsets []int64) *indexRecordsResults {
+	workers := db.options.IndexLoadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	rs := &indexRecordsResults{
+		results: make([]chan *indexRecordsResult, len(files)),
+		slots:   make(chan struct{}, workers),
+		done:    make(chan struct{}),
+	}
+	for i := range files {
+		rs.results[i] = make(chan *indexRecordsResult, 1)
+	}
+
+	go func() {
+		for i := range files {
+			select {
+			case rs.slots <- struct{}{}:
+			case <-rs.done:
+				return
+			}
+			go func(i int) {
+				rs.results[i] <- readIndexRecords(files[i], offsets[i])
+			}(i)
+		}
+	}()
+	return rs
+}
+
+// 等待第 i 个文件读取完成，并释放它占用的位置
+func (rs *indexRecordsResults) wait(i int) *indexRecordsResult {
+	result := <-rs.results[i]
+	<-rs.slots
+	return result
+}
+
+// 停止读取之后的文件
+func (rs *indexRecordsResults) stop() {
+	close(rs.done)
+}
+
+// 获取目录中所有数据文件的 id，从小到大排序
+func getDataFileIds(dirPath string) ([]int, error) {
+	dir, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []int
+	// 遍历目录中的文件，找到所有以 .data 结尾的文件
+	for _, entry := range dir {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			// 自动生成的数据是比如说 0001.lx
+			// 切割后取 0001 为自动生成的文件名
+			// 如果这个已经不是数字了，那么就判定为文件被损坏
+			split := strings.Split(entry.Name(), ".")
+			atoi, err := strconv.Atoi(split[0])
+			if err != nil {
+				return nil, utils.ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, atoi)
+		}
+	}
+
+	// 对文件 id 进行排序，从小到大依次加载
+	sort.Ints(fileIds)
+	return fileIds, nil
+}
+
 // 检查输入是否正确
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
@@ -192,5 +460,69 @@ func checkOptions(options Options) error {
 	if options.DataFileSize < 0 {
 		return errors.New("database should greater than 0")
 	}
+	if options.IndexShards < 0 {
+		return errors.New("index shards can not be negative")
+	}
+	if options.CacheSize < 0 {
+		return errors.New("cache size can not be negative")
+	}
+	// key 本身也要能放进一条记录中
+	if options.MaxKeySize < 0 || maxValueSize(options.MaxKeySize) < 0 {
+		return errors.New("max key size should between 0 and 4GB")
+	}
+	if options.MaxValueSize < 0 {
+		return errors.New("max value size can not be negative")
+	}
+	if options.MaxDiskUsage < 0 {
+		return errors.New("max disk usage can not be negative")
+	}
+	if options.Checksum != 0 && data.ChecksumTable(options.Checksum) == nil {
+		return errors.New("unsupported checksum type")
+	}
 	return nil
 }
+
+// 检查 key 的长度
+func (db *DB) checkKeySize(key []byte) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if int64(len(key)) > db.maxKeySize() {
+		return utils.ErrKeyTooLarge
+	}
+	return nil
+}
+
+// 写入的 key 允许的最大长度，二级索引生成的内部 key 也要满足这个限制
+func (db *DB) maxKeySize() int64 {
+	limit := db.options.MaxKeySize
+	if limit == 0 {
+		limit = data.MaxLogRecordFieldSize
+	}
+	// 磁盘哈希索引的一个条目必须能放进一个桶页中
+	if db.options.IndexType == DiskHash && limit > index.DiskHashMaxKeySize {
+		limit = index.DiskHashMaxKeySize
+	}
+	return limit
+}
+
+// 检查 value 的长度，streamed 表示流式写入，流式写入的数据会被分块，不受单条记录长度的限制
+func (db *DB) checkValueSize(key []byte, size int64, streamed bool) error {
+	limit := db.options.MaxValueSize
+	if !streamed {
+		// 整条记录的长度不能超过 LogRecordPos.Size 能表示的范围
+		recordLimit := maxValueSize(int64(len(key)))
+		if limit == 0 || limit > recordLimit {
+			limit = recordLimit
+		}
+	}
+	if limit > 0 && size > limit {
+		return utils.ErrValueTooLarge
+	}
+	return nil
+}
+
+// key 的长度为 keySize 时单条记录中 value 的最大长度，写入的 key 前面还有事务序列号
+func maxValueSize(keySize int64) int64 {
+	return data.MaxLogRecordValueSize(keySize + binary.MaxVarintLen64)
+}
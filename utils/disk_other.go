@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package utils
+
+// AvailableDiskSize 当前平台无法获取可用空间，返回 -1
+func AvailableDiskSize(dirPath string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package utils
+
+import "syscall"
+
+// AvailableDiskSize 获取目录所在的文件系统中当前用户可用的空间
+func AvailableDiskSize(dirPath string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -18,4 +18,32 @@ var (
 	ErrorOverMaxNumber = errors.New("the context is over the max number")
 
 	ErrorMergeIsProgress = errors.New("the process is in merge,please wait for a moment")
+
+	ErrMergeFileIdExhausted = errors.New("merge output exceeds the reserved file ids")
+
+	ErrKeyTooLarge = errors.New("key is too large")
+
+	ErrKeyIsReserved = errors.New("key uses the reserved internal prefix")
+
+	ErrValueTooLarge = errors.New("value is too large")
+
+	ErrUnsupportedFileFormat = errors.New("unsupported data file format")
+
+	ErrUnsupportedDumpFormat = errors.New("unsupported dump format")
+
+	ErrInvalidDump = errors.New("invalid dump data")
+
+	ErrIndexKeyMismatch = errors.New("index key does not match the record")
+
+	ErrIndexPointsToDeleted = errors.New("index points to a deleted record")
+
+	ErrSeqNoMismatch = errors.New("saved seq no is less than the max seq no in data files")
+
+	ErrSecondaryIndexExists = errors.New("secondary index already exists")
+
+	ErrSecondaryIndexNotFound = errors.New("secondary index not found")
+
+	ErrDiskQuotaExceeded = errors.New("disk usage exceeds the quota")
+
+	ErrReadOnly = errors.New("database is read-only because the disk is full")
 )
@@ -0,0 +1,424 @@
+package LustreDB
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/index"
+	"github.com/lustresix/lxdb/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// ProblemKind 校验发现的问题的类型
+type ProblemKind int8
+
+const (
+	// ProblemCorruptRecord 记录的 crc 校验不通过或者头部损坏
+	ProblemCorruptRecord ProblemKind = iota + 1
+
+	// ProblemTruncatedRecord 文件末尾有不完整的记录，一般是写入的过程中崩溃了
+	ProblemTruncatedRecord
+
+	// ProblemBadFile 文件无法打开或者读取，比如文件头部损坏
+	ProblemBadFile
+
+	// ProblemBadHint hint 文件中的数据没有指向有效的记录
+	ProblemBadHint
+
+	// ProblemBadIndex 索引中的数据没有指向有效的记录
+	ProblemBadIndex
+
+	// ProblemSeqNo 保存的事务序列号比数据文件中最大的序列号小
+	ProblemSeqNo
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemCorruptRecord:
+		return "corrupt record"
+	case ProblemTruncatedRecord:
+		return "truncated record"
+	case ProblemBadFile:
+		return "bad file"
+	case ProblemBadHint:
+		return "bad hint entry"
+	case ProblemBadIndex:
+		return "bad index entry"
+	case ProblemSeqNo:
+		return "seq no mismatch"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyProblem 校验发现的一个问题
+type VerifyProblem struct {
+	// 问题的类型
+	Kind ProblemKind
+
+	// 出现问题的文件，内存索引的问题为空
+	File string
+
+	// 问题在文件中的偏移
+	Offset int64
+
+	// hint 文件和索引中出现问题的 key
+	Key []byte
+
+	// hint 文件和索引中出现问题的数据指向的位置
+	Pos *data.LogRecordPos
+
+	// 具体的错误
+	Err error
+}
+
+func (p *VerifyProblem) String() string {
+	s := fmt.Sprintf("%s: %s offset %d", p.Kind, p.File, p.Offset)
+	if p.Key != nil {
+		s += fmt.Sprintf(" key %q", p.Key)
+	}
+	if p.Pos != nil {
+		s += fmt.Sprintf(" -> fid %d offset %d", p.Pos.Fid, p.Pos.Offset)
+	}
+	return s + ": " + p.Err.Error()
+}
+
+// VerifyReport 校验的结果
+type VerifyReport struct {
+	// 检查的数据文件数量
+	DataFileNum int
+
+	// 检查的记录数量
+	RecordNum int
+
+	// 检查的 hint 文件中的数据数量
+	HintEntryNum int
+
+	// 检查的索引中的数据数量
+	IndexEntryNum int
+
+	// 数据文件中最大的事务序列号
+	MaxSeqNo uint64
+
+	// 保存的事务序列号
+	SeqNo uint64
+
+	// 发现的问题
+	Problems []*VerifyProblem
+
+	// 问题数量达到 MaxProblems 后提前停止了校验
+	Incomplete bool
+}
+
+// OK 是否没有发现问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify 检查数据库的完整性，会重新读取所有数据文件中的每一条记录校验 crc
+// 并检查 hint 文件和索引中的数据都指向 key 相同的有效记录，以及事务序列号是否正确
+// 校验期间持有读锁，不影响读取，但写入会被阻塞
+// 发现的问题记录在返回的报告中，返回的错误表示校验本身无法进行
+func (db *DB) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	db.lo.RLock()
+	defer db.lo.RUnlock()
+
+	v := newVerifier(db.options.DirPath, opts)
+	for fid, file := range db.olderFiles() {
+		v.files[fid] = file
+	}
+	if db.activeFile() != nil {
+		v.files[db.activeFile().FileId] = db.activeFile()
+	}
+	v.report.DataFileNum = len(v.files)
+	v.verifyDataFiles()
+
+	if opts.CheckHint {
+		err := v.verifyHintFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CheckIndex {
+		verifyEntry := func(key []byte, pos *data.LogRecordPos) bool {
+			v.report.IndexEntryNum++
+			return v.verifyPos(ProblemBadIndex, "", key, pos)
+		}
+		if bpt, ok := db.index.(*index.BPTree); ok {
+			err := bpt.ForEach(verifyEntry)
+			if err != nil {
+				return nil, err
+			}
+		} else if iterator := db.index.Iterator(false); iterator != nil {
+			for iterator.Rewind(); iterator.Valid() && !v.stopped(); iterator.Next() {
+				verifyEntry(iterator.Key(), iterator.Value())
+			}
+			iterator.Close()
+		}
+	}
+
+	v.verifySeqNo(db.seqNo)
+	return v.report, nil
+}
+
+// VerifyDir 不打开数据库，直接检查目录中的数据，检查的内容和 DB.Verify 相同
+// 索引只检查保存在磁盘中的 B+ 树索引，目录不能被其他进程以 B+ 树索引打开
+func VerifyDir(dirPath string, opts VerifyOptions) (*VerifyReport, error) {
+	fileIds, err := getDataFileIds(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	v := newVerifier(dirPath, opts)
+	defer func() {
+		for _, file := range v.files {
+			_ = file.Close()
+		}
+	}()
+	v.report.DataFileNum = len(fileIds)
+	for _, fid := range fileIds {
+		name := data.GetDataFileName(dirPath, uint32(fid))
+		// 以只读方式打开，不会修改目录中的文件
+		file, err := data.OpenDataFileReadOnly(dirPath, uint32(fid))
+		if err != nil {
+			if !v.addProblem(&VerifyProblem{Kind: ProblemBadFile, File: name, Err: err}) {
+				return v.report, nil
+			}
+			continue
+		}
+		v.files[uint32(fid)] = file
+	}
+	v.verifyDataFiles()
+
+	if opts.CheckHint {
+		err := v.verifyHintFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	indexFile := index.BPTreeIndexFileName(dirPath)
+	if _, err := os.Stat(indexFile); opts.CheckIndex && err == nil {
+		err := index.ForEachBPTreeIndex(dirPath, func(key []byte, pos *data.LogRecordPos) bool {
+			v.report.IndexEntryNum++
+			return v.verifyPos(ProblemBadIndex, indexFile, key, pos)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seqNo, ok, err := readSavedSeqNo(dirPath)
+	if err != nil {
+		v.addProblem(&VerifyProblem{Kind: ProblemSeqNo, File: filepath.Join(dirPath, data.SeqNoName), Err: err})
+	} else if ok {
+		v.verifySeqNo(seqNo)
+	}
+	return v.report, nil
+}
+
+// 检查过程中的状态
+type verifier struct {
+	dirPath string
+	options VerifyOptions
+	report  *VerifyReport
+
+	// 可以读取的数据文件
+	files map[uint32]*data.DataFile
+}
+
+func newVerifier(dirPath string, opts VerifyOptions) *verifier {
+	return &verifier{
+		dirPath: dirPath,
+		options: opts,
+		report:  &VerifyReport{},
+		files:   make(map[uint32]*data.DataFile),
+	}
+}
+
+// 记录一个问题，问题数量达到上限时返回 false
+func (v *verifier) addProblem(problem *VerifyProblem) bool {
+	v.report.Problems = append(v.report.Problems, problem)
+	if v.options.MaxProblems > 0 && len(v.report.Problems) >= v.options.MaxProblems {
+		v.report.Incomplete = true
+	}
+	return !v.report.Incomplete
+}
+
+func (v *verifier) stopped() bool {
+	return v.report.Incomplete
+}
+
+// 按照文件 id 从小到大检查所有的数据文件
+func (v *verifier) verifyDataFiles() {
+	var fileIds []int
+	for fid := range v.files {
+		fileIds = append(fileIds, int(fid))
+	}
+	sort.Ints(fileIds)
+	for _, fid := range fileIds {
+		if v.stopped() {
+			return
+		}
+		v.verifyDataFile(v.files[uint32(fid)])
+	}
+}
+
+// 读取数据文件中的每一条记录，读取时会校验 crc
+func (v *verifier) verifyDataFile(file *data.DataFile) {
+	name := data.GetDataFileName(v.dirPath, file.FileId)
+	size, err := file.IOManager.Size()
+	if err != nil {
+		v.addProblem(&VerifyProblem{Kind: ProblemBadFile, File: name, Err: err})
+		return
+	}
+
+	offset := file.DataOffset()
+	for offset < size {
+		record, n, err := file.Read(offset)
+		if err == io.EOF {
+			// 还没有到文件末尾就读不出完整的记录
+			v.addProblem(&VerifyProblem{Kind: ProblemTruncatedRecord, File: name, Offset: offset, Err: io.ErrUnexpectedEOF})
+			return
+		}
+		if err != nil {
+			if !v.addProblem(&VerifyProblem{Kind: ProblemCorruptRecord, File: name, Offset: offset, Err: err}) {
+				return
+			}
+			// 头部损坏时无法知道记录的长度，后面的数据也无法读取了
+			if n == 0 {
+				return
+			}
+			offset += n
+			continue
+		}
+
+		v.report.RecordNum++
+		if _, seq := parseLogRecord(record.Key); seq > v.report.MaxSeqNo {
+			v.report.MaxSeqNo = seq
+		}
+		offset += n
+	}
+}
+
+// 检查 hint 文件中的每一条数据
+func (v *verifier) verifyHintFile() error {
+	name := filepath.Join(v.dirPath, data.HintFileName)
+	file, err := data.OpenFileReadOnly(name, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var offset int64 = 0
+	for !v.stopped() {
+		record, n, err := file.Read(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.addProblem(&VerifyProblem{Kind: ProblemBadHint, File: name, Offset: offset, Err: err})
+			if n == 0 {
+				break
+			}
+			offset += n
+			continue
+		}
+
+		v.report.HintEntryNum++
+		pos := data.DecodeLogRecordPos(record.Value)
+		if !v.verifyPos(ProblemBadHint, name, record.Key, pos) {
+			break
+		}
+		offset += n
+	}
+	return nil
+}
+
+// 检查 pos 指向的是 key 对应的有效记录，问题数量达到上限时返回 false
+func (v *verifier) verifyPos(kind ProblemKind, source string, key []byte, pos *data.LogRecordPos) bool {
+	err := v.checkPos(key, pos)
+	if err != nil {
+		return v.addProblem(&VerifyProblem{Kind: kind, File: source, Key: key, Pos: pos, Err: err})
+	}
+	return !v.stopped()
+}
+
+func (v *verifier) checkPos(key []byte, pos *data.LogRecordPos) error {
+	file, ok := v.files[pos.Fid]
+	if !ok {
+		return utils.ErrDataFileNotFound
+	}
+	record, err := file.ReadRecord(pos)
+	if err != nil {
+		return err
+	}
+	realKey, _ := parseLogRecord(record.Key)
+	if !bytes.Equal(realKey, key) {
+		return utils.ErrIndexKeyMismatch
+	}
+	switch record.Type {
+	case data.LogRecordNormal, data.LogRecordStream:
+		return nil
+	case data.LogRecordDelete:
+		return utils.ErrIndexPointsToDeleted
+	default:
+		return utils.ErrDataDirectoryCorrupted
+	}
+}
+
+// 保存的事务序列号不能比数据文件中已经使用过的小，否则新的事务会重复使用序列号
+func (v *verifier) verifySeqNo(seqNo uint64) {
+	v.report.SeqNo = seqNo
+	if seqNo < v.report.MaxSeqNo {
+		v.addProblem(&VerifyProblem{
+			Kind: ProblemSeqNo,
+			File: filepath.Join(v.dirPath, data.SeqNoName),
+			Err:  utils.ErrSeqNoMismatch,
+		})
+	}
+}
+
+// 读取 seq-no 文件中最后保存的事务序列号，文件不存在时 ok 为 false
+func readSavedSeqNo(dirPath string) (uint64, bool, error) {
+	file, err := data.OpenFileReadOnly(filepath.Join(dirPath, data.SeqNoName), 0)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var seqNo uint64
+	var ok bool
+	var offset int64 = 0
+	for {
+		record, n, err := file.Read(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		seqNo, err = strconv.ParseUint(string(record.Value), 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		ok = true
+		offset += n
+	}
+	return seqNo, ok, nil
+}
@@ -0,0 +1,178 @@
+package LustreDB
+
+import (
+	"github.com/lustresix/lxdb/data"
+	"github.com/lustresix/lxdb/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Verify(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(1), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	// merge 的结果已经替换了旧的数据文件，hint 文件中的数据也要检查
+	report, err := db.Verify(DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 902, report.RecordNum)
+	assert.Equal(t, 900, report.HintEntryNum)
+	assert.Equal(t, 901, report.IndexEntryNum)
+	assert.Equal(t, uint64(1), report.MaxSeqNo)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	report, err = db.Verify(DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 900, report.HintEntryNum)
+	assert.Equal(t, 901, report.IndexEntryNum)
+	DestroyDB(db)
+}
+
+func TestVerifyDir(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-dir")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(10), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	report, err := VerifyDir(dir, DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, report.DataFileNum)
+	assert.Equal(t, 12, report.RecordNum)
+	assert.Equal(t, uint64(1), report.SeqNo)
+
+	// 改坏第二条记录，并在文件末尾追加不完整的数据
+	name := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	file, err := data.OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+	_, size, err := file.Read(file.DataOffset())
+	assert.Nil(t, err)
+	_ = file.Close()
+	buf[data.FileHeaderSize+size+size-1] ^= 0xff
+	buf = append(buf, buf[data.FileHeaderSize:data.FileHeaderSize+size-1]...)
+	err = os.WriteFile(name, buf, 0644)
+	assert.Nil(t, err)
+
+	report, err = VerifyDir(dir, DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(report.Problems))
+	assert.Equal(t, ProblemCorruptRecord, report.Problems[0].Kind)
+	assert.Equal(t, data.FileHeaderSize+size, report.Problems[0].Offset)
+	assert.Equal(t, utils.ErrorIncorrectCrc, report.Problems[0].Err)
+	assert.Equal(t, ProblemTruncatedRecord, report.Problems[1].Kind)
+	// 损坏的记录之后的数据也被检查了
+	assert.Equal(t, 11, report.RecordNum)
+
+	verifyOpts := DefaultVerifyOptions
+	verifyOpts.MaxProblems = 1
+	report, err = VerifyDir(dir, verifyOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Problems))
+	assert.True(t, report.Incomplete)
+}
+
+func TestVerifyDir_SeqNo(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-seq")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(1), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 保存一个比数据文件中小的序列号
+	err = os.Remove(dir + "/" + data.SeqNoName)
+	assert.Nil(t, err)
+	file, err := data.OpenSeqNoFile(dir)
+	assert.Nil(t, err)
+	record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte(seqNoKey), Value: []byte("0")})
+	err = file.Write(record)
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	report, err := VerifyDir(dir, DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, ProblemSeqNo, report.Problems[0].Kind)
+	assert.Equal(t, utils.ErrSeqNoMismatch, report.Problems[0].Err)
+}
+
+func TestVerifyDir_ReadOnly(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-dir-read-only")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 目录不存在时返回错误，不会被创建
+	_, err := VerifyDir(filepath.Join(dir, "not-exist"), DefaultVerifyOptions)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "not-exist"))
+	assert.True(t, os.IsNotExist(err))
+
+	// 空的数据文件不会被写入头部，也不会创建 hint 和 seq-no 文件
+	name := data.GetDataFileName(dir, 0)
+	assert.Nil(t, os.WriteFile(name, nil, 0644))
+	report, err := VerifyDir(dir, DefaultVerifyOptions)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	stat, err := os.Stat(name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+}